@@ -0,0 +1,262 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/asig/odit/internal/filesystem"
+)
+
+// Archive formats for export and import
+const (
+	archiveTar = "tar"
+	archiveZip = "zip"
+)
+
+// exportArchive writes all files of the image to the archive name, or to
+// stdout if name is "-". Entries are streamed from the image one by one.
+func exportArchive(fs *filesystem.FileSystem, name, format string) error {
+	files, err := fs.ListFiles(filesystem.AllFiles)
+	if err != nil {
+		return fmt.Errorf("error listing files: %w", err)
+	}
+
+	var out io.Writer = os.Stdout
+	var outFile *os.File
+	if name != "-" {
+		if outFile, err = os.Create(name); err != nil {
+			return fmt.Errorf("error creating %s: %w", name, err)
+		}
+		defer outFile.Close()
+		out = outFile
+	}
+	bw := bufio.NewWriter(out)
+
+	var total int64
+	if format == archiveZip {
+		total, err = writeZip(bw, files)
+	} else {
+		total, err = writeTar(bw, files)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil && outFile != nil {
+		err = outFile.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+
+	if name == "-" {
+		// stdout is taken by the archive
+		return nil
+	}
+	summary := newTable("export", styleRecord, column{"files", "Files"}, column{"bytes", "Bytes"}, column{"archive", "Archive"})
+	summary.add(len(files), total, name)
+	return printTables(summary)
+}
+
+func writeTar(w io.Writer, files []*filesystem.File) (int64, error) {
+	tw := tar.NewWriter(w)
+	var total int64
+	for _, f := range files {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.Name(),
+			Size:     int64(f.Size()),
+			Mode:     0644,
+			ModTime:  f.ModTime(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return total, err
+		}
+		n, err := io.Copy(tw, io.NewSectionReader(f, 0, hdr.Size))
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+	}
+	return total, tw.Close()
+}
+
+func writeZip(w io.Writer, files []*filesystem.File) (int64, error) {
+	zw := zip.NewWriter(w)
+	var total int64
+	for _, f := range files {
+		hdr := &zip.FileHeader{
+			Name:     f.Name(),
+			Method:   zip.Deflate,
+			Modified: f.ModTime(),
+		}
+		hdr.SetMode(0644)
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return total, err
+		}
+		n, err := io.Copy(fw, io.NewSectionReader(f, 0, int64(f.Size())))
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+	}
+	return total, zw.Close()
+}
+
+// archivePath turns the name of an archive entry into a relative, slash
+// separated path.
+func archivePath(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+// tarImport reads a tar file, which may be gzip compressed, for import. The
+// file is read twice: once for the list of entries, and once for the
+// contents, which are streamed into the image.
+type tarImport struct {
+	file *os.File
+	tr   *tar.Reader
+}
+
+func openTarImport(name string) (*tarImport, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", name, err)
+	}
+	return &tarImport{file: file}, nil
+}
+
+// rewind starts reading the archive from the beginning.
+func (t *tarImport) rewind() error {
+	if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	br := bufio.NewReader(t.file)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		r = gz
+	}
+	t.tr = tar.NewReader(r)
+	return nil
+}
+
+func (t *tarImport) entries() ([]importEntry, int, error) {
+	if err := t.rewind(); err != nil {
+		return nil, 0, err
+	}
+	var entries []importEntry
+	skipped := 0
+	for {
+		hdr, err := t.tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		rel := archivePath(hdr.Name)
+		switch {
+		case hdr.Typeflag == tar.TypeDir || hdr.Typeflag == tar.TypeXGlobalHeader:
+		case !hdr.FileInfo().Mode().IsRegular() || isHidden(rel):
+			skipped++
+		default:
+			entries = append(entries, importEntry{path: hdr.Name, rel: rel, size: hdr.Size, mtime: hdr.ModTime})
+		}
+	}
+	t.tr = nil
+	return entries, skipped, nil
+}
+
+// open returns the contents of e. Entries must be opened in archive order.
+func (t *tarImport) open(e importEntry) (io.ReadCloser, error) {
+	if t.tr == nil {
+		if err := t.rewind(); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		hdr, err := t.tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: %s", filesystem.ErrNotFound, e.path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == e.path {
+			return io.NopCloser(t.tr), nil
+		}
+	}
+}
+
+func (t *tarImport) Close() error {
+	return t.file.Close()
+}
+
+// zipImport reads a zip file for import.
+type zipImport struct {
+	zr    *zip.ReadCloser
+	files map[string]*zip.File // by entry name
+}
+
+func openZipImport(name string) (*zipImport, error) {
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", name, err)
+	}
+	return &zipImport{zr: zr, files: make(map[string]*zip.File)}, nil
+}
+
+func (z *zipImport) entries() ([]importEntry, int) {
+	var entries []importEntry
+	skipped := 0
+	for _, f := range z.zr.File {
+		rel := archivePath(f.Name)
+		switch {
+		case f.FileInfo().IsDir():
+		case !f.Mode().IsRegular() || isHidden(rel):
+			skipped++
+		default:
+			// Zip times are the local time of whoever wrote the archive,
+			// which is just what Oberon wants.
+			entries = append(entries, importEntry{path: f.Name, rel: rel, size: int64(f.UncompressedSize64), mtime: f.Modified})
+			z.files[f.Name] = f
+		}
+	}
+	return entries, skipped
+}
+
+func (z *zipImport) open(e importEntry) (io.ReadCloser, error) {
+	return z.files[e.path].Open()
+}
+
+func (z *zipImport) Close() error {
+	return z.zr.Close()
+}
@@ -0,0 +1,121 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveImport(t *testing.T) {
+	mtime := time.Date(2003, 4, 5, 6, 7, 8, 0, time.Local)
+	files := []struct{ name, content string }{
+		{"./src/A.Mod", "MODULE A; END A."},
+		{"src/.git/config", "hidden"},
+		{"B.Text", "some text"},
+	}
+	dir := t.TempDir()
+
+	writeTar := func(name string, compress bool) {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var w io.Writer = f
+		if compress {
+			gz := gzip.NewWriter(f)
+			defer gz.Close()
+			w = gz
+		}
+		tw := tar.NewWriter(w)
+		defer tw.Close()
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "src/", Mode: 0755, ModTime: mtime})
+		for _, file := range files {
+			tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: file.name, Size: int64(len(file.content)), Mode: 0644, ModTime: mtime})
+			tw.Write([]byte(file.content))
+		}
+	}
+	writeTar("plain.tar", false)
+	writeTar("compressed.tgz", true)
+
+	zf, err := os.Create(filepath.Join(dir, "files.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zf)
+	for _, file := range files {
+		w, _ := zw.CreateHeader(&zip.FileHeader{Name: file.name, Modified: mtime})
+		w.Write([]byte(file.content))
+	}
+	zw.Close()
+	zf.Close()
+
+	check := func(archive string, entries []importEntry, skipped int, open func(importEntry) (io.ReadCloser, error)) {
+		t.Helper()
+		if len(entries) != 2 || skipped != 1 {
+			t.Fatalf("%s: got %d entries, %d skipped, want 2 and 1", archive, len(entries), skipped)
+		}
+		for i, want := range []string{"src/A.Mod", "B.Text"} {
+			e := entries[i]
+			if e.rel != want {
+				t.Errorf("%s: entry %d is %q, want %q", archive, i, e.rel, want)
+			}
+			if !e.mtime.Equal(mtime) {
+				t.Errorf("%s: %s has time %v, want %v", archive, e.rel, e.mtime, mtime)
+			}
+			r, err := open(e)
+			if err != nil {
+				t.Fatalf("%s: open(%s) failed: %v", archive, e.rel, err)
+			}
+			data, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || int64(len(data)) != e.size {
+				t.Errorf("%s: read %d bytes of %s (%v), want %d", archive, len(data), e.rel, err, e.size)
+			}
+		}
+	}
+
+	for _, name := range []string{"plain.tar", "compressed.tgz"} {
+		tr, err := openTarImport(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, skipped, err := tr.entries()
+		if err != nil {
+			t.Fatalf("%s: entries failed: %v", name, err)
+		}
+		check(name, entries, skipped, tr.open)
+		tr.Close()
+	}
+
+	zr, err := openZipImport(filepath.Join(dir, "files.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	entries, skipped := zr.entries()
+	check("files.zip", entries, skipped, zr.open)
+}
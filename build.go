@@ -0,0 +1,296 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asig/odit/internal/disk"
+	"github.com/asig/odit/internal/filesystem"
+	"github.com/rs/zerolog/log"
+)
+
+const blockSize = 512
+
+// buildSpec describes an image for build. Paths are relative to the spec
+// file.
+type buildSpec struct {
+	Output    string         `json:"output"`
+	Geometry  buildGeometry  `json:"geometry"`
+	Partition buildPartition `json:"partition"`
+	Boot      buildBoot      `json:"boot"`
+	Alloc     string         `json:"alloc"` // default: the -alloc flag
+	Seed      int64          `json:"seed"`  // for the random policy, default 0
+	Date      string         `json:"date"`  // of all files that don't have one
+	Files     []buildFile    `json:"files"`
+}
+
+type buildGeometry struct {
+	Size            byteSize `json:"size"`
+	Heads           uint32   `json:"heads"`
+	SectorsPerTrack uint32   `json:"sectors_per_track"`
+}
+
+// buildPartition gives the partition in 512 byte blocks.
+type buildPartition struct {
+	Start    uint32 `json:"start"`    // default: the second track
+	Size     uint32 `json:"size"`     // default: the rest of the image
+	Reserved uint32 `json:"reserved"` // default: what the boot block and file need
+}
+
+type buildBoot struct {
+	Block string `json:"block"`
+	File  string `json:"file"`
+}
+
+type buildFile struct {
+	Name    string  `json:"name"`
+	Source  string  `json:"source"`
+	Content *string `json:"content"`
+	Date    string  `json:"date"`
+}
+
+// byteSize is a size in bytes, given as number or as string with an
+// optional K, M or G suffix.
+type byteSize int64
+
+func (s *byteSize) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("invalid size %s", data)
+		}
+		*s = byteSize(n)
+		return nil
+	}
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(str, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(str, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(str, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		str = str[:len(str)-1]
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", string(data))
+	}
+	*s = byteSize(n * mult)
+	return nil
+}
+
+func readBuildSpec(path string) (*buildSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var spec buildSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for i, f := range spec.Files {
+		if err := filesystem.ValidateFilename(f.Name); err != nil {
+			return nil, fmt.Errorf("file %d: %w", i+1, err)
+		}
+		if seen[f.Name] {
+			return nil, fmt.Errorf("%w: %s is listed twice", filesystem.ErrExists, f.Name)
+		}
+		seen[f.Name] = true
+		if (f.Source == "") == (f.Content == nil) {
+			return nil, fmt.Errorf("%s: needs either source or content", f.Name)
+		}
+		if f.Date != "" {
+			if _, err := parseDate(f.Date); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.Name, err)
+			}
+		}
+	}
+	return &spec, nil
+}
+
+// buildDate returns the date of files that don't have their own: the one
+// in the spec, SOURCE_DATE_EPOCH, or the current time, in that order.
+func buildDate(spec *buildSpec) (time.Time, error) {
+	if spec.Date != "" {
+		return parseDate(spec.Date)
+	}
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		secs, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q", epoch)
+		}
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	log.Warn().Msg("Neither date nor SOURCE_DATE_EPOCH given, the image won't be reproducible")
+	return time.Now(), nil
+}
+
+// layout turns the spec's geometry and partition into a disk.Layout.
+func (spec *buildSpec) layout(dir string) (disk.Layout, error) {
+	g, p := spec.Geometry, spec.Partition
+	if g.Size <= 0 || g.Size%blockSize != 0 {
+		return disk.Layout{}, fmt.Errorf("image size %d is not a positive multiple of %d", g.Size, blockSize)
+	}
+	l := disk.Layout{
+		Size:            uint32(g.Size / blockSize),
+		Heads:           g.Heads,
+		SectorsPerTrack: g.SectorsPerTrack,
+		PartitionStart:  p.Start,
+		PartitionSize:   p.Size,
+		Reserved:        p.Reserved,
+	}
+	if l.Heads == 0 {
+		l.Heads = 16
+	}
+	if l.SectorsPerTrack == 0 {
+		l.SectorsPerTrack = 63
+	}
+	if l.PartitionStart == 0 {
+		l.PartitionStart = l.SectorsPerTrack
+	}
+
+	var err error
+	if spec.Boot.Block != "" {
+		if l.BootBlock, err = os.ReadFile(filepath.Join(dir, spec.Boot.Block)); err != nil {
+			return l, fmt.Errorf("error reading boot block: %w", err)
+		}
+	}
+	if spec.Boot.File != "" {
+		if l.BootFile, err = os.ReadFile(filepath.Join(dir, spec.Boot.File)); err != nil {
+			return l, fmt.Errorf("error reading boot file: %w", err)
+		}
+	}
+	if l.Reserved == 0 {
+		l.Reserved = 1 + uint32((len(l.BootFile)+blockSize-1)/blockSize)
+	}
+	return l, nil
+}
+
+// buildImage creates the image described by the spec file specPath, at
+// output or, if that's empty, where the spec says. The same spec always
+// gives the same image, as long as the files have fixed dates.
+func buildImage(specPath, output string) (err error) {
+	spec, err := readBuildSpec(specPath)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", specPath, err)
+	}
+	dir := filepath.Dir(specPath)
+	if output == "" {
+		if spec.Output == "" {
+			return fmt.Errorf("%w: no output given, neither with -o nor in %s", errUsage, specPath)
+		}
+		output = filepath.Join(dir, spec.Output)
+	}
+
+	l, err := spec.layout(dir)
+	if err != nil {
+		return err
+	}
+	date, err := buildDate(spec)
+	if err != nil {
+		return err
+	}
+	// The seed always comes from the spec, so that -alloc random gives the
+	// same image every time, too
+	policy := spec.Alloc
+	if policy == "" {
+		policy = *flagAlloc
+	}
+	allocator, err := newAllocator(policy, spec.Seed)
+	if err != nil {
+		return err
+	}
+
+	d, err := disk.Create(output, l)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", output, err)
+	}
+	defer func() {
+		if cerr := d.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(output)
+		}
+	}()
+	if err := filesystem.Format(d); err != nil {
+		return fmt.Errorf("error formatting %s: %w", output, err)
+	}
+	fs, err := filesystem.New(d)
+	if err != nil {
+		return err
+	}
+	fs.SetAllocator(allocator)
+	fs.SetClock(func() time.Time { return date })
+
+	var total int64
+	for _, f := range spec.Files {
+		n, err := buildFileInto(fs, dir, f, date)
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+	if err := fs.Close(); err != nil {
+		return fmt.Errorf("error writing directory: %w", err)
+	}
+
+	summary := newTable("build", styleRecord, column{"image", "Image"}, column{"files", "Files"}, column{"bytes", "Bytes"})
+	summary.add(output, len(spec.Files), total)
+	return printTables(summary)
+}
+
+func buildFileInto(fs *filesystem.FileSystem, dir string, f buildFile, date time.Time) (int64, error) {
+	if f.Date != "" {
+		date, _ = parseDate(f.Date) // checked by readBuildSpec
+	}
+	var in io.Reader
+	var size int64
+	src := "inline content"
+	if f.Content != nil {
+		in, size = strings.NewReader(*f.Content), int64(len(*f.Content))
+	} else {
+		src = filepath.Join(dir, f.Source)
+		file, err := os.Open(src)
+		if err != nil {
+			return 0, fmt.Errorf("error opening %s: %w", src, err)
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		in, size = file, info.Size()
+	}
+	return size, storeFile(fs, in, size, date, src, f.Name, writeNew)
+}
@@ -0,0 +1,99 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asig/odit/internal/disk"
+	"github.com/asig/odit/internal/filesystem"
+)
+
+func TestBuildReproducible(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("Hello.Mod", "MODULE Hello;\rEND Hello.\r")
+	const files = `"files": [
+		{"name": "Hello.Mod", "source": "Hello.Mod"},
+		{"name": "Readme.Text", "content": "Hello\r", "date": "1997-05-04 13:14:15"}
+	]`
+	write("seeded.json", `{"geometry": {"size": "1M"}, "partition": {"start": 1}, "alloc": "random", "seed": 42, `+files+`}`)
+	write("default.json", `{"geometry": {"size": "1M"}, "partition": {"start": 1}, `+files+`}`)
+	t.Setenv("SOURCE_DATE_EPOCH", "86400")
+	// Specs without a policy use -alloc, but not its random seed
+	defer func(alloc string, allocator filesystem.Allocator) {
+		*flagAlloc, images.allocator = alloc, allocator
+	}(*flagAlloc, images.allocator)
+	*flagAlloc = "random"
+	images.allocator = filesystem.NewRandomAllocator(time.Now().UnixNano())
+
+	for _, spec := range []string{"seeded.json", "default.json"} {
+		var images [2][]byte
+		for i := range images {
+			path := filepath.Join(dir, "out.img")
+			if err := buildImage(filepath.Join(dir, spec), path); err != nil {
+				t.Fatalf("%s: buildImage failed: %v", spec, err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			images[i] = data
+			if i == 0 {
+				// Let the clock move on
+				time.Sleep(time.Second)
+			}
+		}
+		if !bytes.Equal(images[0], images[1]) {
+			t.Errorf("%s: building twice gave different images", spec)
+		}
+	}
+
+	d, err := disk.Open(filepath.Join(dir, "out.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	fs, err := filesystem.New(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]time.Time{
+		"Hello.Mod":   time.Date(1970, 1, 2, 0, 0, 0, 0, time.UTC),
+		"Readme.Text": time.Date(1997, 5, 4, 13, 14, 15, 0, time.UTC),
+	} {
+		f, err := fs.Find(name)
+		if err != nil {
+			t.Errorf("Find(%s) failed: %v", name, err)
+			continue
+		}
+		if !f.CreationTime().Equal(want) {
+			t.Errorf("%s is dated %v, want %v", name, f.CreationTime(), want)
+		}
+	}
+}
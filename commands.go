@@ -0,0 +1,600 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/asig/odit/internal/filesystem"
+)
+
+// command is a command that can be given on the command line.
+type command struct {
+	name    string
+	format  string // shown in usage errors
+	run     func(fs *filesystem.FileSystem, args []string) error
+	noImage bool  // run is called with a nil fs if there's no -image
+	args    arity // tells which of the following arguments belong to it
+}
+
+// arity describes the arguments of a command, so that runCommands can tell
+// where they end. Required arguments always belong to the command, even if
+// they're named like a command. Optional ones end at the next command name.
+// A ";" ends the arguments of any command, and after "--", everything up
+// to the next ";" belongs to the command.
+type arity struct {
+	min, max   int      // number of non-flag arguments; max < 0 means no limit
+	valueFlags []string // flags that take a value
+	// If one of these flags is given, altMin and altMax apply instead
+	alt            []string
+	altMin, altMax int
+	// If set, scan is used instead, see scanArgs
+	scan func(args []string) int
+}
+
+// commandSeparator ends the arguments of a command.
+const commandSeparator = ";"
+
+// scanArgs returns how many of args, the arguments after the command name,
+// belong to the command.
+func (a arity) scanArgs(args []string) int {
+	if a.scan != nil {
+		return a.scan(args)
+	}
+	min, max := a.min, a.max
+	positional := 0
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == commandSeparator:
+			return i
+		case arg == "--":
+			for i < len(args) && args[i] != commandSeparator {
+				i++
+			}
+			return i
+		case len(arg) > 1 && arg[0] == '-':
+			name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+			if slices.Contains(a.alt, name) {
+				min, max = a.altMin, a.altMax
+			}
+			if !hasValue && slices.Contains(a.valueFlags, name) {
+				i++
+			}
+			continue
+		}
+		if positional >= min {
+			if _, ok := findCommand(arg); ok || (max >= 0 && positional >= max) {
+				return i
+			}
+		}
+		positional++
+	}
+	return len(args)
+}
+
+var commands []command
+
+func init() {
+	// Set up in init() because some commands run other commands.
+	commands = []command{
+		{"help", "help", cmdHelp, true, arity{}},
+		{"build", "build [-o <image>] <spec>", cmdBuild, true, arity{min: 1, max: 1, valueFlags: []string{"o"}}},
+		{"list", "list [-l] [-sort name|size|date] [-r] [<pattern>]", cmdList, false, arity{max: 1, valueFlags: []string{"sort"}}},
+		{"info", "info <pattern>", cmdInfo, false, arity{min: 1, max: 1}},
+		{"find", "find [<expression>] [-print|-print0|-json|-export <dir>|-delete]...", cmdFind, false, arity{scan: scanFind}},
+		{"read", "read <src> <dest> | read -r <pattern> <dir>", cmdRead, false, arity{min: 2, max: 2}},
+		{"write", "write [-f|-backup] [-mtime] <src> <dest> | write -r [-f|-backup] [-mtime] <src>...", cmdWrite, false, arity{min: 2, max: 2, alt: []string{"r"}, altMin: 1, altMax: -1}},
+		{"import", "import [-map base|dotted] [-invalid reject|transliterate] [-manifest] [-mtime] [-f|-backup] [-dry-run] <hostdir> | import [options] -tar <file> | import [options] -zip <file>", cmdImport, false, arity{min: 1, max: 1, valueFlags: []string{"map", "invalid", "tar", "zip"}, alt: []string{"tar", "zip"}}},
+		{"export", "export <dir> | export -tar <file> | export -zip <file>", cmdExport, false, arity{min: 1, max: 1, valueFlags: []string{"tar", "zip"}, alt: []string{"tar", "zip"}}},
+		{"sync", "sync [-reverse] [-delete] [-force] [-dry-run] [-state <file>] <hostdir>", cmdSync, false, arity{min: 1, max: 1, valueFlags: []string{"state"}}},
+		{"touch", "touch [-d <date>] <pattern>...", cmdTouch, false, arity{min: 1, max: -1, valueFlags: []string{"d"}}},
+		{"rm", "rm <pattern>...", cmdRm, false, arity{min: 1, max: -1}},
+		{"mv", "mv <old> <new>", cmdMv, false, arity{min: 2, max: 2}},
+		{"cp", "cp [-conflict fail|skip|overwrite|backup] <src> <dst> | cp [-conflict ...] -from [<image>:]<pattern> -to [<image>:][<name>]", cmdCp, true, arity{min: 2, max: 2, valueFlags: []string{"conflict", "from", "to"}, alt: []string{"from", "to"}}},
+		{"diff", "diff [-u] [-ignore-dates] <image|dir> <image|dir>", cmdDiff, true, arity{min: 2, max: 2}},
+		{"grep", "grep [-i] [-l] [-text] <regexp> [<pattern>]", cmdGrep, false, arity{min: 1, max: 2}},
+		{"hash", "hash [<pattern>]", cmdHash, false, arity{max: 1}},
+		{"verify", "verify [-ignore-dates] <manifest>", cmdVerify, false, arity{min: 1, max: 1}},
+		{"dump", "dump sector <addr> | dump file [-offset <n>] [-len <n>] <name> | dump header <name> | dump dirpage [<addr>] | dump index <addr> | dump bootblock | dump mbr", cmdDump, false, arity{min: 1, max: 2, valueFlags: []string{"offset", "len"}}},
+		{"defrag", "defrag [-files <pattern>]", cmdDefrag, false, arity{valueFlags: []string{"files"}}},
+		{"df", "df", cmdDf, false, arity{}},
+		{"usage", "usage [-png <file>]", cmdUsage, false, arity{valueFlags: []string{"png"}}},
+		{"mount", "mount <mountpoint>", cmdMount, false, arity{min: 1, max: 1}},
+		{"shell", "shell", cmdShell, true, arity{}},
+		{"script", "script [-stop-on-error] <file>", cmdScript, true, arity{min: 1, max: 1}},
+	}
+}
+
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// splitCommands splits args into commands, each followed by its arguments;
+// see arity.
+func splitCommands(args []string) ([][]string, error) {
+	var cmds [][]string
+	pos := 0
+	for pos < len(args) {
+		if args[pos] == commandSeparator {
+			pos++
+			continue
+		}
+		cmd, ok := findCommand(args[pos])
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown command: %s", errUsage, args[pos])
+		}
+		end := pos + 1 + cmd.args.scanArgs(args[pos+1:])
+		cmds = append(cmds, args[pos:end])
+		pos = end
+	}
+	return cmds, nil
+}
+
+// runCommands executes the commands in args one after the other, stopping at
+// the first one that fails.
+func runCommands(fs *filesystem.FileSystem, args []string) error {
+	cmds, err := splitCommands(args)
+	if err != nil {
+		return err
+	}
+	for _, c := range cmds {
+		cmd, _ := findCommand(c[0])
+		if fs == nil && !cmd.noImage {
+			return fmt.Errorf("%w: no image specified for %s command", errUsage, cmd.name)
+		}
+		if err := cmd.run(fs, c[1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commandArgs parses the flags in args and checks that there are between
+// min and max remaining arguments; max < 0 means there is no upper limit.
+// It returns the remaining arguments.
+func commandArgs(name string, flags *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	cmd, _ := findCommand(name)
+	if flags == nil {
+		flags = newFlagSet(name)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, fmt.Errorf("%w: %s for %s command. Format is \"%s\"", errUsage, err, name, cmd.format)
+	}
+	args = flags.Args()
+	if len(args) < min {
+		return nil, fmt.Errorf("%w: not enough arguments for %s command. Format is \"%s\"", errUsage, name, cmd.format)
+	}
+	if max >= 0 && len(args) > max {
+		return nil, fmt.Errorf("%w: too many arguments for %s command. Format is \"%s\"", errUsage, name, cmd.format)
+	}
+	return args, nil
+}
+
+// overwriteMode returns the writeMode for the -f and -backup flags.
+func overwriteMode(force, backup bool) writeMode {
+	switch {
+	case backup:
+		return writeBackup
+	case force:
+		return writeReplace
+	}
+	return writeNew
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	return flags
+}
+
+func cmdHelp(fs *filesystem.FileSystem, args []string) error {
+	if _, err := commandArgs("help", nil, args, 0, 0); err != nil {
+		return err
+	}
+	usage()
+	return nil
+}
+
+func cmdBuild(fs *filesystem.FileSystem, args []string) error {
+	flags := newFlagSet("build")
+	output := flags.String("o", "", "")
+	args, err := commandArgs("build", flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	return buildImage(args[0], *output)
+}
+
+func cmdList(fs *filesystem.FileSystem, args []string) error {
+	flags := newFlagSet("list")
+	long := flags.Bool("l", false, "")
+	sortBy := flags.String("sort", "name", "")
+	reverse := flags.Bool("r", false, "")
+	args, err := commandArgs("list", flags, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	pattern := "*"
+	if len(args) > 0 {
+		pattern = args[0]
+	}
+	return listFiles(fs, pattern, *long, *sortBy, *reverse)
+}
+
+func cmdInfo(fs *filesystem.FileSystem, args []string) error {
+	args, err := commandArgs("info", nil, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	return fileInfo(fs, args[0])
+}
+
+// cmdFind parses its arguments itself, an expression isn't made of flags.
+func cmdFind(fs *filesystem.FileSystem, args []string) error {
+	return findFiles(fs, args)
+}
+
+func cmdRead(fs *filesystem.FileSystem, args []string) error {
+	flags := newFlagSet("read")
+	recursive := flags.Bool("r", false, "")
+	args, err := commandArgs("read", flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	if *recursive {
+		return readFilesFromImage(fs, args[0], args[1])
+	}
+	return readFromImage(fs, args[0], args[1])
+}
+
+func cmdWrite(fs *filesystem.FileSystem, args []string) error {
+	flags := newFlagSet("write")
+	recursive := flags.Bool("r", false, "")
+	force := flags.Bool("f", false, "")
+	backup := flags.Bool("backup", false, "")
+	keepMtime := flags.Bool("mtime", false, "")
+	args, err := commandArgs("write", flags, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	mode := overwriteMode(*force, *backup)
+	if *recursive {
+		return writeFilesToImage(fs, args, mode, *keepMtime)
+	}
+	if len(args) != 2 {
+		cmd, _ := findCommand("write")
+		return fmt.Errorf("%w: write command needs exactly two arguments without -r. Format is \"%s\"", errUsage, cmd.format)
+	}
+	return writeToImage(fs, args[0], args[1], mode, *keepMtime)
+}
+
+func cmdImport(fs *filesystem.FileSystem, args []string) error {
+	flags := newFlagSet("import")
+	var opts importOptions
+	flags.StringVar(&opts.mapping, "map", mapBase, "")
+	flags.StringVar(&opts.invalid, "invalid", invalidReject, "")
+	force := flags.Bool("f", false, "")
+	backup := flags.Bool("backup", false, "")
+	flags.BoolVar(&opts.useManifest, "manifest", false, "")
+	flags.BoolVar(&opts.keepMtime, "mtime", false, "")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "")
+	flags.StringVar(&opts.tarFile, "tar", "", "")
+	flags.StringVar(&opts.zipFile, "zip", "", "")
+	args, err := commandArgs("import", flags, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	opts.mode = overwriteMode(*force, *backup)
+
+	archive := opts.tarFile != "" || opts.zipFile != ""
+	switch {
+	case opts.tarFile != "" && opts.zipFile != "":
+		return fmt.Errorf("%w: import needs either -tar or -zip, not both", errUsage)
+	case archive && len(args) > 0:
+		return fmt.Errorf("%w: import needs either an archive or a directory, not both", errUsage)
+	case !archive && len(args) == 0:
+		return fmt.Errorf("%w: import needs an archive or a directory", errUsage)
+	case archive && opts.useManifest:
+		return fmt.Errorf("%w: -manifest can only be used when importing a directory", errUsage)
+	}
+	dir := ""
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	return importFiles(fs, dir, opts)
+}
+
+func cmdExport(fs *filesystem.FileSystem, args []string) error {
+	flags := newFlagSet("export")
+	tarFile := flags.String("tar", "", "")
+	zipFile := flags.String("zip", "", "")
+	args, err := commandArgs("export", flags, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	targets := len(args)
+	if *tarFile != "" {
+		targets++
+	}
+	if *zipFile != "" {
+		targets++
+	}
+	if targets != 1 {
+		return fmt.Errorf("%w: export needs exactly one of <dir>, -tar or -zip", errUsage)
+	}
+	switch {
+	case *tarFile != "":
+		return exportArchive(fs, *tarFile, archiveTar)
+	case *zipFile != "":
+		return exportArchive(fs, *zipFile, archiveZip)
+	}
+	return exportImage(fs, args[0])
+}
+
+func cmdSync(fs *filesystem.FileSystem, args []string) error {
+	flags := newFlagSet("sync")
+	var opts syncOptions
+	flags.BoolVar(&opts.reverse, "reverse", false, "")
+	flags.BoolVar(&opts.delete, "delete", false, "")
+	flags.BoolVar(&opts.force, "force", false, "")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "")
+	flags.StringVar(&opts.stateFile, "state", "", "")
+	args, err := commandArgs("sync", flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	image, err := images.path(fs)
+	if err != nil {
+		return err
+	}
+	return syncDir(fs, image, args[0], opts)
+}
+
+func cmdTouch(fs *filesystem.FileSystem, args []string) error {
+	flags := newFlagSet("touch")
+	date := flags.String("d", "", "")
+	args, err := commandArgs("touch", flags, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	t := fs.Now()
+	if *date != "" {
+		if t, err = parseDate(*date); err != nil {
+			return fmt.Errorf("%w: %s", errUsage, err)
+		}
+	}
+	return touchFiles(fs, args, t)
+}
+
+func cmdRm(fs *filesystem.FileSystem, args []string) error {
+	args, err := commandArgs("rm", nil, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	return removeFiles(fs, args)
+}
+
+func cmdMv(fs *filesystem.FileSystem, args []string) error {
+	args, err := commandArgs("mv", nil, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	return moveFile(fs, args[0], args[1])
+}
+
+func cmdCp(fs *filesystem.FileSystem, args []string) error {
+	flags := newFlagSet("cp")
+	conflict := flags.String("conflict", conflictFail, "")
+	from := flags.String("from", "", "")
+	to := flags.String("to", "", "")
+	args, err := commandArgs("cp", flags, args, 0, 2)
+	if err != nil {
+		return err
+	}
+	switch {
+	case *from == "" && *to == "" && len(args) == 2:
+		// Both in the -image image
+		*from, *to = ":"+args[0], ":"+args[1]
+	case *from == "" || *to == "" || len(args) > 0:
+		cmd, _ := findCommand("cp")
+		return fmt.Errorf("%w: cp needs either <src> and <dst>, or -from and -to. Format is \"%s\"", errUsage, cmd.format)
+	}
+	return copyFiles(fs, *from, *to, *conflict)
+}
+
+func cmdDiff(fs *filesystem.FileSystem, args []string) error {
+	flags := newFlagSet("diff")
+	unified := flags.Bool("u", false, "")
+	ignoreDates := flags.Bool("ignore-dates", false, "")
+	args, err := commandArgs("diff", flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	return diffImages(args[0], args[1], *unified, *ignoreDates)
+}
+
+func cmdGrep(fs *filesystem.FileSystem, args []string) error {
+	flags := newFlagSet("grep")
+	ignoreCase := flags.Bool("i", false, "")
+	namesOnly := flags.Bool("l", false, "")
+	decode := flags.Bool("text", false, "")
+	args, err := commandArgs("grep", flags, args, 1, 2)
+	if err != nil {
+		return err
+	}
+	pattern := "*"
+	if len(args) > 1 {
+		pattern = args[1]
+	}
+	return grepFiles(fs, args[0], pattern, *ignoreCase, *namesOnly, *decode)
+}
+
+func cmdHash(fs *filesystem.FileSystem, args []string) error {
+	args, err := commandArgs("hash", nil, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	pattern := "*"
+	if len(args) > 0 {
+		pattern = args[0]
+	}
+	return hashFiles(fs, pattern)
+}
+
+func cmdVerify(fs *filesystem.FileSystem, args []string) error {
+	flags := newFlagSet("verify")
+	ignoreDates := flags.Bool("ignore-dates", false, "")
+	args, err := commandArgs("verify", flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	return verifyFiles(fs, args[0], *ignoreDates)
+}
+
+func cmdDump(fs *filesystem.FileSystem, args []string) error {
+	cmd, _ := findCommand("dump")
+	if len(args) == 0 {
+		return fmt.Errorf("%w: not enough arguments for dump command. Format is \"%s\"", errUsage, cmd.format)
+	}
+	what, args := args[0], args[1:]
+	addr := func(s string) (uint32, error) {
+		a, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			return 0, fmt.Errorf("%w: invalid sector address %q", errUsage, s)
+		}
+		return uint32(a), nil
+	}
+
+	switch what {
+	case "sector", "index", "dirpage":
+		min := 1
+		if what == "dirpage" {
+			min = 0
+		}
+		args, err := commandArgs("dump", nil, args, min, 1)
+		if err != nil {
+			return err
+		}
+		a := uint32(filesystem.RootDirPage)
+		if len(args) > 0 {
+			if a, err = addr(args[0]); err != nil {
+				return err
+			}
+		}
+		switch what {
+		case "sector":
+			return dumpSector(fs, a)
+		case "index":
+			return dumpIndex(fs, a)
+		}
+		return dumpDirPage(fs, a)
+	case "file":
+		// Also take the flags after the name
+		if len(args) > 1 && !strings.HasPrefix(args[0], "-") {
+			args = append(args[1:], args[0])
+		}
+		flags := newFlagSet("dump")
+		offset := flags.Int("offset", 0, "")
+		length := flags.Int("len", -1, "")
+		args, err := commandArgs("dump", flags, args, 1, 1)
+		if err != nil {
+			return err
+		}
+		if *offset < 0 {
+			return fmt.Errorf("%w: negative offset %d", errUsage, *offset)
+		}
+		return dumpFile(fs, args[0], *offset, *length)
+	case "header":
+		args, err := commandArgs("dump", nil, args, 1, 1)
+		if err != nil {
+			return err
+		}
+		return dumpHeader(fs, args[0])
+	case "bootblock", "mbr":
+		if _, err := commandArgs("dump", nil, args, 0, 0); err != nil {
+			return err
+		}
+		if what == "mbr" {
+			return dumpMBR(fs.Disk())
+		}
+		return dumpBootBlock(fs.Disk())
+	}
+	return fmt.Errorf("%w: unknown structure %q for dump command. Format is \"%s\"", errUsage, what, cmd.format)
+}
+
+func cmdDefrag(fs *filesystem.FileSystem, args []string) error {
+	flags := newFlagSet("defrag")
+	pattern := flags.String("files", "*", "")
+	if _, err := commandArgs("defrag", flags, args, 0, 0); err != nil {
+		return err
+	}
+	return defrag(fs, *pattern)
+}
+
+func cmdDf(fs *filesystem.FileSystem, args []string) error {
+	if _, err := commandArgs("df", nil, args, 0, 0); err != nil {
+		return err
+	}
+	return diskFree(fs)
+}
+
+func cmdUsage(fs *filesystem.FileSystem, args []string) error {
+	flags := newFlagSet("usage")
+	pngFile := flags.String("png", "", "")
+	if _, err := commandArgs("usage", flags, args, 0, 0); err != nil {
+		return err
+	}
+	return usageReport(fs, *pngFile)
+}
+
+func cmdMount(fs *filesystem.FileSystem, args []string) error {
+	args, err := commandArgs("mount", nil, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	return mount(fs, args[0])
+}
+
+func cmdShell(fs *filesystem.FileSystem, args []string) error {
+	if _, err := commandArgs("shell", nil, args, 0, 0); err != nil {
+		return err
+	}
+	return runShell(fs)
+}
+
+func cmdScript(fs *filesystem.FileSystem, args []string) error {
+	flags := newFlagSet("script")
+	stopOnError := flags.Bool("stop-on-error", false, "")
+	args, err := commandArgs("script", flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	return runScript(fs, args[0], *stopOnError)
+}
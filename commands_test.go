@@ -0,0 +1,105 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitCommands(t *testing.T) {
+	tests := []struct {
+		args string
+		want []string
+	}{
+		{"list", []string{"list"}},
+		{"read A.Mod list", []string{"read A.Mod list"}},
+		{"read A.Mod list df", []string{"read A.Mod list", "df"}},
+		{"write x export", []string{"write x export"}},
+		{"write -f x export list", []string{"write -f x export", "list"}},
+		{"write -r dir A.Mod B.Mod list", []string{"write -r dir A.Mod B.Mod", "list"}},
+		{"grep dump", []string{"grep dump"}},
+		{"grep dump list info x", []string{"grep dump", "list", "info x"}},
+		{"grep dump *.Mod list", []string{"grep dump *.Mod", "list"}},
+		{"dump mbr dump bootblock", []string{"dump mbr", "dump bootblock"}},
+		{"dump file -offset 10 -len 16 A.Mod df", []string{"dump file -offset 10 -len 16 A.Mod", "df"}},
+		{"list -sort size info A.Mod", []string{"list -sort size", "info A.Mod"}},
+		{"import -tar list", []string{"import -tar list"}},
+		{"import -tar a.tar list", []string{"import -tar a.tar", "list"}},
+		{"export -zip=a.zip df", []string{"export -zip=a.zip", "df"}},
+		{"rm A.Mod B.Mod list", []string{"rm A.Mod B.Mod", "list"}},
+		{"rm A.Mod ; list", []string{"rm A.Mod", "list"}},
+		{"rm -- A.Mod list ; df", []string{"rm -- A.Mod list", "df"}},
+		{"mv list df ; ; hash", []string{"mv list df", "hash"}},
+		{"find -name list -print df", []string{"find -name list -print", "df"}},
+		{"find -export list ( -size +10 -o -fragmented ) ; list", []string{"find -export list ( -size +10 -o -fragmented )", "list"}},
+	}
+	for _, test := range tests {
+		cmds, err := splitCommands(strings.Fields(test.args))
+		if err != nil {
+			t.Errorf("splitCommands(%q) failed: %v", test.args, err)
+			continue
+		}
+		var got []string
+		for _, cmd := range cmds {
+			got = append(got, strings.Join(cmd, " "))
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("splitCommands(%q) = %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestRunCommands(t *testing.T) {
+	for _, args := range []string{"foo", "list foo", "list", "list help"} {
+		err := runCommands(nil, strings.Fields(args))
+		if !errors.Is(err, errUsage) {
+			t.Errorf("runCommands(%q) = %v, want a usage error", args, err)
+		}
+	}
+	if err := runCommands(nil, nil); err != nil {
+		t.Errorf("runCommands() failed: %v", err)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	fs, _ := openReportImage(t)
+	now := time.Date(1998, 7, 6, 5, 4, 3, 0, time.UTC)
+	fs.SetClock(func() time.Time { return now })
+	given := time.Date(2001, 2, 3, 0, 0, 0, 0, time.UTC)
+
+	if err := runCommands(fs, []string{"touch", "A.Mod", "New.Mod"}); err != nil {
+		t.Fatalf("touch failed: %v", err)
+	}
+	if err := runCommands(fs, []string{"touch", "-d", "2001-02-03", "B.Text"}); err != nil {
+		t.Fatalf("touch -d failed: %v", err)
+	}
+	for name, want := range map[string]time.Time{"A.Mod": now, "New.Mod": now, "B.Text": given} {
+		f, err := fs.Find(name)
+		if err != nil {
+			t.Fatalf("Find(%s) failed: %v", name, err)
+		}
+		if got := f.CreationTime(); !got.Equal(want) {
+			t.Errorf("%s: time stamp is %v, want %v", name, got, want)
+		}
+	}
+}
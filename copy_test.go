@@ -0,0 +1,153 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asig/odit/internal/filesystem"
+)
+
+func TestCopyFiles(t *testing.T) {
+	srcDate := time.Date(1997, 5, 4, 13, 14, 15, 0, time.UTC)
+	dstDate := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	type file struct {
+		content string
+		date    time.Time
+	}
+	tests := []struct {
+		name     string
+		from, to string // "src:" and "dst:" are replaced by the image paths
+		conflict string
+		err      error // nil if the copy succeeds
+		want     map[string]file
+	}{
+		{
+			name: "new", from: "src:B.Mod", to: "dst:", conflict: conflictFail,
+			want: map[string]file{"A.Mod": {"a-dst", dstDate}, "B.Mod": {"b-src", srcDate}},
+		},
+		{
+			name: "rename", from: "src:A.Mod", to: "dst:C.Mod", conflict: conflictFail,
+			want: map[string]file{"A.Mod": {"a-dst", dstDate}, "C.Mod": {"a-src", srcDate}},
+		},
+		{
+			name: "fail", from: "src:*.Mod", to: "dst:", conflict: conflictFail, err: filesystem.ErrExists,
+			want: map[string]file{"A.Mod": {"a-dst", dstDate}},
+		},
+		{
+			name: "skip", from: "src:*.Mod", to: "dst:", conflict: conflictSkip,
+			want: map[string]file{"A.Mod": {"a-dst", dstDate}, "B.Mod": {"b-src", srcDate}},
+		},
+		{
+			name: "overwrite", from: "src:*.Mod", to: "dst:", conflict: conflictOverwrite,
+			want: map[string]file{"A.Mod": {"a-src", srcDate}, "B.Mod": {"b-src", srcDate}},
+		},
+		{
+			name: "backup", from: "src:A.Mod", to: "dst:", conflict: conflictBackup,
+			want: map[string]file{"A.Mod": {"a-src", srcDate}, "A.Mod.Bak": {"a-dst", dstDate}},
+		},
+		{
+			name: "several to one", from: "src:*.Mod", to: "dst:C.Mod", conflict: conflictFail, err: errUsage,
+			want: map[string]file{"A.Mod": {"a-dst", dstDate}},
+		},
+		{
+			name: "same image", from: "dst:A.Mod", to: "dst:", conflict: conflictOverwrite, err: filesystem.ErrExists,
+			want: map[string]file{"A.Mod": {"a-dst", dstDate}},
+		},
+		{
+			name: "within image", from: "dst:A.Mod", to: "dst:D.Mod", conflict: conflictFail,
+			want: map[string]file{"A.Mod": {"a-dst", dstDate}, "D.Mod": {"a-dst", dstDate}},
+		},
+		{
+			name: "unknown policy", from: "src:A.Mod", to: "dst:", conflict: "merge", err: errUsage,
+			want: map[string]file{"A.Mod": {"a-dst", dstDate}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			build := func(name, spec string) string {
+				t.Helper()
+				path := filepath.Join(dir, name+".img")
+				if err := os.WriteFile(filepath.Join(dir, name+".json"), []byte(spec), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := buildImage(filepath.Join(dir, name+".json"), path); err != nil {
+					t.Fatalf("buildImage failed: %v", err)
+				}
+				return path
+			}
+			src := build("src", `{"geometry": {"size": "1M"}, "partition": {"start": 1}, "date": "1997-05-04 13:14:15", "files": [
+				{"name": "A.Mod", "content": "a-src"},
+				{"name": "B.Mod", "content": "b-src"}
+			]}`)
+			dst := build("dst", `{"geometry": {"size": "1M"}, "partition": {"start": 1}, "date": "2001-02-03 04:05:06", "files": [
+				{"name": "A.Mod", "content": "a-dst"}
+			]}`)
+			t.Cleanup(func() { images.close() })
+
+			spec := func(s string) string {
+				image, name := splitImageSpec(s)
+				return map[string]string{"src": src, "dst": dst}[image] + ":" + name
+			}
+			err := copyFiles(nil, spec(test.from), spec(test.to), test.conflict)
+			switch {
+			case test.err == nil && err != nil:
+				t.Fatalf("copyFiles failed: %v", err)
+			case test.err != nil && !errors.Is(err, test.err):
+				t.Fatalf("copyFiles: got %v, want %v", err, test.err)
+			}
+			if err := images.close(); err != nil {
+				t.Fatalf("close failed: %v", err)
+			}
+
+			fs, err := images.open(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries := fs.ListEntries()
+			if len(entries) != len(test.want) {
+				t.Errorf("Image has %v, want %d files", entries, len(test.want))
+			}
+			for name, want := range test.want {
+				f, err := fs.Find(name)
+				if err != nil {
+					t.Errorf("Find(%s) failed: %v", name, err)
+					continue
+				}
+				got, err := io.ReadAll(f)
+				if err != nil {
+					t.Fatalf("ReadAll failed: %v", err)
+				}
+				if string(got) != want.content {
+					t.Errorf("%s contains %q, want %q", name, got, want.content)
+				}
+				if !f.CreationTime().Equal(want.date) {
+					t.Errorf("%s is dated %v, want %v", name, f.CreationTime(), want.date)
+				}
+			}
+		})
+	}
+}
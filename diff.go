@@ -0,0 +1,278 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/asig/odit/internal/filesystem"
+	"github.com/asig/odit/internal/util"
+)
+
+// diffFile is a file on one side of a diff.
+type diffFile struct {
+	size int64
+	date time.Time // as Oberon sees it, i.e. in UTC; see File.CreationTime
+	open func() (io.ReadCloser, error)
+}
+
+// diffSide is one side of a diff: an image, or a host directory as written
+// by export.
+type diffSide struct {
+	name  string
+	files map[string]diffFile
+}
+
+// hashFile returns the SHA-256 of r's contents, in hex.
+func hashFile(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// openDiffSide reads the list of files in path, which is an image or a host
+// directory.
+func openDiffSide(path string) (*diffSide, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	side := &diffSide{name: path, files: make(map[string]diffFile)}
+	if info.IsDir() {
+		return side, side.readDir(path)
+	}
+
+	fs, err := images.open(path)
+	if err != nil {
+		return nil, err
+	}
+	files, err := fs.ListFiles(filesystem.AllFiles)
+	if err != nil {
+		return nil, fmt.Errorf("error listing files in %s: %w", path, err)
+	}
+	for _, f := range files {
+		side.files[f.Name()] = imageDiffFile(f)
+	}
+	return side, nil
+}
+
+func imageDiffFile(f *filesystem.File) diffFile {
+	size := int64(f.Size())
+	return diffFile{
+		size: size,
+		date: f.CreationTime(),
+		open: func() (io.ReadCloser, error) {
+			return io.NopCloser(io.NewSectionReader(f, 0, size)), nil
+		},
+	}
+}
+
+// hostDiffFile returns the host file at path, dated with the wall clock of
+// its modification time.
+func hostDiffFile(path string, info os.FileInfo) diffFile {
+	mtime := info.ModTime()
+	return diffFile{
+		size: info.Size(),
+		date: time.Date(mtime.Year(), mtime.Month(), mtime.Day(), mtime.Hour(), mtime.Minute(), mtime.Second(), 0, time.UTC),
+		open: func() (io.ReadCloser, error) { return os.Open(path) },
+	}
+}
+
+// readDir adds the files in dir. Like import, it takes the dates from the
+// manifest if there is one.
+func (s *diffSide) readDir(dir string) error {
+	recorded, err := readManifest(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading manifest: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || isHidden(e.Name()) || e.Name() == manifestName {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		f := hostDiffFile(filepath.Join(dir, e.Name()), info)
+		if m, ok := recorded[e.Name()]; ok {
+			f.date, _ = time.Parse(manifestDate, m.Date) // checked by readManifest
+		}
+		s.files[e.Name()] = f
+	}
+	return nil
+}
+
+func (f diffFile) hash() (string, error) {
+	r, err := f.open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return hashFile(r)
+}
+
+func (f diffFile) lines() ([]string, bool, error) {
+	r, err := f.open()
+	if err != nil {
+		return nil, false, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false, err
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return nil, false, nil
+	}
+	// Oberon ends lines with CR
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.TrimSuffix(strings.ReplaceAll(text, "\r", "\n"), "\n")
+	if text == "" {
+		return nil, true, nil
+	}
+	return strings.Split(text, "\n"), true, nil
+}
+
+// diffImages compares the files in a and b, which are images or host
+// directories. With unified, it shows the changes of text files as unified
+// diff. It fails with errDiffer if any file differs.
+func diffImages(a, b string, unified, ignoreDates bool) error {
+	sideA, err := openDiffSide(a)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", a, err)
+	}
+	sideB, err := openDiffSide(b)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", b, err)
+	}
+
+	var names []string
+	for name := range sideA.files {
+		names = append(names, name)
+	}
+	for name := range sideB.files {
+		if _, ok := sideA.files[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	columns := []column{{"name", "Name"}, {"status", "Status"}, {"changes", "Changes"}}
+	// In text format, diffs are shown below the table
+	inTable := unified && *flagFormat != formatText
+	if inTable {
+		columns = append(columns, column{"diff", "Diff"})
+	}
+	t := newTable("diff", styleColumns, columns...)
+	var diffs []string
+
+	for _, name := range names {
+		fa, inA := sideA.files[name]
+		fb, inB := sideB.files[name]
+		var status string
+		var changes []string
+		diff := ""
+		switch {
+		case !inB:
+			status = "removed"
+		case !inA:
+			status = "added"
+		default:
+			if fa.size != fb.size {
+				changes = append(changes, "size", "content")
+			} else {
+				ha, err := fa.hash()
+				if err != nil {
+					return fmt.Errorf("error reading %s in %s: %w", name, a, err)
+				}
+				hb, err := fb.hash()
+				if err != nil {
+					return fmt.Errorf("error reading %s in %s: %w", name, b, err)
+				}
+				if ha != hb {
+					changes = append(changes, "content")
+				}
+			}
+			if !ignoreDates && !fa.date.Equal(fb.date) {
+				changes = append(changes, "date")
+			}
+			if len(changes) == 0 {
+				continue
+			}
+			status = "changed"
+			if unified && slices.Contains(changes, "content") {
+				if diff, err = unifiedDiff(name, sideA, sideB); err != nil {
+					return err
+				}
+				if diff != "" && !inTable {
+					diffs = append(diffs, diff)
+				}
+			}
+		}
+		if inTable {
+			t.add(name, status, strings.Join(changes, ","), diff)
+		} else {
+			t.add(name, status, strings.Join(changes, ","))
+		}
+	}
+
+	if err := printTables(t); err != nil {
+		return err
+	}
+	for _, d := range diffs {
+		fmt.Print("\n" + d)
+	}
+	if len(t.rows) > 0 {
+		return fmt.Errorf("%w: %d files", errDiffer, len(t.rows))
+	}
+	return nil
+}
+
+// unifiedDiff returns the unified diff of file name, or "" if it isn't a text
+// file on both sides.
+func unifiedDiff(name string, a, b *diffSide) (string, error) {
+	linesA, textA, err := a.files[name].lines()
+	if err != nil {
+		return "", fmt.Errorf("error reading %s in %s: %w", name, a.name, err)
+	}
+	linesB, textB, err := b.files[name].lines()
+	if err != nil {
+		return "", fmt.Errorf("error reading %s in %s: %w", name, b.name, err)
+	}
+	if !textA || !textB {
+		return "", nil
+	}
+	return util.UnifiedDiff(a.name+":"+name, b.name+":"+name, linesA, linesB, 3), nil
+}
@@ -0,0 +1,73 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffCommand(t *testing.T) {
+	const base = `{"geometry": {"size": "1M"}, "partition": {"start": 1}, "date": "1997-05-04 13:14:15", "files": [
+		{"name": "A.Mod", "content": "a"}, {"name": "B.Mod", "content": "b"}]}`
+	tests := []struct {
+		name  string
+		flags string
+		other string
+		want  int
+	}{
+		{"same", "", base, exitOK},
+		{"content", "", strings.Replace(base, `"content": "b"`, `"content": "c"`, 1), exitDiffer},
+		{"added", "", strings.Replace(base, `]}`, `, {"name": "C.Mod", "content": "c"}]}`, 1), exitDiffer},
+		{"removed", "", strings.Replace(base, `, {"name": "B.Mod", "content": "b"}`, "", 1), exitDiffer},
+		{"date", "", strings.Replace(base, "1997", "2001", 1), exitDiffer},
+		{"ignored date", "-ignore-dates", strings.Replace(base, "1997", "2001", 1), exitOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			build := func(name, spec string) string {
+				t.Helper()
+				path := filepath.Join(dir, name+".img")
+				if err := os.WriteFile(filepath.Join(dir, name+".json"), []byte(spec), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := buildImage(filepath.Join(dir, name+".json"), path); err != nil {
+					t.Fatalf("buildImage failed: %v", err)
+				}
+				return path
+			}
+			a := build("a", base)
+			b := build("b", test.other)
+			t.Cleanup(func() { images.close() })
+
+			err := runCommands(nil, append(strings.Fields("diff "+test.flags), a, b))
+			if got := exitCode(err); got != test.want {
+				t.Errorf("diff: got status %d (%v), want %d", got, err, test.want)
+			}
+			if test.want == exitDiffer && !errors.Is(err, errDiffer) {
+				t.Errorf("diff: got %v, want %v", err, errDiffer)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/asig/odit/internal/disk"
+	"github.com/asig/odit/internal/filesystem"
+	"github.com/asig/odit/internal/util"
+)
+
+// printHexDump shows data, which starts at offset base, as hex dump in text
+// format, or as rows of 16 bytes otherwise.
+func printHexDump(data []byte, base int) error {
+	if *flagFormat == formatText {
+		fmt.Print(util.HexDumpAt(data, base))
+		return nil
+	}
+	t := newTable("dump", styleColumns, column{"offset", "Offset"}, column{"hex", "Hex"})
+	for ofs := 0; ofs < len(data); ofs += 16 {
+		t.add(base+ofs, hex.EncodeToString(data[ofs:min(ofs+16, len(data))]))
+	}
+	return printTables(t)
+}
+
+func hexMark(mark uint32) string {
+	return fmt.Sprintf("0x%08X", mark)
+}
+
+func readSector(fs *filesystem.FileSystem, addr uint32) (disk.Sector, error) {
+	sec, err := fs.Disk().GetSector(addr)
+	if err != nil {
+		return sec, fmt.Errorf("error reading sector %d: %w", addr, err)
+	}
+	return sec, nil
+}
+
+// dumpSector shows the sector at addr as hex dump.
+func dumpSector(fs *filesystem.FileSystem, addr uint32) error {
+	sec, err := readSector(fs, addr)
+	if err != nil {
+		return err
+	}
+	return printHexDump(sec[:], 0)
+}
+
+// dumpFile shows the contents of file name from offset on as hex dump,
+// length bytes or up to the end if length is negative.
+func dumpFile(fs *filesystem.FileSystem, name string, offset, length int) error {
+	f, err := fs.Find(name)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", name, err)
+	}
+	size := int(f.Size())
+	if offset > size {
+		return fmt.Errorf("%w: offset %d is beyond the end of %s (%d bytes)", errUsage, offset, name, size)
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, int64(offset)); err != nil && err != io.EOF {
+		return fmt.Errorf("error reading %s: %w", name, err)
+	}
+	return printHexDump(data, offset)
+}
+
+// dumpHeader decodes the header of file name, which doesn't need to be
+// valid.
+func dumpHeader(fs *filesystem.FileSystem, name string) error {
+	addr := uint32(0)
+	for _, e := range fs.ListEntries() {
+		if e.Name == name {
+			addr = e.HeaderAddr
+		}
+	}
+	if addr == 0 {
+		return fmt.Errorf("%w: %s", filesystem.ErrNotFound, name)
+	}
+	sec, err := readSector(fs, addr)
+	if err != nil {
+		return err
+	}
+	h := filesystem.DecodeHeader(sec)
+
+	header := newTable("header", styleRecord,
+		column{"address", "Address"},
+		column{"mark", "Mark"},
+		column{"valid", "Valid"},
+		column{"name", "Name"},
+		column{"aleng", "Aleng"},
+		column{"bleng", "Bleng"},
+		column{"date", "Date"},
+	)
+	header.add(addr, hexMark(h.Mark), h.Valid, h.Name, h.Aleng, h.Bleng, h.Date)
+	return printTables(header, addrTable("ext", "Ext", h.ExtTab), addrTable("sec", "Sec", h.SecTab))
+}
+
+// addrTable lists the used entries of a table of sector addresses.
+func addrTable(name, label string, addrs []uint32) *table {
+	t := newTable(name, styleColumns, column{"index", label}, column{"address", "Address"})
+	for i, addr := range addrs {
+		if addr != 0 {
+			t.add(i, addr)
+		}
+	}
+	return t
+}
+
+// dumpDirPage decodes the directory page at addr.
+func dumpDirPage(fs *filesystem.FileSystem, addr uint32) error {
+	sec, err := readSector(fs, addr)
+	if err != nil {
+		return err
+	}
+	p := filesystem.DecodeDirPage(sec)
+
+	page := newTable("page", styleRecord,
+		column{"address", "Address"},
+		column{"mark", "Mark"},
+		column{"valid", "Valid"},
+		column{"m", "M"},
+		column{"p0", "P0"},
+	)
+	page.add(addr, hexMark(p.Mark), p.Valid, p.M, p.P0)
+	entries := newTable("entries", styleColumns,
+		column{"index", "Entry"},
+		column{"name", "Name"},
+		column{"adr", "Adr"},
+		column{"p", "P"},
+	)
+	for i, e := range p.Entries {
+		entries.add(i, e.Name, e.Adr, e.P)
+	}
+	return printTables(page, entries)
+}
+
+// dumpIndex decodes the index sector at addr.
+func dumpIndex(fs *filesystem.FileSystem, addr uint32) error {
+	sec, err := readSector(fs, addr)
+	if err != nil {
+		return err
+	}
+	return printTables(addrTable("index", "Index", filesystem.DecodeIndex(sec)))
+}
+
+// dumpBootBlock decodes the boot block of the Oberon partition, which has
+// the same fields as a DOS boot sector.
+func dumpBootBlock(d *disk.Disk) error {
+	b, err := d.BootBlock()
+	if err != nil {
+		return fmt.Errorf("error reading boot block: %w", err)
+	}
+	t := newTable("bootblock", styleRecord,
+		column{"block", "Block"},
+		column{"oem", "OEM name"},
+		column{"bytes_per_sector", "Bytes per sector"},
+		column{"reserved", "Reserved sectors"},
+		column{"sectors16", "Sectors (16 bit)"},
+		column{"sectors_per_track", "Sectors per track"},
+		column{"heads", "Heads"},
+		column{"hidden", "Hidden sectors"},
+		column{"sectors32", "Sectors (32 bit)"},
+		column{"signature", "Signature"},
+	)
+	t.add(
+		d.PartitionStart(),
+		util.StringFromBytes(b[3:11]),
+		util.ReadLEUint16(b, 0x0B),
+		util.ReadLEUint16(b, 0x0E),
+		util.ReadLEUint16(b, 0x13),
+		util.ReadLEUint16(b, 0x18),
+		util.ReadLEUint16(b, 0x1A),
+		util.ReadLEUint32(b, 0x1C),
+		util.ReadLEUint32(b, 0x20),
+		fmt.Sprintf("0x%04X", util.ReadLEUint16(b, 510)),
+	)
+	return printTables(t)
+}
+
+// chs formats the CHS address in a partition table entry.
+func chs(b []byte) string {
+	c := int(b[2]) | int(b[1]&0xC0)<<2
+	return fmt.Sprintf("%d/%d/%d", c, b[0], b[1]&0x3F)
+}
+
+// dumpMBR decodes the partition table in the MBR.
+func dumpMBR(d *disk.Disk) error {
+	b, err := d.MBR()
+	if err != nil {
+		return fmt.Errorf("error reading MBR: %w", err)
+	}
+	parts := newTable("partitions", styleColumns,
+		column{"entry", "Entry"},
+		column{"active", "Active"},
+		column{"type", "Type"},
+		column{"start", "Start"},
+		column{"size", "Size"},
+		column{"chs_start", "CHS start"},
+		column{"chs_end", "CHS end"},
+	)
+	for i := 0; i < 4; i++ {
+		e := b[0x1BE+16*i:]
+		parts.add(i, e[0] == 0x80, e[4], util.ReadLEUint32(e, 8), util.ReadLEUint32(e, 12), chs(e[1:4]), chs(e[5:8]))
+	}
+	mbr := newTable("mbr", styleRecord, column{"signature", "Signature"})
+	mbr.add(fmt.Sprintf("0x%04X", util.ReadLEUint16(b, 510)))
+	return printTables(parts, mbr)
+}
@@ -0,0 +1,88 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+
+	"github.com/asig/odit/internal/filesystem"
+)
+
+// Exit codes, see usage()
+const (
+	exitOK = iota
+	exitFailure
+	exitUsage
+	exitNotFound
+	exitExists
+	exitInvalidName
+	exitDiskFull
+	exitFileTooLarge
+	exitCorrupt
+	exitConflict
+	exitVerify
+	exitNoMatch
+	exitDiffer
+)
+
+var errUsage = errors.New("usage error")
+
+// errConflict is returned by sync if files changed on both sides.
+var errConflict = errors.New("sync conflict")
+
+// errVerify is returned by verify if the image doesn't match the manifest.
+var errVerify = errors.New("verification failed")
+
+// errNoMatch is returned by grep if no line matches.
+var errNoMatch = errors.New("no match")
+
+// errDiffer is returned by diff if the images differ.
+var errDiffer = errors.New("images differ")
+
+// exitCode maps err to the process exit code.
+func exitCode(err error) int {
+	var corrupt *filesystem.ErrCorrupt
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, filesystem.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, filesystem.ErrExists):
+		return exitExists
+	case errors.Is(err, filesystem.ErrInvalidName):
+		return exitInvalidName
+	case errors.Is(err, filesystem.ErrDiskFull):
+		return exitDiskFull
+	case errors.Is(err, filesystem.ErrFileTooLarge):
+		return exitFileTooLarge
+	case errors.As(err, &corrupt):
+		return exitCorrupt
+	case errors.Is(err, errConflict):
+		return exitConflict
+	case errors.Is(err, errVerify):
+		return exitVerify
+	case errors.Is(err, errNoMatch):
+		return exitNoMatch
+	case errors.Is(err, errDiffer):
+		return exitDiffer
+	}
+	return exitFailure
+}
@@ -0,0 +1,125 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/asig/odit/internal/filesystem"
+)
+
+const manifestName = "odit-manifest.json"
+
+// manifestDate is the format of dates in the manifest. Oberon doesn't know
+// about time zones, so neither does the manifest.
+const manifestDate = "2006-01-02T15:04:05"
+
+// manifest describes the files written by export, so that import can restore
+// their names and dates.
+type manifest struct {
+	Files []manifestEntry `json:"files"`
+}
+
+type manifestEntry struct {
+	Name       string `json:"name"`
+	Size       uint32 `json:"size"`
+	Date       string `json:"date"`
+	HeaderAddr uint32 `json:"header_addr"`
+}
+
+func readManifest(dir string) (map[string]manifestEntry, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", manifestName, err)
+	}
+	entries := make(map[string]manifestEntry, len(m.Files))
+	for _, e := range m.Files {
+		if _, err := time.Parse(manifestDate, e.Date); err != nil {
+			return nil, fmt.Errorf("error parsing %s: invalid date for %s: %w", manifestName, e.Name, err)
+		}
+		entries[e.Name] = e
+	}
+	return entries, nil
+}
+
+// exportImage writes all files of the image to dir, together with a
+// manifest.
+func exportImage(fs *filesystem.FileSystem, dir string) error {
+	files, err := fs.ListFiles(filesystem.AllFiles)
+	if err != nil {
+		return fmt.Errorf("error listing files: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating directory %s: %w", dir, err)
+	}
+
+	m := manifest{Files: []manifestEntry{}}
+	var total int64
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		n, err := exportFile(f, path)
+		if err != nil {
+			return fmt.Errorf("error exporting %s to %s: %w", f.Name(), path, err)
+		}
+		total += n
+		m.Files = append(m.Files, manifestEntry{
+			Name:       f.Name(),
+			Size:       f.Size(),
+			Date:       f.CreationTime().Format(manifestDate),
+			HeaderAddr: f.HeaderAddr(),
+		})
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestName), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+
+	summary := newTable("export", styleRecord, column{"files", "Files"}, column{"bytes", "Bytes"}, column{"directory", "Directory"})
+	summary.add(len(files), total, dir)
+	return printTables(summary)
+}
+
+func exportFile(f *filesystem.File, path string) (int64, error) {
+	out, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, io.NewSectionReader(f, 0, int64(f.Size())))
+	if err != nil {
+		out.Close()
+		return n, err
+	}
+	if err := out.Close(); err != nil {
+		return n, err
+	}
+	return n, os.Chtimes(path, f.ModTime(), f.ModTime())
+}
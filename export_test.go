@@ -0,0 +1,54 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, manifestName), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"files": [{"name": "Foo.Mod", "size": 3, "date": "1997-05-04T13:14:15", "header_addr": 58}]}`)
+	m, err := readManifest(dir)
+	if err != nil {
+		t.Fatalf("readManifest failed: %v", err)
+	}
+	e, ok := m["Foo.Mod"]
+	if !ok || e.Size != 3 || e.HeaderAddr != 58 {
+		t.Errorf("readManifest returned %v", m)
+	}
+	if d, _ := time.Parse(manifestDate, e.Date); !d.Equal(time.Date(1997, 5, 4, 13, 14, 15, 0, time.UTC)) {
+		t.Errorf("Date is %v", d)
+	}
+
+	write(`{"files": [{"name": "Foo.Mod", "date": "yesterday"}]}`)
+	if _, err := readManifest(dir); err == nil {
+		t.Errorf("readManifest accepted an invalid date")
+	}
+}
@@ -0,0 +1,417 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asig/odit/internal/filesystem"
+	"github.com/rs/zerolog/log"
+)
+
+// findFile is a directory entry as seen by find. file is nil if the header
+// is damaged.
+type findFile struct {
+	name       string
+	headerAddr uint32
+	file       *filesystem.File
+}
+
+type findPredicate func(*findFile) bool
+
+// fileFilter turns a filter for intact files into a predicate. Damaged
+// files never match.
+func fileFilter(filter filesystem.ListFileFilter) findPredicate {
+	return func(f *findFile) bool {
+		return f.file != nil && filter(f.file)
+	}
+}
+
+// findAction is what find does with the matching files.
+type findAction struct {
+	name string
+	arg  string // directory for -export
+}
+
+// findParser parses the expression of find, which works like the one of
+// Unix find: primaries are joined by -and, which is implied, -or, "!" and
+// parentheses, and followed by the actions.
+type findParser struct {
+	args []string
+	pos  int
+}
+
+// parseFind parses args into a predicate and the actions.
+func parseFind(args []string) (findPredicate, []findAction, error) {
+	p := &findParser{args: args}
+	pred := func(*findFile) bool { return true }
+	if p.pos < len(args) && !isFindAction(args[p.pos]) {
+		var err error
+		if pred, err = p.parseOr(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var actions []findAction
+	for p.pos < len(args) {
+		a := findAction{name: p.next()}
+		switch a.name {
+		case "-print", "-print0", "-json", "-delete":
+		case "-export":
+			arg, err := p.arg(a.name)
+			if err != nil {
+				return nil, nil, err
+			}
+			a.arg = arg
+		default:
+			return nil, nil, fmt.Errorf("%w: unexpected %q after the actions", errUsage, a.name)
+		}
+		actions = append(actions, a)
+	}
+	if len(actions) == 0 {
+		actions = []findAction{{name: "-print"}}
+	}
+	return pred, actions, nil
+}
+
+// scanFind returns how many of args belong to find: everything up to the
+// next command name that isn't the argument of a primary or an action.
+func scanFind(args []string) int {
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case commandSeparator:
+			return i
+		case "-name", "-regex", "-size", "-before", "-after", "-sectors", "-export":
+			i++
+			continue
+		}
+		if _, ok := findCommand(args[i]); ok {
+			return i
+		}
+	}
+	return len(args)
+}
+
+func isFindAction(arg string) bool {
+	switch arg {
+	case "-print", "-print0", "-json", "-delete", "-export":
+		return true
+	}
+	return false
+}
+
+func (p *findParser) next() string {
+	p.pos++
+	return p.args[p.pos-1]
+}
+
+func (p *findParser) peek() string {
+	if p.pos < len(p.args) {
+		return p.args[p.pos]
+	}
+	return ""
+}
+
+func (p *findParser) arg(name string) (string, error) {
+	if p.pos >= len(p.args) {
+		return "", fmt.Errorf("%w: %s needs an argument", errUsage, name)
+	}
+	return p.next(), nil
+}
+
+func (p *findParser) parseOr() (findPredicate, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "-o" || p.peek() == "-or" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f *findFile) bool { return l(f) || right(f) }
+	}
+	return left, nil
+}
+
+func (p *findParser) parseAnd() (findPredicate, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch next := p.peek(); {
+		case next == "-a" || next == "-and":
+			p.next()
+		case next == "" || next == ")" || next == "-o" || next == "-or" || isFindAction(next):
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f *findFile) bool { return l(f) && right(f) }
+	}
+}
+
+func (p *findParser) parseNot() (findPredicate, error) {
+	switch p.peek() {
+	case "!", "-not":
+		p.next()
+		pred, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(f *findFile) bool { return !pred(f) }, nil
+	case "(":
+		p.next()
+		pred, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("%w: missing )", errUsage)
+		}
+		p.next()
+		return pred, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *findParser) parsePrimary() (findPredicate, error) {
+	if p.pos >= len(p.args) {
+		return nil, fmt.Errorf("%w: incomplete expression", errUsage)
+	}
+	name := p.next()
+	switch name {
+	case "-fragmented":
+		return fileFilter(filesystem.Fragmented()), nil
+	case "-damaged":
+		return func(f *findFile) bool { return f.file == nil }, nil
+	case "-name", "-regex", "-size", "-before", "-after", "-sectors":
+	default:
+		return nil, fmt.Errorf("%w: unknown expression %q", errUsage, name)
+	}
+
+	arg, err := p.arg(name)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "-name":
+		return func(f *findFile) bool { return filesystem.MatchPattern(arg, f.name) }, nil
+	case "-regex":
+		re, err := regexp.Compile("^(?:" + arg + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid regular expression %q: %s", errUsage, arg, err)
+		}
+		return func(f *findFile) bool { return re.MatchString(f.name) }, nil
+	case "-size":
+		min, max, err := parseSizeRange(arg)
+		if err != nil {
+			return nil, err
+		}
+		return fileFilter(filesystem.SizeBetween(min, max)), nil
+	case "-before", "-after":
+		t, err := parseDate(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errUsage, err)
+		}
+		// Oberon dates have no zone, compare wall clocks
+		t = wallClock(t)
+		if name == "-before" {
+			return fileFilter(filesystem.CreatedBefore(t)), nil
+		}
+		return fileFilter(filesystem.CreatedAfter(t)), nil
+	}
+	from, to, err := parseSectorRange(arg)
+	if err != nil {
+		return nil, err
+	}
+	return fileFilter(filesystem.UsesSectors(from, to)), nil
+}
+
+// wallClock returns t's wall clock as UTC, like File.CreationTime does.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// parseSize parses a number of bytes with an optional k or M suffix.
+func parseSize(s string) (uint32, error) {
+	mult := uint64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult, s = 1<<10, s[:len(s)-1]
+	case strings.HasSuffix(s, "M"):
+		mult, s = 1<<20, s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n*mult > 1<<32-1 {
+		return 0, fmt.Errorf("%w: invalid size %q", errUsage, s)
+	}
+	return uint32(n * mult), nil
+}
+
+// parseSizeRange parses the argument of -size: "N" for exactly N bytes,
+// "+N" for more, "-N" for less, and "MIN..MAX", where either end can be
+// left out.
+func parseSizeRange(s string) (uint32, uint32, error) {
+	var min, max uint32 = 0, 1<<32 - 1
+	var err error
+	switch {
+	case strings.Contains(s, ".."):
+		lo, hi, _ := strings.Cut(s, "..")
+		if lo != "" {
+			if min, err = parseSize(lo); err != nil {
+				return 0, 0, err
+			}
+		}
+		if hi != "" {
+			if max, err = parseSize(hi); err != nil {
+				return 0, 0, err
+			}
+		}
+	case strings.HasPrefix(s, "+"):
+		if min, err = parseSize(s[1:]); err != nil {
+			return 0, 0, err
+		}
+		min++
+	case strings.HasPrefix(s, "-"):
+		if max, err = parseSize(s[1:]); err != nil {
+			return 0, 0, err
+		}
+		if max == 0 {
+			return 0, 0, fmt.Errorf("%w: no file is smaller than 0 bytes", errUsage)
+		}
+		max--
+	default:
+		if min, err = parseSize(s); err != nil {
+			return 0, 0, err
+		}
+		max = min
+	}
+	return min, max, nil
+}
+
+// parseSectorRange parses the argument of -sectors: a sector address, or
+// "FROM..TO".
+func parseSectorRange(s string) (uint32, uint32, error) {
+	lo, hi, isRange := strings.Cut(s, "..")
+	from, err := strconv.ParseUint(lo, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: invalid sector address %q", errUsage, lo)
+	}
+	to := from
+	if isRange {
+		if to, err = strconv.ParseUint(hi, 10, 32); err != nil {
+			return 0, 0, fmt.Errorf("%w: invalid sector address %q", errUsage, hi)
+		}
+	}
+	return uint32(from), uint32(to), nil
+}
+
+// findFiles runs the actions on the files matching the expression in args.
+func findFiles(fs *filesystem.FileSystem, args []string) error {
+	pred, actions, err := parseFind(args)
+	if err != nil {
+		return err
+	}
+
+	var matches []*findFile
+	for _, e := range fs.ListEntries() {
+		f := &findFile{name: e.Name, headerAddr: e.HeaderAddr}
+		if file, err := fs.NewFileFromFileHeader(e.HeaderAddr); err == nil {
+			if _, err := file.Sectors(); err == nil {
+				f.file = file
+			}
+		}
+		if pred(f) {
+			matches = append(matches, f)
+		}
+	}
+
+	for _, a := range actions {
+		if err := runFindAction(fs, a, matches); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runFindAction(fs *filesystem.FileSystem, a findAction, matches []*findFile) error {
+	switch a.name {
+	case "-print":
+		t := newTable("files", styleBare, column{"name", "Name"})
+		for _, f := range matches {
+			t.add(f.name)
+		}
+		return printTables(t)
+	case "-print0":
+		for _, f := range matches {
+			fmt.Printf("%s\x00", f.name)
+		}
+	case "-json":
+		columns := append(append([]column{}, fileColumns...), column{"damaged", "Damaged"})
+		t := newTable("files", styleColumns, columns...)
+		for _, f := range matches {
+			t.add(findRow(f)...)
+		}
+		return writeTables(os.Stdout, formatJSON, t)
+	case "-export":
+		if err := os.MkdirAll(a.arg, 0755); err != nil {
+			return fmt.Errorf("error creating directory %s: %w", a.arg, err)
+		}
+		for _, f := range matches {
+			if f.file == nil {
+				log.Warn().Msgf("Not exporting %s, its header is damaged", f.name)
+				continue
+			}
+			if err := readFromImage(fs, f.name, filepath.Join(a.arg, f.name)); err != nil {
+				return err
+			}
+		}
+	case "-delete":
+		for _, f := range matches {
+			if err := fs.Remove(f.name); err != nil {
+				return fmt.Errorf("error removing %s: %w", f.name, err)
+			}
+			fmt.Fprintf(os.Stderr, "Removed %s\n", f.name)
+		}
+	}
+	return nil
+}
+
+// findRow returns the columns of list -l for f, and whether f is damaged.
+func findRow(f *findFile) []any {
+	if f.file != nil {
+		if row, err := fileRow(f.file); err == nil {
+			return append(row, false)
+		}
+	}
+	return []any{f.name, nil, nil, f.headerAddr, nil, nil, true}
+}
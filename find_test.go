@@ -0,0 +1,117 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseFind(t *testing.T) {
+	// Without a file, only the name predicates and -damaged can match
+	names := []string{"A.Mod", "B.Mod", "A.Obj", "System.Tool"}
+	tests := []struct {
+		expr    string
+		want    string
+		actions string
+	}{
+		{"", "A.Mod B.Mod A.Obj System.Tool", "-print"},
+		{"-name *.Mod", "A.Mod B.Mod", "-print"},
+		{"-name A.* -name *.Mod", "A.Mod", "-print"},
+		{"-name A.* -a -name *.Mod", "A.Mod", "-print"},
+		{"-name A.* -o -name *.Mod", "A.Mod B.Mod A.Obj", "-print"},
+		{"-name B.* -o -name A.* -name *.Obj", "B.Mod A.Obj", "-print"},
+		{"( -name B.* -o -name A.* ) -name *.Obj", "A.Obj", "-print"},
+		{"! -name *.Mod", "A.Obj System.Tool", "-print"},
+		{"-not -not -name *.Tool", "System.Tool", "-print"},
+		{"-regex [AB]\\.Mod", "A.Mod B.Mod", "-print"},
+		{"-regex Mod", "", "-print"},
+		{"-damaged -json -print0", "A.Mod B.Mod A.Obj System.Tool", "-json -print0"},
+		{"-fragmented -o -size 1..10", "", "-print"},
+		{"-export out -delete", "A.Mod B.Mod A.Obj System.Tool", "-export -delete"},
+	}
+	for _, tc := range tests {
+		pred, actions, err := parseFind(strings.Fields(tc.expr))
+		if err != nil {
+			t.Errorf("parseFind(%q) failed: %v", tc.expr, err)
+			continue
+		}
+		var got, gotActions []string
+		for _, name := range names {
+			if pred(&findFile{name: name}) {
+				got = append(got, name)
+			}
+		}
+		for _, a := range actions {
+			gotActions = append(gotActions, a.name)
+		}
+		if g := strings.Join(got, " "); g != tc.want {
+			t.Errorf("parseFind(%q) matches %q, want %q", tc.expr, g, tc.want)
+		}
+		if g := strings.Join(gotActions, " "); g != tc.actions {
+			t.Errorf("parseFind(%q) has actions %q, want %q", tc.expr, g, tc.actions)
+		}
+	}
+
+	for _, expr := range []string{
+		"-name",
+		"( -name A.Mod",
+		"-name A.Mod )",
+		"-o -name A.Mod",
+		"-bogus",
+		"-print -name A.Mod",
+		"-export",
+		"-regex (",
+		"-size x",
+		"-before yesterday",
+		"-sectors 1..x",
+	} {
+		if _, _, err := parseFind(strings.Fields(expr)); !errors.Is(err, errUsage) {
+			t.Errorf("parseFind(%q) = %v, want usage error", expr, err)
+		}
+	}
+}
+
+func TestParseSizeRange(t *testing.T) {
+	const maxSize = 1<<32 - 1
+	tests := []struct {
+		s        string
+		min, max uint32
+	}{
+		{"100", 100, 100},
+		{"+100", 101, maxSize},
+		{"-100", 0, 99},
+		{"2k", 2048, 2048},
+		{"1M..", 1 << 20, maxSize},
+		{"..1k", 0, 1024},
+		{"10..20", 10, 20},
+	}
+	for _, tc := range tests {
+		min, max, err := parseSizeRange(tc.s)
+		if err != nil || min != tc.min || max != tc.max {
+			t.Errorf("parseSizeRange(%q) = %d, %d, %v, want %d, %d", tc.s, min, max, err, tc.min, tc.max)
+		}
+	}
+	for _, s := range []string{"", "-0", "1..2..3", "5G", "+", "4096M"} {
+		if _, _, err := parseSizeRange(s); err == nil {
+			t.Errorf("parseSizeRange(%q) succeeded, want error", s)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/asig/odit/internal/filesystem"
+	"github.com/asig/odit/internal/text"
+	"github.com/rs/zerolog/log"
+)
+
+// grepLines returns the lines to search in data, the contents of file name,
+// or nil if it's binary. With decode, Oberon Text documents are searched
+// without their header.
+func grepLines(name string, data []byte, decode bool) []string {
+	content := ""
+	switch s, err := text.Decode(data); {
+	case decode && err == nil:
+		content = s
+	case decode && !errors.Is(err, text.ErrNotText):
+		log.Warn().Msgf("Searching %s as binary file: %s", name, err)
+		fallthrough
+	default:
+		if bytes.IndexByte(data, 0) >= 0 {
+			return nil
+		}
+		content = strings.ReplaceAll(string(data), "\r\n", "\n")
+		content = strings.ReplaceAll(content, "\r", "\n")
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// grepFiles shows the lines matching the regular expression re in the
+// files matching pattern, or with namesOnly, just the names of the files.
+// It fails with errNoMatch if no line matches.
+func grepFiles(fs *filesystem.FileSystem, re, pattern string, ignoreCase, namesOnly, decode bool) error {
+	if ignoreCase {
+		re = "(?i)" + re
+	}
+	r, err := regexp.Compile(re)
+	if err != nil {
+		return fmt.Errorf("%w: invalid regular expression %q: %s", errUsage, re, err)
+	}
+	files, err := fs.ListFiles(filesystem.NameMatches(pattern))
+	if err != nil {
+		return fmt.Errorf("error listing files: %w", err)
+	}
+
+	var t *table
+	if namesOnly {
+		t = newTable("files", styleBare, column{"name", "Name"})
+	} else {
+		t = newTable("matches", styleColumns, column{"name", "Name"}, column{"line", "Line"}, column{"text", "Text"})
+	}
+	matches := 0
+	for _, f := range files {
+		data, err := io.ReadAll(io.NewSectionReader(f, 0, int64(f.Size())))
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", f.Name(), err)
+		}
+		lines := grepLines(f.Name(), data, decode)
+		if lines == nil {
+			// Like grep, only say whether a binary file matches
+			if !r.Match(data) {
+				continue
+			}
+			matches++
+			if namesOnly {
+				t.add(f.Name())
+			} else {
+				t.add(f.Name(), nil, "binary file matches")
+			}
+			continue
+		}
+		for i, line := range lines {
+			if !r.MatchString(line) {
+				continue
+			}
+			matches++
+			if namesOnly {
+				t.add(f.Name())
+				break
+			}
+			t.add(f.Name(), i+1, line)
+		}
+	}
+	if err := printTables(t); err != nil {
+		return err
+	}
+	if matches == 0 {
+		return fmt.Errorf("%w: %s", errNoMatch, re)
+	}
+	return nil
+}
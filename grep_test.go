@@ -0,0 +1,46 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestGrepLines(t *testing.T) {
+	// A Project Oberon text with one run in font 1
+	doc := []byte("\xf1\x17\x00\x00\x00\x01F.Fnt\x00\x00\x00\x07\x00\x00\x00\x00\x07\x00\x00\x00ab\rc\rd\r")
+	tests := []struct {
+		data   string
+		decode bool
+		want   []string
+	}{
+		{"a\rb\r", false, []string{"a", "b"}},
+		{"a\r\nb\nc", true, []string{"a", "b", "c"}},
+		{"a\x00b", false, nil},
+		{string(doc), false, nil},
+		{string(doc), true, []string{"ab", "c", "d"}},
+		{string(doc[:10]), true, nil}, // damaged, searched as binary
+	}
+	for _, tc := range tests {
+		if got := grepLines("T.Text", []byte(tc.data), tc.decode); !slices.Equal(got, tc.want) {
+			t.Errorf("grepLines(%q, %v) = %q, want %q", tc.data, tc.decode, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asig/odit/internal/filesystem"
+)
+
+// hashEntry is a line of the manifest written by hash.
+type hashEntry struct {
+	name string
+	size int64
+	date time.Time
+	sum  string
+}
+
+var hashColumns = []column{{"name", "Name"}, {"size", "Size"}, {"date", "Date"}, {"sha256", "SHA-256"}}
+
+// hashFiles prints the SHA-256 of the files matching pattern, together with
+// their names, sizes and dates.
+func hashFiles(fs *filesystem.FileSystem, pattern string) error {
+	files, err := fs.ListFiles(filesystem.NameMatches(pattern))
+	if err != nil {
+		return fmt.Errorf("error listing files: %w", err)
+	}
+	t := newTable("hash", styleColumns, hashColumns...)
+	for _, f := range files {
+		sum, err := imageDiffFile(f).hash()
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", f.Name(), err)
+		}
+		t.add(f.Name(), f.Size(), f.CreationTime(), sum)
+	}
+	return printTables(t)
+}
+
+// readHashManifest parses the output of hash, in any of the output formats.
+func readHashManifest(r io.Reader) ([]hashEntry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		return parseHashJSON(trimmed)
+	case bytes.HasPrefix(trimmed, []byte("name,")):
+		return parseHashCSV(trimmed)
+	}
+	return parseHashText(trimmed)
+}
+
+func parseHashJSON(data []byte) ([]hashEntry, error) {
+	var rows []struct {
+		Name   string `json:"name"`
+		Size   int64  `json:"size"`
+		Date   string `json:"date"`
+		SHA256 string `json:"sha256"`
+	}
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, err
+	}
+	entries := make([]hashEntry, len(rows))
+	for i, row := range rows {
+		date, err := time.Parse(tableDate, row.Date)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q for %s", row.Date, row.Name)
+		}
+		entries[i] = hashEntry{row.Name, row.Size, date, row.SHA256}
+	}
+	return entries, nil
+}
+
+func parseHashCSV(data []byte) ([]hashEntry, error) {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var entries []hashEntry
+	for i, rec := range records[1:] {
+		if len(rec) != len(hashColumns) {
+			return nil, fmt.Errorf("line %d: expected %d fields", i+2, len(hashColumns))
+		}
+		e, err := parseHashEntry(rec[0], rec[1], rec[2], tableDate, rec[3])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+2, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// parseHashText parses the text format. Names don't contain blanks, so
+// fields are separated by blanks; the date takes two.
+func parseHashText(data []byte) ([]hashEntry, error) {
+	var entries []hashEntry
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for sc.Scan() {
+		line++
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || line == 1 && fields[0] == hashColumns[0].label {
+			continue
+		}
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("line %d: expected name, size, date and hash", line)
+		}
+		e, err := parseHashEntry(fields[0], fields[1], fields[2]+" "+fields[3], time.DateTime, fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+func parseHashEntry(name, size, date, dateLayout, sum string) (hashEntry, error) {
+	e := hashEntry{name: name, sum: sum}
+	var err error
+	if e.size, err = strconv.ParseInt(size, 10, 64); err != nil {
+		return e, fmt.Errorf("invalid size %q", size)
+	}
+	if e.date, err = time.Parse(dateLayout, date); err != nil {
+		return e, fmt.Errorf("invalid date %q", date)
+	}
+	return e, nil
+}
+
+// verifyFiles checks the image against the manifest written by hash. It
+// fails with errVerify if files differ, are missing or are not listed.
+func verifyFiles(fs *filesystem.FileSystem, manifestFile string, ignoreDates bool) error {
+	in := os.Stdin
+	if manifestFile != "-" {
+		var err error
+		if in, err = os.Open(manifestFile); err != nil {
+			return fmt.Errorf("error opening manifest: %w", err)
+		}
+		defer in.Close()
+	}
+	expected, err := readHashManifest(in)
+	if err != nil {
+		return fmt.Errorf("error reading manifest %s: %w", manifestFile, err)
+	}
+
+	files, err := fs.ListFiles(filesystem.AllFiles)
+	if err != nil {
+		return fmt.Errorf("error listing files: %w", err)
+	}
+	byName := make(map[string]*filesystem.File, len(files))
+	for _, f := range files {
+		byName[f.Name()] = f
+	}
+
+	t := newTable("verify", styleColumns, column{"name", "Name"}, column{"status", "Status"}, column{"differences", "Differences"})
+	ok, mismatched, missing := 0, 0, 0
+	for _, e := range expected {
+		f, found := byName[e.name]
+		if !found {
+			t.add(e.name, "missing", "")
+			missing++
+			continue
+		}
+		delete(byName, e.name)
+
+		var diffs []string
+		if int64(f.Size()) != e.size {
+			diffs = append(diffs, "size")
+		}
+		if !ignoreDates && !f.CreationTime().Equal(e.date) {
+			diffs = append(diffs, "date")
+		}
+		sum, err := imageDiffFile(f).hash()
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", f.Name(), err)
+		}
+		if sum != e.sum {
+			diffs = append(diffs, "sha256")
+		}
+		if len(diffs) > 0 {
+			t.add(e.name, "mismatch", strings.Join(diffs, ","))
+			mismatched++
+		} else {
+			ok++
+		}
+	}
+	var extra []string
+	for name := range byName {
+		extra = append(extra, name)
+	}
+	slices.Sort(extra)
+	for _, name := range extra {
+		t.add(name, "extra", "")
+	}
+
+	summary := newTable("summary", styleRecord,
+		column{"ok", "OK"},
+		column{"mismatched", "Mismatched"},
+		column{"missing", "Missing"},
+		column{"extra", "Extra"},
+	)
+	summary.add(ok, mismatched, missing, len(extra))
+	if err := printTables(t, summary); err != nil {
+		return err
+	}
+	if mismatched+missing+len(extra) > 0 {
+		return fmt.Errorf("%w: %d mismatched, %d missing, %d extra files", errVerify, mismatched, missing, len(extra))
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestReadHashManifest(t *testing.T) {
+	want := []hashEntry{
+		{"System.Tool", 1234, time.Date(1997, 5, 4, 13, 14, 15, 0, time.UTC), "0d3b"},
+		{"Foo.Mod", 0, time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC), "e3b0"},
+	}
+	for _, format := range []string{formatText, formatJSON, formatCSV} {
+		tbl := newTable("hash", styleColumns, hashColumns...)
+		for _, e := range want {
+			tbl.add(e.name, uint32(e.size), e.date, e.sum)
+		}
+		var buf bytes.Buffer
+		if err := writeTables(&buf, format, tbl); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readHashManifest(&buf)
+		if err != nil {
+			t.Errorf("%s: readHashManifest failed: %v", format, err)
+			continue
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: got %v, want %v", format, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i].name != want[i].name || got[i].size != want[i].size || !got[i].date.Equal(want[i].date) || got[i].sum != want[i].sum {
+				t.Errorf("%s: entry %d is %v, want %v", format, i, got[i], want[i])
+			}
+		}
+	}
+
+	if _, err := readHashManifest(bytes.NewBufferString("Foo.Mod 12 yesterday 0d3b\n")); err == nil {
+		t.Errorf("readHashManifest accepted an invalid line")
+	}
+}
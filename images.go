@@ -0,0 +1,97 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/asig/odit/internal/disk"
+	"github.com/asig/odit/internal/filesystem"
+)
+
+// imageSet keeps track of the images opened while odit runs, so that an
+// image is opened only once, however often it's named.
+type imageSet struct {
+	allocator filesystem.Allocator
+	images    []*openImage
+}
+
+type openImage struct {
+	path string
+	info os.FileInfo
+	disk *disk.Disk
+	fs   *filesystem.FileSystem
+}
+
+var images imageSet
+
+// open returns the file system in the image at path.
+func (s *imageSet) open(path string) (*filesystem.FileSystem, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open image: %w", err)
+	}
+	for _, img := range s.images {
+		if os.SameFile(img.info, info) {
+			return img.fs, nil
+		}
+	}
+
+	d, err := disk.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open image %s: %w", path, err)
+	}
+	fs, err := filesystem.New(d)
+	if err != nil {
+		d.Close()
+		return nil, fmt.Errorf("can't load file system in %s: %w", path, err)
+	}
+	if s.allocator != nil {
+		fs.SetAllocator(s.allocator)
+	}
+	s.images = append(s.images, &openImage{path: path, info: info, disk: d, fs: fs})
+	return fs, nil
+}
+
+// path returns the path fs was opened from.
+func (s *imageSet) path(fs *filesystem.FileSystem) (string, error) {
+	for _, img := range s.images {
+		if img.fs == fs {
+			return img.path, nil
+		}
+	}
+	return "", fmt.Errorf("image of file system not known")
+}
+
+// close closes all images. It returns the first error.
+func (s *imageSet) close() error {
+	var first error
+	for _, img := range s.images {
+		err := img.fs.Close()
+		if cerr := img.disk.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil && first == nil {
+			first = fmt.Errorf("error closing %s: %w", img.path, err)
+		}
+	}
+	s.images = nil
+	return first
+}
@@ -0,0 +1,317 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/asig/odit/internal/filesystem"
+	"github.com/rs/zerolog/log"
+)
+
+// How import maps host paths to Oberon names, see the -map flag
+const (
+	mapBase   = "base"   // sub/Foo.Mod -> Foo.Mod
+	mapDotted = "dotted" // sub/Foo.Mod -> Sub.Foo.Mod
+)
+
+// What import does with names Oberon doesn't accept, see the -invalid flag
+const (
+	invalidReject        = "reject"
+	invalidTransliterate = "transliterate"
+)
+
+// importEntry is a file to be imported, from a host directory or an archive.
+type importEntry struct {
+	path          string // host path, or path in the archive
+	rel           string // slash separated path relative to the imported tree
+	size          int64
+	mtime         time.Time
+	name          string    // name in the image
+	date          time.Time // date in the image; zero for the current time
+	transliterate bool      // name had to be changed to be valid
+}
+
+// importName maps rel, a slash separated path relative to the imported
+// directory, to a file name.
+func importName(rel, mapping string) string {
+	parts := strings.Split(rel, "/")
+	if mapping == mapBase {
+		return parts[len(parts)-1]
+	}
+	for i, p := range parts[:len(parts)-1] {
+		if p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// transliterateName turns name into a valid file name: invalid characters
+// are dropped, with the next letter capitalized ("foo_bar" -> "fooBar"), an
+// "X" is prepended if name doesn't start with a letter, and names that are
+// too long are shortened, keeping the extension if possible.
+func transliterateName(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range name {
+		switch {
+		case r == '.' || r >= '0' && r <= '9':
+			b.WriteRune(r)
+			upper = false
+		case r >= 'a' && r <= 'z':
+			if upper {
+				r -= 'a' - 'A'
+			}
+			b.WriteRune(r)
+			upper = false
+		case r >= 'A' && r <= 'Z':
+			b.WriteRune(r)
+			upper = false
+		default:
+			upper = true
+		}
+	}
+	s := b.String()
+	if s == "" || !(s[0] >= 'a' && s[0] <= 'z' || s[0] >= 'A' && s[0] <= 'Z') {
+		s = "X" + s
+	}
+	if len(s) > filesystem.MaxNameLength {
+		ext := ""
+		if i := strings.LastIndexByte(s, '.'); i > 0 && len(s)-i <= filesystem.MaxNameLength/2 {
+			ext = s[i:]
+		}
+		s = s[:filesystem.MaxNameLength-len(ext)] + ext
+	}
+	return s
+}
+
+// isHidden tells whether rel, or one of the directories it's in, starts
+// with a dot, like .git does.
+func isHidden(rel string) bool {
+	for _, p := range strings.Split(rel, "/") {
+		if strings.HasPrefix(p, ".") && p != "." && p != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// dirEntries collects the files below dir. It returns the files and the
+// number of entries skipped.
+func dirEntries(dir string) ([]importEntry, int, error) {
+	var entries []importEntry
+	skipped := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			skipped++
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			skipped++
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel = filepath.ToSlash(rel); rel == manifestName {
+			return nil
+		}
+		entries = append(entries, importEntry{path: path, rel: rel, size: info.Size(), mtime: info.ModTime()})
+		return nil
+	})
+	return entries, skipped, err
+}
+
+// planImport decides on the names and dates of entries. Files listed in
+// recorded, the manifest if there is one, keep the name and date recorded
+// there. With keepMtime, the other files' dates are their modification times.
+// It returns the files to import and all problems found.
+func planImport(fsys *filesystem.FileSystem, entries []importEntry, mapping, invalid string, mode writeMode, recorded map[string]manifestEntry, keepMtime bool) ([]importEntry, []error) {
+	var planned []importEntry
+	var problems []error
+	byName := make(map[string]string) // name -> path
+
+	for _, e := range entries {
+		e.name = importName(e.rel, mapping)
+		if keepMtime {
+			e.date = e.mtime
+		}
+		if m, ok := recorded[e.rel]; ok {
+			e.name = m.Name
+			e.date, _ = time.Parse(manifestDate, m.Date) // checked by readManifest
+			delete(recorded, e.rel)
+		}
+		if err := filesystem.ValidateFilename(e.name); err != nil {
+			if invalid == invalidReject {
+				problems = append(problems, fmt.Errorf("%s: %w", e.path, err))
+				continue
+			}
+			e.name = transliterateName(e.name)
+			e.transliterate = true
+		}
+		if other, ok := byName[e.name]; ok {
+			problems = append(problems, fmt.Errorf("%s and %s both map to %s: %w", other, e.path, e.name, filesystem.ErrExists))
+			continue
+		}
+		byName[e.name] = e.path
+		if mode == writeNew {
+			if _, err := fsys.Find(e.name); err == nil {
+				problems = append(problems, fmt.Errorf("%s (from %s): %w", e.name, e.path, filesystem.ErrExists))
+				continue
+			}
+		}
+		planned = append(planned, e)
+	}
+	for name := range recorded {
+		log.Warn().Msgf("%s is listed in %s, but doesn't exist", name, manifestName)
+	}
+	return planned, problems
+}
+
+// importOptions are the flags of the import command.
+type importOptions struct {
+	mapping     string
+	invalid     string
+	mode        writeMode
+	useManifest bool
+	keepMtime   bool
+	dryRun      bool
+	tarFile     string
+	zipFile     string
+}
+
+// importFiles writes all files below dir, or in the archive given in opts,
+// into the image. Names and conflicts are checked for all files first, and
+// nothing is written if one of them can't be imported. If writing a file
+// fails, e.g. because the disk is full, the files stored before stay in
+// the image.
+func importFiles(fsys *filesystem.FileSystem, dir string, opts importOptions) error {
+	if opts.mapping != mapBase && opts.mapping != mapDotted {
+		return fmt.Errorf("%w: unknown name mapping %q, must be %s or %s", errUsage, opts.mapping, mapBase, mapDotted)
+	}
+	if opts.invalid != invalidReject && opts.invalid != invalidTransliterate {
+		return fmt.Errorf("%w: unknown value %q for -invalid, must be %s or %s", errUsage, opts.invalid, invalidReject, invalidTransliterate)
+	}
+
+	var entries []importEntry
+	var skipped int
+	var open func(e importEntry) (io.ReadCloser, error)
+	var recorded map[string]manifestEntry
+	var err error
+	switch {
+	case opts.tarFile != "":
+		var tr *tarImport
+		if tr, err = openTarImport(opts.tarFile); err != nil {
+			return err
+		}
+		defer tr.Close()
+		entries, skipped, err = tr.entries()
+		open = tr.open
+		opts.keepMtime = true
+	case opts.zipFile != "":
+		var zr *zipImport
+		if zr, err = openZipImport(opts.zipFile); err != nil {
+			return err
+		}
+		defer zr.Close()
+		entries, skipped = zr.entries()
+		open = zr.open
+		opts.keepMtime = true
+	default:
+		if opts.useManifest {
+			if recorded, err = readManifest(dir); err != nil {
+				return fmt.Errorf("error reading manifest: %w", err)
+			}
+		}
+		entries, skipped, err = dirEntries(dir)
+		open = func(e importEntry) (io.ReadCloser, error) { return os.Open(e.path) }
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", importSource(dir, opts), err)
+	}
+
+	planned, problems := planImport(fsys, entries, opts.mapping, opts.invalid, opts.mode, recorded, opts.keepMtime)
+	if len(problems) > 0 {
+		return errors.Join(problems...)
+	}
+
+	files := newTable("files", styleColumns, column{"source", "Source"}, column{"name", "Name"}, column{"size", "Size"}, column{"transliterated", "Transliterated"})
+	var total int64
+	transliterated := 0
+	for i, e := range planned {
+		if !opts.dryRun {
+			in, err := open(e)
+			if err != nil {
+				return fmt.Errorf("error opening %s (%d of %d files imported): %w", e.path, i, len(planned), err)
+			}
+			err = storeFile(fsys, in, e.size, e.date, e.path, e.name, opts.mode)
+			in.Close()
+			if err != nil {
+				return fmt.Errorf("%w (%d of %d files imported)", err, i, len(planned))
+			}
+		}
+		files.add(e.path, e.name, e.size, e.transliterate)
+		total += e.size
+		if e.transliterate {
+			transliterated++
+		}
+	}
+
+	summary := newTable("summary", styleRecord,
+		column{"files", "Files"},
+		column{"bytes", "Bytes"},
+		column{"transliterated", "Transliterated"},
+		column{"skipped", "Skipped"},
+		column{"dry_run", "Dry run"},
+	)
+	summary.add(len(planned), total, transliterated, skipped, opts.dryRun)
+	return printTables(files, summary)
+}
+
+func importSource(dir string, opts importOptions) string {
+	switch {
+	case opts.tarFile != "":
+		return opts.tarFile
+	case opts.zipFile != "":
+		return opts.zipFile
+	}
+	return dir
+}
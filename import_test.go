@@ -0,0 +1,63 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/asig/odit/internal/filesystem"
+)
+
+func TestImportNames(t *testing.T) {
+	tests := []struct {
+		rel, mapping, want string
+	}{
+		{"Foo.Mod", mapBase, "Foo.Mod"},
+		{"sub/Foo.Mod", mapBase, "Foo.Mod"},
+		{"sub/Foo.Mod", mapDotted, "Sub.Foo.Mod"},
+		{"a/b/Foo.Mod", mapDotted, "A.B.Foo.Mod"},
+	}
+	for _, tc := range tests {
+		if got := importName(tc.rel, tc.mapping); got != tc.want {
+			t.Errorf("importName(%q, %s) = %q, want %q", tc.rel, tc.mapping, got, tc.want)
+		}
+	}
+
+	translits := []struct {
+		name, want string
+	}{
+		{"Foo.Mod", "Foo.Mod"},
+		{"foo_bar.Mod", "fooBar.Mod"},
+		{"my-module.Mod", "myModule.Mod"},
+		{"2d.Mod", "X2d.Mod"},
+		{"_init.Mod", "Init.Mod"},
+		{"Grüße.Text", "GrE.Text"},
+		{"AVeryLongModuleNameThatDoesNotFit.Mod", "AVeryLongModuleNameThatDoesN.Mod"},
+		{"AVeryLongModuleNameThatDoesNotFitEither", "AVeryLongModuleNameThatDoesNotFi"},
+	}
+	for _, tc := range translits {
+		got := transliterateName(tc.name)
+		if got != tc.want {
+			t.Errorf("transliterateName(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+		if err := filesystem.ValidateFilename(got); err != nil {
+			t.Errorf("transliterateName(%q) is invalid: %v", tc.name, err)
+		}
+	}
+}
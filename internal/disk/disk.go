@@ -19,7 +19,9 @@
 package disk
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/asig/odit/internal/util"
@@ -35,6 +37,16 @@ const (
 	bps = SectorSize / bs // blocks per sector
 )
 
+var (
+	// ErrInvalidSector is returned for sector addresses that are not a
+	// multiple of SectorMultiplier or lie outside the partition.
+	ErrInvalidSector = errors.New("invalid sector number")
+
+	// ErrNoPartition is returned by Open if the image has no Native Oberon
+	// partition.
+	ErrNoPartition = errors.New("Oberon partition not found")
+)
+
 type Sector [SectorSize]byte
 
 type Disk struct {
@@ -66,6 +78,132 @@ func Open(imagePath string) (*Disk, error) {
 	return disk, nil
 }
 
+// Layout describes a new image, see Create. All sizes are in 512 byte
+// blocks.
+type Layout struct {
+	Size            uint32 // of the image
+	Heads           uint32 // for the CHS addresses in the partition table
+	SectorsPerTrack uint32
+	PartitionStart  uint32
+	PartitionSize   uint32 // 0 for the rest of the image
+	Reserved        uint32 // blocks before the file system, at least 1 for the boot block
+	BootBlock       []byte // optional; the fields describing the partition are filled in
+	BootFile        []byte // optional; goes right after the boot block
+}
+
+// Create writes a new image with a single Native Oberon partition to path,
+// replacing any existing file. Everything that isn't set by l is zero, so
+// the same layout always gives the same image. The file system still needs
+// to be formatted.
+func Create(imagePath string, l Layout) (*Disk, error) {
+	if l.Heads == 0 || l.SectorsPerTrack == 0 {
+		return nil, fmt.Errorf("Create: invalid geometry: %d heads, %d sectors per track", l.Heads, l.SectorsPerTrack)
+	}
+	if l.Size == 0 {
+		return nil, fmt.Errorf("Create: disk of 0 blocks")
+	}
+	if l.PartitionStart == 0 || l.PartitionStart >= l.Size {
+		return nil, fmt.Errorf("Create: partition start %d not in 1..%d", l.PartitionStart, l.Size-1)
+	}
+	if l.PartitionSize == 0 {
+		l.PartitionSize = l.Size - l.PartitionStart
+	}
+	if l.PartitionSize > l.Size-l.PartitionStart {
+		return nil, fmt.Errorf("Create: partition of %d blocks doesn't fit into %d blocks", l.PartitionSize, l.Size-l.PartitionStart)
+	}
+	if len(l.BootBlock) > bs {
+		return nil, fmt.Errorf("Create: boot block has %d bytes, must be at most %d", len(l.BootBlock), bs)
+	}
+	if l.Reserved < 1+uint32((len(l.BootFile)+bs-1)/bs) {
+		return nil, fmt.Errorf("Create: %d reserved blocks can't hold the boot block and a boot file of %d bytes", l.Reserved, len(l.BootFile))
+	}
+	// The root directory and the index need at least two sectors
+	if l.PartitionSize < l.Reserved+2*bps {
+		return nil, fmt.Errorf("Create: partition of %d blocks is too small", l.PartitionSize)
+	}
+
+	f, err := os.OpenFile(imagePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	d := &Disk{f: f}
+	if err := d.format(l); err != nil {
+		d.Close()
+		return nil, err
+	}
+	if err := d.init(); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Disk) format(l Layout) error {
+	if err := d.f.Truncate(int64(l.Size) * bs); err != nil {
+		return err
+	}
+
+	mbr := make([]byte, bs)
+	e := 0x1BE
+	mbr[e] = 0x80 // active
+	l.writeCHS(mbr[e+1:], l.PartitionStart)
+	mbr[e+4] = oberonPartitionType
+	l.writeCHS(mbr[e+5:], l.PartitionStart+l.PartitionSize-1)
+	util.WriteLEUint32(mbr, e+8, l.PartitionStart)
+	util.WriteLEUint32(mbr, e+12, l.PartitionSize)
+	mbr[510], mbr[511] = 0x55, 0xAA
+	if err := d.putBlocks(0, 1, mbr, 0); err != nil {
+		return err
+	}
+
+	// Same fields as in a DOS boot sector
+	boot := make([]byte, bs)
+	copy(boot, l.BootBlock)
+	if l.BootBlock == nil {
+		copy(boot[3:], "OBERON")
+	}
+	util.WriteLEUint16(boot, 0x0B, bs)
+	util.WriteLEUint16(boot, 0x0E, uint16(l.Reserved))
+	if l.PartitionSize < 1<<16 {
+		util.WriteLEUint16(boot, 0x13, uint16(l.PartitionSize))
+	} else {
+		util.WriteLEUint16(boot, 0x13, 0)
+	}
+	util.WriteLEUint16(boot, 0x18, uint16(l.SectorsPerTrack))
+	util.WriteLEUint16(boot, 0x1A, uint16(l.Heads))
+	util.WriteLEUint32(boot, 0x1C, l.PartitionStart)
+	util.WriteLEUint32(boot, 0x20, l.PartitionSize)
+	boot[510], boot[511] = 0x55, 0xAA
+	if err := d.putBlocks(l.PartitionStart, 1, boot, 0); err != nil {
+		return err
+	}
+
+	if len(l.BootFile) > 0 {
+		n := uint32((len(l.BootFile) + bs - 1) / bs)
+		b := make([]byte, n*bs)
+		copy(b, l.BootFile)
+		if err := d.putBlocks(l.PartitionStart+1, n, b, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCHS writes the CHS address of block lba to b, the way partition
+// tables have it. Blocks beyond what CHS can address get the largest
+// address.
+func (l Layout) writeCHS(b []byte, lba uint32) {
+	c := lba / (l.Heads * l.SectorsPerTrack)
+	h := lba / l.SectorsPerTrack % l.Heads
+	s := lba%l.SectorsPerTrack + 1
+	if c > 1023 {
+		c, h, s = 1023, 254, 63
+	}
+	b[0] = byte(h)
+	b[1] = byte(s&0x3F) | byte(c>>2&0xC0)
+	b[2] = byte(c)
+}
+
 func (d *Disk) Close() error {
 	return d.f.Close()
 }
@@ -75,6 +213,24 @@ func (d *Disk) Size() uint32 {
 	return d.nummax * SectorMultiplier
 }
 
+// PartitionStart returns the first block of the Oberon partition, i.e. of
+// its boot block.
+func (d *Disk) PartitionStart() uint32 {
+	return d.partitionOffset
+}
+
+// MBR returns the first block of the image, with the partition table.
+func (d *Disk) MBR() ([]byte, error) {
+	b := make([]byte, bs)
+	return b, d.getBlocks(0, 1, b, 0)
+}
+
+// BootBlock returns the first block of the Oberon partition.
+func (d *Disk) BootBlock() ([]byte, error) {
+	b := make([]byte, bs)
+	return b, d.getBlocks(d.partitionOffset, 1, b, 0)
+}
+
 func (d *Disk) init() error {
 	// Read partition table, finding first Native Oberon partition
 	partitions, err := d.readPartitionTable()
@@ -89,13 +245,16 @@ func (d *Disk) init() error {
 		}
 	}
 	if oberonPart == -1 {
-		return fmt.Errorf("init: Oberon partition not found")
+		return fmt.Errorf("init: %w", ErrNoPartition)
 	}
 	d.partitionOffset = partitions[oberonPart].start
 	d.partitionLen = partitions[oberonPart].size
 
 	b := make([]byte, bs)
-	d.getBlocks(d.partitionOffset, 1, b, 0) // read boot block to get offset
+	err = d.getBlocks(d.partitionOffset, 1, b, 0) // read boot block to get offset
+	if err != nil {
+		return err
+	}
 
 	if util.ReadLEUint16(b, 0) != 0xAA55 {
 		if !(b[3] == 'O' && b[4] == 'B' && b[5] == 'E' && b[6] == 'R' && b[7] == 'O' && b[8] == 'N') {
@@ -126,10 +285,11 @@ func (d *Disk) init() error {
 func (d *Disk) getBlocks(start, num uint32, buf []byte, ofs int) error {
 	// log.Debug().Msgf("getBlocks: reading %d blocks starting at %d", num, start)
 
+	// ReadAt and WriteAt don't share a file offset, so concurrent transfers
+	// don't get in each other's way.
 	b := make([]byte, num*bs)
-	d.f.Seek(int64(start*bs), 0)
-	count, err := d.f.Read(b)
-	if err != nil {
+	count, err := d.f.ReadAt(b, int64(start)*bs)
+	if err != nil && !(errors.Is(err, io.EOF) && count > 0) {
 		return err
 	}
 	if count < int(num*bs) {
@@ -148,15 +308,8 @@ func (d *Disk) putBlocks(start, num uint32, buf []byte, ofs int) error {
 	}
 	copy(b, buf[ofs:])
 
-	_, err := d.f.Seek(int64(start*bs), 0)
-	if err != nil {
-		panic(err)
-	}
-	_, err = d.f.Write(b)
-	if err != nil {
-		panic(err)
-	}
-	return nil
+	_, err := d.f.WriteAt(b, int64(start)*bs)
+	return err
 }
 
 /*
@@ -321,42 +474,27 @@ func (d *Disk) readLogical(first uint32) (partitions []partition, err error) {
 // "sec" is the sector data to write.
 func (d *Disk) PutSector(src uint32, sec Sector) error {
 	if src%SectorMultiplier != 0 {
-		panic(fmt.Sprintf("PutSector: invalid sector number %d (mod %d == %d)", src, SectorMultiplier, src%SectorMultiplier))
+		return fmt.Errorf("PutSector: %w %d (mod %d == %d)", ErrInvalidSector, src, SectorMultiplier, src%SectorMultiplier)
 	}
 	src = src / SectorMultiplier
 
 	if src < 1 || src > d.nummax {
-		return fmt.Errorf("PutSector: invalid sector number %d (not in 1..%d)", src, d.nummax)
+		return fmt.Errorf("PutSector: %w %d (not in 1..%d)", ErrInvalidSector, src, d.nummax)
 	}
 
 	return d.putBlocks(d.partitionOffset+d.rootOffset+(src-1)*bps, bps, sec[:], 0)
 }
 
-func (d *Disk) MustGetSector(src uint32) Sector {
-	sec, err := d.GetSector(src)
-	if err != nil {
-		panic(fmt.Sprintf("MustGetSector: failed to read sector %d: %v", src, err))
-	}
-	return sec
-}
-
-func (d *Disk) MustPutSector(src uint32, sec Sector) {
-	err := d.PutSector(src, sec)
-	if err != nil {
-		panic(fmt.Sprintf("MustPutSector: failed to write sector %d: %v", src, err))
-	}
-}
-
 // GetSector reads a 2048-byte Oberon sector. Sector addresses are 1-based!
 // src is sector number (in "encoded" Oberon sectors, i.e. multiple of 29)
 // dest is the buffer to read into.
 func (d *Disk) GetSector(src uint32) (Sector, error) {
 	if src%SectorMultiplier != 0 {
-		panic(fmt.Sprintf("GetSector: invalid sector number %d (mod %d == %d)", src, SectorMultiplier, src%SectorMultiplier))
+		return Sector{}, fmt.Errorf("GetSector: %w %d (mod %d == %d)", ErrInvalidSector, src, SectorMultiplier, src%SectorMultiplier)
 	}
 	src = src / SectorMultiplier
 	if src < 1 || src > d.nummax {
-		return Sector{}, fmt.Errorf("GetSector: invalid sector number %d (not in 1..%d)", src, d.nummax)
+		return Sector{}, fmt.Errorf("GetSector: %w %d (not in 1..%d)", ErrInvalidSector, src, d.nummax)
 	}
 
 	var sec Sector
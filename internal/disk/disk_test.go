@@ -20,6 +20,8 @@ package disk
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -33,3 +35,46 @@ func TestAll(t *testing.T) {
 	defer disk.Close()
 
 }
+
+func TestCreate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "new.img")
+	l := Layout{
+		Size:            2048,
+		Heads:           16,
+		SectorsPerTrack: 63,
+		PartitionStart:  63,
+		Reserved:        3,
+		BootFile:        []byte("boot file"),
+	}
+	d, err := Create(path, l)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	d.Close()
+
+	d, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer d.Close()
+	if want := (2048 - 63 - 3) / bps * SectorMultiplier; d.Size() != want {
+		t.Errorf("Size is %d, want %d", d.Size(), want)
+	}
+	b := make([]byte, bs)
+	if err := d.getBlocks(64, 1, b, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:9]) != "boot file" {
+		t.Errorf("Boot file not found after the boot block")
+	}
+
+	l.Reserved = 1
+	if _, err := Create(path, l); err == nil {
+		t.Errorf("Create accepted a boot file that doesn't fit")
+	}
+
+	l.Size = 0
+	if _, err := Create(path, l); err == nil || strings.Contains(err.Error(), "4294967295") {
+		t.Errorf("Create with size 0: got %v, want an error without wrapped sizes", err)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filesystem
+
+import (
+	"math/rand"
+
+	"github.com/asig/odit/internal/disk"
+)
+
+// SectorMap is the allocator's view of the sector reservation map.
+type SectorMap interface {
+	// Size returns the highest sector address.
+	Size() uint32
+	IsFree(addr uint32) bool
+}
+
+// Allocator decides where new sectors are placed. It only picks sectors;
+// the FileSystem makes sure there are enough free sectors before calling
+// Pick, and marks the picked sectors as used.
+type Allocator interface {
+	// Pick returns n distinct free sectors. hint is the file's last sector,
+	// or 0 if there is none. want, at least n, is the number of sectors the
+	// file is expected to need from hint on, so that the allocator can leave
+	// room for the ones that follow.
+	Pick(m SectorMap, hint uint32, n, want int) []uint32
+}
+
+// nextFree returns the first free sector after addr, wrapping around at the
+// end of the disk. There must be at least one free sector.
+func nextFree(m SectorMap, addr uint32, taken map[uint32]bool) uint32 {
+	for {
+		addr += disk.SectorMultiplier
+		if addr > m.Size() {
+			addr = disk.SectorMultiplier
+		}
+		if m.IsFree(addr) && !taken[addr] {
+			return addr
+		}
+	}
+}
+
+// NextFreeAllocator places every sector on the first free sector after the
+// previous one, like Oberon's Kernel.AllocSector does.
+type NextFreeAllocator struct{}
+
+func (NextFreeAllocator) Pick(m SectorMap, hint uint32, n, want int) []uint32 {
+	res := make([]uint32, 0, n)
+	taken := make(map[uint32]bool, n)
+	for len(res) < n {
+		hint = nextFree(m, hint, taken)
+		taken[hint] = true
+		res = append(res, hint)
+	}
+	return res
+}
+
+// FirstFitAllocator looks for a run of want free sectors, preferring the
+// one right after hint, then the first one on the disk, and takes the first
+// n of them. If there is no such run, it looks for one of n sectors, and
+// then behaves like NextFreeAllocator.
+type FirstFitAllocator struct{}
+
+func (FirstFitAllocator) Pick(m SectorMap, hint uint32, n, want int) []uint32 {
+	for _, size := range []int{max(n, want), n} {
+		if start, ok := findFreeRun(m, hint, size); ok {
+			return run(start, n)
+		}
+	}
+	return NextFreeAllocator{}.Pick(m, hint, n, want)
+}
+
+// findFreeRun looks for n free sectors in a row, preferring the ones right
+// after hint, then the first ones on the disk.
+func findFreeRun(m SectorMap, hint uint32, n int) (uint32, bool) {
+	if start, ok := freeRunAt(m, hint+disk.SectorMultiplier, n); ok {
+		return start, true
+	}
+	for addr := uint32(disk.SectorMultiplier); addr <= m.Size(); addr += disk.SectorMultiplier {
+		if !m.IsFree(addr) {
+			continue
+		}
+		start := addr
+		for addr <= m.Size() && m.IsFree(addr) && int((addr-start)/disk.SectorMultiplier) < n {
+			addr += disk.SectorMultiplier
+		}
+		if int((addr-start)/disk.SectorMultiplier) == n {
+			return start, true
+		}
+	}
+	return 0, false
+}
+
+// freeRunAt checks whether the n sectors starting at start are free.
+func freeRunAt(m SectorMap, start uint32, n int) (uint32, bool) {
+	for i := 0; i < n; i++ {
+		addr := start + uint32(i)*disk.SectorMultiplier
+		if addr > m.Size() || !m.IsFree(addr) {
+			return 0, false
+		}
+	}
+	return start, true
+}
+
+func run(start uint32, n int) []uint32 {
+	res := make([]uint32, n)
+	for i := range res {
+		res[i] = start + uint32(i)*disk.SectorMultiplier
+	}
+	return res
+}
+
+// RandomAllocator scatters sectors all over the disk. This is what odit
+// used to do; it is mostly useful for testing.
+type RandomAllocator struct {
+	rand *rand.Rand
+}
+
+// NewRandomAllocator returns a RandomAllocator whose choices are determined
+// by seed.
+func NewRandomAllocator(seed int64) *RandomAllocator {
+	return &RandomAllocator{rand: rand.New(rand.NewSource(seed))}
+}
+
+func (a *RandomAllocator) Pick(m SectorMap, hint uint32, n, want int) []uint32 {
+	res := make([]uint32, 0, n)
+	taken := make(map[uint32]bool, n)
+	for len(res) < n {
+		start := a.rand.Uint32() % (m.Size() / disk.SectorMultiplier) * disk.SectorMultiplier
+		addr := nextFree(m, start, taken)
+		taken[addr] = true
+		res = append(res, addr)
+	}
+	return res
+}
+
+// sectorMap implements SectorMap on top of the reservation map. The caller
+// must hold sectorMapMutex.
+type sectorMap struct {
+	fs *FileSystem
+}
+
+func (m sectorMap) Size() uint32 {
+	return m.fs.disk.Size()
+}
+
+func (m sectorMap) IsFree(addr uint32) bool {
+	return !m.fs.sectorReservationMap.Test(addr / disk.SectorMultiplier)
+}
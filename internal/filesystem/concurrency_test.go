@@ -0,0 +1,245 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// These tests are meant to be run with -race.
+
+func TestConcurrentAlloc(t *testing.T) {
+	fs := openTestFS(t, newTestImage(t, 500))
+
+	const workers, perWorker = 8, 50
+	var mutex sync.Mutex
+	seen := make(map[uint32]bool)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				addr, err := fs.AllocSector(0)
+				if err != nil {
+					t.Errorf("AllocSector failed: %v", err)
+					return
+				}
+				if free, _ := fs.IsSectorFree(addr); free {
+					t.Errorf("Sector %d is free right after allocation", addr)
+				}
+				mutex.Lock()
+				if seen[addr] {
+					t.Errorf("Sector %d allocated twice", addr)
+				}
+				seen[addr] = true
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestConcurrentFiles(t *testing.T) {
+	path := newTestImage(t, 2000)
+	fs := openTestFS(t, path)
+
+	const workers = 16
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			name := fmt.Sprintf("File%d.Data", w)
+			f, err := fs.NewFile(name)
+			if err != nil {
+				t.Errorf("NewFile(%s) failed: %v", name, err)
+				return
+			}
+			if err := f.Register(); err != nil {
+				t.Errorf("Register(%s) failed: %v", name, err)
+				return
+			}
+			data := bytes.Repeat([]byte{byte(w)}, (w+1)*1000)
+			for pos := 0; pos < len(data); pos += 700 {
+				end := min(pos+700, len(data))
+				if _, err := f.WriteAt(data[pos:end], int64(pos)); err != nil {
+					t.Errorf("WriteAt(%s) failed: %v", name, err)
+					return
+				}
+				// Keep readers and the directory busy at the same time
+				if _, err := fs.ListFiles(AllFiles); err != nil {
+					t.Errorf("ListFiles failed: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	fs = openTestFS(t, path)
+	for w := 0; w < workers; w++ {
+		name := fmt.Sprintf("File%d.Data", w)
+		f, err := fs.Find(name)
+		if err != nil {
+			t.Errorf("Find(%s) failed: %v", name, err)
+			continue
+		}
+		got, err := io.ReadAll(f)
+		if err != nil {
+			t.Errorf("ReadAll(%s) failed: %v", name, err)
+			continue
+		}
+		if want := bytes.Repeat([]byte{byte(w)}, (w+1)*1000); !bytes.Equal(got, want) {
+			t.Errorf("%s: content differs from what was written", name)
+		}
+	}
+}
+
+func TestConcurrentHandlesOnSameFile(t *testing.T) {
+	fs := openTestFS(t, newTestImage(t, 1000))
+
+	f, err := fs.NewFile("Shared.Data")
+	if err != nil {
+		t.Fatalf("NewFile failed: %v", err)
+	}
+	if err := f.Register(); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	// Every goroutine uses its own handle and writes its own slice of the
+	// file. Each write may grow the file, so without shared state the
+	// handles would overwrite each other's sector tables and lengths.
+	const workers, chunk = 8, 3000
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			h, err := fs.Find("Shared.Data")
+			if err != nil {
+				t.Errorf("Find failed: %v", err)
+				return
+			}
+			data := bytes.Repeat([]byte{byte('a' + w)}, chunk)
+			if _, err := h.WriteAt(data, int64(w*chunk)); err != nil {
+				t.Errorf("WriteAt failed: %v", err)
+			}
+			if _, err := io.ReadAll(h); err != nil {
+				t.Errorf("ReadAll failed: %v", err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if f.Size() != workers*chunk {
+		t.Fatalf("Size() = %d, want %d", f.Size(), workers*chunk)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	for w := 0; w < workers; w++ {
+		if want := bytes.Repeat([]byte{byte('a' + w)}, chunk); !bytes.Equal(got[w*chunk:(w+1)*chunk], want) {
+			t.Errorf("Chunk %d differs from what was written", w)
+		}
+	}
+}
+
+func TestConcurrentDefrag(t *testing.T) {
+	fs := openTestFS(t, newTestImage(t, 2000))
+	fs.SetAllocator(NewRandomAllocator(1))
+	for i := 0; i < 10; i++ {
+		f, err := fs.Create(fmt.Sprintf("Old%d.Data", i))
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if _, err := f.Write(testData(20 * sectorSize)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	// New files allocate sectors while Defrag moves sectors around
+	const workers = 8
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := fs.Defrag(AllFiles, nil); err != nil {
+			t.Errorf("Defrag failed: %v", err)
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			f, err := fs.NewFile(fmt.Sprintf("New%d.Data", w))
+			if err != nil {
+				t.Errorf("NewFile failed: %v", err)
+				return
+			}
+			for pos := 0; pos < 20*sectorSize; pos += sectorSize {
+				if _, err := f.WriteAt(bytes.Repeat([]byte{byte(w)}, sectorSize), int64(pos)); err != nil {
+					t.Errorf("WriteAt failed: %v", err)
+					return
+				}
+			}
+			if err := f.Register(); err != nil {
+				t.Errorf("Register failed: %v", err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	files, err := fs.ListFiles(AllFiles)
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	owner := make(map[uint32]string)
+	for _, f := range files {
+		secs, err := f.Sectors()
+		if err != nil {
+			t.Fatalf("Sectors(%s) failed: %v", f.Name(), err)
+		}
+		for _, addr := range secs {
+			if other, ok := owner[addr]; ok {
+				t.Errorf("Sector %d used by %s and %s", addr, other, f.Name())
+			}
+			owner[addr] = f.Name()
+		}
+		got, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("ReadAll(%s) failed: %v", f.Name(), err)
+		}
+		want := testData(20 * sectorSize)
+		var w int
+		if _, err := fmt.Sscanf(f.Name(), "New%d.Data", &w); err == nil {
+			want = bytes.Repeat([]byte{byte(w)}, 20*sectorSize)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: content differs from what was written", f.Name())
+		}
+	}
+}
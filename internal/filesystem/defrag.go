@@ -0,0 +1,386 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filesystem
+
+import (
+	"sort"
+
+	"github.com/asig/odit/internal/disk"
+	"github.com/rs/zerolog/log"
+)
+
+// Sectors returns the addresses of the file's sectors in the order a
+// sequential read visits them: the header, then the data sectors, with every
+// index sector right before the first data sector it maps.
+func (f *File) Sectors() ([]uint32, error) {
+	f.st.mutex.RLock()
+	defer f.st.mutex.RUnlock()
+
+	return f.sectors_locked()
+}
+
+func (f *File) sectors_locked() ([]uint32, error) {
+	extTable := f.st.header.getExtensionTable()
+	res := []uint32{f.headerAddr}
+	for i := uint32(1); i < numSectors(f.size_locked()); i++ {
+		if i >= secTabSize && (i-secTabSize)%indexSize == 0 {
+			k := (i - secTabSize) / indexSize
+			if int(k) >= len(extTable) {
+				return nil, corrupt(f.headerAddr, "no index sector for sector %d", i)
+			}
+			res = append(res, extTable[k])
+		}
+		addr, err := f.getSectorAddr(i)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, addr)
+	}
+	return res, nil
+}
+
+// Fragments returns the number of runs of adjacent sectors the file is
+// made of. A contiguous file has exactly one.
+func (f *File) Fragments() (int, error) {
+	secs, err := f.Sectors()
+	if err != nil {
+		return 0, err
+	}
+	return fragments(secs), nil
+}
+
+func fragments(secs []uint32) int {
+	n := 1
+	for i := 1; i < len(secs); i++ {
+		if secs[i] != secs[i-1]+disk.SectorMultiplier {
+			n++
+		}
+	}
+	return n
+}
+
+// layoutRef tells what is at position pos of the result of Sectors: data
+// sector i, or the index sector that maps data sectors i..i+indexSize-1.
+func layoutRef(pos int) (i uint32, isIndex bool) {
+	if pos < secTabSize {
+		return uint32(pos), false
+	}
+	block, r := (pos-secTabSize)/(indexSize+1), (pos-secTabSize)%(indexSize+1)
+	i = uint32(secTabSize + block*indexSize)
+	if r == 0 {
+		return i, true
+	}
+	return i + uint32(r-1), false
+}
+
+// relocate_locked copies the sector at position pos of the result of
+// Sectors from "from" to "to", and points the header or index sector that
+// references it to the copy. That single write is what commits the move.
+// "to" must be reserved already; "from" is not freed.
+func (f *File) relocate_locked(pos int, from, to uint32) error {
+	sec, err := f.fs.disk.GetSector(from)
+	if err != nil {
+		return err
+	}
+	if err := f.fs.disk.PutSector(to, sec); err != nil {
+		return err
+	}
+
+	i, isIndex := layoutRef(pos)
+	switch {
+	case isIndex:
+		extTable := f.st.header.getExtensionTable()
+		extTable[(i-secTabSize)/indexSize] = to
+		f.st.header.setExtensionTable(extTable)
+	case i < secTabSize:
+		f.st.header.setSectorTableEntry(i, to)
+	default:
+		indexAddr := f.st.header.getExtensionTable()[(i-secTabSize)/indexSize]
+		sec, err := f.fs.disk.GetSector(indexAddr)
+		if err != nil {
+			return err
+		}
+		isec := indexSector(sec)
+		isec.setEntry((i-secTabSize)%indexSize, to)
+		return f.fs.disk.PutSector(indexAddr, disk.Sector(isec))
+	}
+	return f.fs.disk.PutSector(f.headerAddr, disk.Sector(f.st.header))
+}
+
+// DefragStats describes what a Defrag run did.
+type DefragStats struct {
+	Files        int // files looked at
+	Moved        int // files that were made contiguous
+	Skipped      int // fragmented files that couldn't be made contiguous
+	SectorsMoved int // including sectors of other files that were in the way
+
+	// Sum of the fragments of the files looked at, before and afterwards
+	FragmentsBefore int
+	FragmentsAfter  int
+
+	// Sum of the fragments of all files, before and afterwards
+	TotalFragmentsBefore int
+	TotalFragmentsAfter  int
+}
+
+// sectorOwner identifies a movable sector: position pos of the result of
+// Sectors for file f.
+type sectorOwner struct {
+	f   *File
+	pos int
+}
+
+// defragger holds the state of a Defrag run. The caller holds filesMutex and
+// the mutexes of all files' states.
+type defragger struct {
+	fs      *FileSystem
+	layouts map[uint32][]uint32 // keyed by header address
+	owners  map[uint32]sectorOwner
+	pinned  map[uint32]bool // sectors that must not be moved
+	stats   DefragStats
+}
+
+// Defrag makes every file matching pred contiguous: the header is followed
+// by the data sectors, with every index sector right before the data
+// sectors it maps. The header stays where it is, the rest of the file goes
+// right after it if possible, or to the place that needs the fewest sectors
+// of other files to be moved out of the way. progress, if not nil, is called
+// after every file; it must not use the file system.
+//
+// Every sector is moved by writing a copy and then rewriting the one sector
+// that points to it, so an interrupted run leaves a consistent file system;
+// at worst, some sectors stay allocated until the image is opened again.
+// The directory and all files in it are locked while Defrag runs. Files
+// that are being created can still allocate sectors; Defrag claims every
+// sector it moves to at the moment it needs it, and gives up on a file if
+// a sector it counted on was taken in the meantime.
+func (fs *FileSystem) Defrag(pred ListFileFilter, progress func(done, total int, name string)) (DefragStats, error) {
+	fs.filesMutex.Lock()
+	defer fs.filesMutex.Unlock()
+
+	d := &defragger{
+		fs:      fs,
+		layouts: make(map[uint32][]uint32),
+		owners:  make(map[uint32]sectorOwner),
+		pinned:  make(map[uint32]bool),
+	}
+
+	// Lock and map all files. Sectors that are in use but don't belong to a
+	// file we could map (directory pages, damaged files, files that aren't
+	// registered) are never moved.
+	var all, selected []*File
+	for _, entry := range fs.files {
+		if d.pinned[entry.adr] {
+			// Shares its header with an entry we've seen, which is locked
+			// already
+			continue
+		}
+		d.pinned[entry.adr] = true
+		f, err := fs.NewFileFromFileHeader(entry.adr)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Not moving sectors of damaged file %s", entry.name)
+			continue
+		}
+		matches := pred(f)
+		f.st.mutex.Lock()
+		defer f.st.mutex.Unlock()
+		layout, err := f.sectors_locked()
+		if err != nil {
+			log.Warn().Err(err).Msgf("Not moving sectors of damaged file %s", entry.name)
+			continue
+		}
+		d.layouts[f.headerAddr] = layout
+		for pos, addr := range layout[1:] {
+			d.owners[addr] = sectorOwner{f, pos + 1}
+		}
+		all = append(all, f)
+		if matches {
+			selected = append(selected, f)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].headerAddr < selected[j].headerAddr })
+
+	for _, f := range all {
+		d.stats.TotalFragmentsBefore += fragments(d.layouts[f.headerAddr])
+	}
+	for i, f := range selected {
+		before := fragments(d.layouts[f.headerAddr])
+		if err := d.defrag(f); err != nil {
+			return d.stats, err
+		}
+		after := fragments(d.layouts[f.headerAddr])
+		d.stats.Files++
+		d.stats.FragmentsBefore += before
+		d.stats.FragmentsAfter += after
+		if after < before {
+			d.stats.Moved++
+		} else if after > 1 {
+			d.stats.Skipped++
+		}
+		if progress != nil {
+			progress(i+1, len(selected), f.st.header.name())
+		}
+	}
+	for _, f := range all {
+		d.stats.TotalFragmentsAfter += fragments(d.layouts[f.headerAddr])
+	}
+	return d.stats, nil
+}
+
+// defrag moves f's sectors into a window of sectors right after each other,
+// and pins them there.
+func (d *defragger) defrag(f *File) error {
+	layout := d.layouts[f.headerAddr]
+	n := uint32(len(layout) - 1)
+	if fragments(layout) == 1 {
+		d.pin(layout)
+		return nil
+	}
+	start, ok := d.findWindow(f, n)
+	if !ok {
+		log.Info().Msgf("No room to make %s contiguous", f.st.header.name())
+		return nil
+	}
+
+	for pos := 1; pos <= int(n); pos++ {
+		target := start + uint32(pos-1)*disk.SectorMultiplier
+		from := layout[pos]
+		if from == target {
+			continue
+		}
+		if occupant, ok := d.owners[target]; ok {
+			// Move whatever is in the way out of the window
+			free, ok := d.freeOutside(start, n)
+			if !ok {
+				log.Info().Msgf("No room left to make %s contiguous", f.st.header.name())
+				return nil
+			}
+			if err := d.move(occupant, target, free); err != nil {
+				return err
+			}
+		} else if claimed, err := d.fs.claimSector(target); err != nil {
+			return err
+		} else if !claimed {
+			log.Info().Msgf("Sector %d was taken, can't make %s contiguous", target, f.st.header.name())
+			return nil
+		}
+		if err := d.move(sectorOwner{f, pos}, from, target); err != nil {
+			return err
+		}
+		if err := d.fs.FreeSector(from); err != nil {
+			return err
+		}
+	}
+	d.pin(layout)
+	return nil
+}
+
+// move relocates o's sector from "from" to "to" and updates the maps.
+func (d *defragger) move(o sectorOwner, from, to uint32) error {
+	if err := o.f.relocate_locked(o.pos, from, to); err != nil {
+		return err
+	}
+	delete(d.owners, from)
+	d.owners[to] = o
+	d.layouts[o.f.headerAddr][o.pos] = to
+	d.stats.SectorsMoved++
+	return nil
+}
+
+func (d *defragger) pin(layout []uint32) {
+	for _, addr := range layout {
+		d.pinned[addr] = true
+	}
+}
+
+// movable tells whether sector addr is free or can be moved out of the way.
+func (d *defragger) movable(addr uint32) bool {
+	if d.pinned[addr] {
+		return false
+	}
+	if _, ok := d.owners[addr]; ok {
+		return true
+	}
+	free, _ := d.fs.IsSectorFree(addr)
+	return free
+}
+
+// findWindow finds n sectors in a row where f can go: preferably right
+// after its header, otherwise where the fewest sectors of other files are
+// in the way. f's own sectors might be in the way too, so there must be
+// enough free sectors outside the window to park all of them.
+func (d *defragger) findWindow(f *File, n uint32) (uint32, bool) {
+	const m = disk.SectorMultiplier
+	size := d.fs.disk.Size()
+
+	d.fs.sectorMapMutex.RLock()
+	numFree := size/m - d.fs.numUsedSectors
+	d.fs.sectorMapMutex.RUnlock()
+	var immovable, inTheWay, free uint32
+	count := func(addr uint32, delta int) {
+		switch {
+		case !d.movable(addr):
+			immovable += uint32(delta)
+		case d.owners[addr].f != nil:
+			inTheWay += uint32(delta)
+		default:
+			free += uint32(delta)
+		}
+	}
+	fits := func() bool {
+		return immovable == 0 && numFree-free >= inTheWay
+	}
+
+	best, bestInTheWay := uint32(0), uint32(0)
+	for addr := uint32(m); addr <= size; addr += m {
+		count(addr, 1)
+		if addr >= n*m+m {
+			count(addr-n*m, -1)
+		}
+		if addr < n*m {
+			continue
+		}
+		start := addr - (n-1)*m
+		if !fits() {
+			continue
+		}
+		if start == f.headerAddr+m {
+			return start, true
+		}
+		if best == 0 || inTheWay < bestInTheWay {
+			best, bestInTheWay = start, inTheWay
+		}
+	}
+	return best, best != 0
+}
+
+// freeOutside reserves a free sector that is not part of the window of n
+// sectors at start.
+func (d *defragger) freeOutside(start, n uint32) (uint32, bool) {
+	end := start + n*disk.SectorMultiplier
+	for addr := uint32(disk.SectorMultiplier); addr <= d.fs.disk.Size(); addr += disk.SectorMultiplier {
+		if addr >= start && addr < end {
+			continue
+		}
+		if claimed, _ := d.fs.claimSector(addr); claimed {
+			return addr, true
+		}
+	}
+	return 0, false
+}
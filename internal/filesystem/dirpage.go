@@ -19,8 +19,6 @@
 package filesystem
 
 import (
-	"fmt"
-
 	"github.com/asig/odit/internal/disk"
 	"github.com/asig/odit/internal/util"
 	"github.com/rs/zerolog/log"
@@ -66,17 +64,24 @@ type dirPage struct {
 */
 
 func loadDirFromDisk(d *disk.Disk, addr uint32, seen map[uint32]struct{}, parent uint32) (*dirPage, error) {
-	sec := d.MustGetSector(addr)
+	sec, err := d.GetSector(addr)
+	if err != nil {
+		return nil, err
+	}
 	mark := util.ReadLEUint32(sec[:], 0)
 	if mark != dirMark {
-		return nil, fmt.Errorf("invalid dir page mark: got 0x%08X, want 0x%08X", mark, dirMark)
+		return nil, corrupt(addr, "invalid dir page mark: got 0x%08X, want 0x%08X", mark, dirMark)
 	}
 
 	if _, ok := seen[addr]; ok {
-		return nil, fmt.Errorf("detected cycle in directory pages at address %d, coming from %d", addr, parent)
+		return nil, corrupt(addr, "detected cycle in directory pages, coming from %d", parent)
 	}
 	seen[addr] = struct{}{}
 
+	if m := util.ReadLEUint16(sec[:], 4); m > dirPgSize {
+		return nil, corrupt(addr, "too many entries in dir page: %d > %d", m, dirPgSize)
+	}
+
 	dir := &dirPage{
 		addr:    addr,
 		entries: make([]dirEntry, 0, dirPgSize),
@@ -150,7 +155,9 @@ func (dp *dirPage) writeToDisk(d *disk.Disk) error {
 	}
 
 	sec := dp.asSector()
-	d.MustPutSector(dp.addr, sec)
+	if err := d.PutSector(dp.addr, sec); err != nil {
+		return err
+	}
 	if err := dp.p0.writeToDisk(d); err != nil {
 		return err
 	}
@@ -173,6 +180,18 @@ func (dp *dirPage) collectDirPageAddresses(collector func(addr uint32)) {
 	}
 }
 
+// depth returns the number of levels of the tree rooted at dp.
+func (dp *dirPage) depth() int {
+	if dp == nil {
+		return 0
+	}
+	d := dp.p0.depth()
+	for _, e := range dp.entries {
+		d = max(d, e.p.depth())
+	}
+	return d + 1
+}
+
 func (dp *dirPage) collectDirEntries(collector func(entry dirEntry)) {
 	if dp == nil {
 		return
@@ -0,0 +1,47 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotFound     = errors.New("file not found")
+	ErrExists       = errors.New("file already exists")
+	ErrInvalidName  = errors.New("invalid file name")
+	ErrDiskFull     = errors.New("disk full")
+	ErrFileTooLarge = errors.New("file too large")
+)
+
+// ErrCorrupt is returned when an on-disk structure (directory page, file
+// header, index sector) does not look the way it should.
+type ErrCorrupt struct {
+	Sector uint32 // address of the offending sector
+	Reason string
+}
+
+func (e *ErrCorrupt) Error() string {
+	return fmt.Sprintf("corrupt sector %d: %s", e.Sector, e.Reason)
+}
+
+func corrupt(sector uint32, format string, args ...any) error {
+	return &ErrCorrupt{Sector: sector, Reason: fmt.Sprintf(format, args...)}
+}
@@ -19,26 +19,59 @@
 package filesystem
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/asig/odit/internal/disk"
-	"github.com/asig/odit/internal/util"
+	"github.com/rs/zerolog/log"
 )
 
+// fileState is shared by all File handles on the same file header, so that
+// changes made through one handle are immediately visible through the others.
+type fileState struct {
+	mutex    sync.RWMutex
+	header   fileHeader // in-memory copy of the header sector, always up to date
+	reserved []uint32   // sectors set aside by Reserve, in the order they're used
+	open     int        // handles returned by Open that aren't closed yet
+	removed  bool       // not in the directory any more, free on the last Close
+}
+
+// File is a handle on a file in the image. Handles returned by Find, Open,
+// Create etc. each have their own position for Read, Write and Seek, but
+// share the file's contents and metadata.
 type File struct {
 	fs         *FileSystem
-	header     fileHeader
+	st         *fileState
 	headerAddr uint32
+
+	posMutex sync.Mutex
+	pos      int64
+	opened   bool // counted in st.open, guarded by st.mutex
 }
 
+// MaxFileSize is the size of the largest file the sector and extension
+// tables can describe.
+const MaxFileSize = (secTabSize+exTabSize*indexSize)*sectorSize - headerSize
+
 func (f *File) Size() uint32 {
-	return uint32(f.header.aleng())*sectorSize + uint32(f.header.bleng()) - headerSize
+	f.st.mutex.RLock()
+	defer f.st.mutex.RUnlock()
+
+	return f.size_locked()
+}
+
+func (f *File) size_locked() uint32 {
+	return uint32(f.st.header.aleng())*sectorSize + uint32(f.st.header.bleng()) - headerSize
 }
 
 func (f *File) Name() string {
-	return f.header.name()
+	f.st.mutex.RLock()
+	defer f.st.mutex.RUnlock()
+
+	return f.st.header.name()
 }
 
 func (f *File) HeaderAddr() uint32 {
@@ -52,149 +85,578 @@ func (f *File) physicalPos(p uint32) (sector, offset uint32) {
 	return
 }
 
+// CreationTime returns the file's time stamp. Oberon time stamps have no
+// time zone, so the result's location is always UTC; see ModTime.
 func (f *File) CreationTime() time.Time {
-	return f.header.creationTime()
+	f.st.mutex.RLock()
+	defer f.st.mutex.RUnlock()
+
+	return f.st.header.creationTime()
+}
+
+// ModTime returns the file's time stamp as a time in the local time zone,
+// which is how Oberon interprets it.
+func (f *File) ModTime() time.Time {
+	t := f.CreationTime()
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local)
 }
 
 // getSectorAddr returns the disk address of the i-th sector of the file.
-func (f *File) getSectorAddr(i uint32) uint32 {
+func (f *File) getSectorAddr(i uint32) (uint32, error) {
 	// No idea why we don't have special handling for i==0 here
 	// Need to check the Oberon sources...
 	if i < secTabSize {
 		// Sector table
-		secTable := f.header.getSectorTable()
-		return secTable[i]
+		addr := f.st.header.sectorTableEntry(i)
+		if addr == 0 {
+			return 0, corrupt(f.headerAddr, "sector table entry %d missing", i)
+		}
+		return addr, nil
 	}
 
 	i -= secTabSize
 
 	indexBlockIndex := i / indexSize
 	if indexBlockIndex >= exTabSize {
-		panic("file too large")
+		return 0, ErrFileTooLarge
 	}
-	extTable := f.header.getExtensionTable()
+	extTable := f.st.header.getExtensionTable()
 	if len(extTable) <= int(indexBlockIndex) {
-		panic(fmt.Sprintf("index block %d for file sector %d missing", indexBlockIndex, i+secTabSize+1))
+		return 0, corrupt(f.headerAddr, "index block %d for file sector %d missing", indexBlockIndex, i+secTabSize+1)
+	}
+	sec, err := f.fs.disk.GetSector(extTable[indexBlockIndex])
+	if err != nil {
+		return 0, err
 	}
-	indexBlock := indexSector(f.fs.disk.MustGetSector(extTable[indexBlockIndex]))
-	return indexBlock.entries()[i%indexSize]
+	indexBlock := indexSector(sec)
+	addr := indexBlock.entry(i % indexSize)
+	if addr == 0 {
+		return 0, corrupt(extTable[indexBlockIndex], "index entry %d missing", i%indexSize)
+	}
+	return addr, nil
 }
 
-func (f *File) WriteAt(pos uint32, data []byte) error {
-	minSize := pos + uint32(len(data))
-	f.ensureSize(minSize)
+// ReadAt implements io.ReaderAt.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("ReadAt: negative offset %d", off)
+	}
+
+	f.st.mutex.RLock()
+	defer f.st.mutex.RUnlock()
+
+	size := int64(f.size_locked())
+	if off >= size {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if int64(n) > size-off {
+		n = int(size - off)
+	}
+
+	read := 0
+	for read < n {
+		sectorIdx, offset := f.physicalPos(uint32(off) + uint32(read))
+		sectorData, err := f.getSector(sectorIdx)
+		if err != nil {
+			return read, err
+		}
+		read += copy(p[read:n], sectorData[offset:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
 
-	firstSectorIdx, firstOffset := f.physicalPos(pos)
+// WriteAt implements io.WriterAt. Writing beyond the end of the file grows it.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("WriteAt: negative offset %d", off)
+	}
+	if off+int64(len(p)) > MaxFileSize {
+		return 0, fmt.Errorf("%w: %d bytes", ErrFileTooLarge, off+int64(len(p)))
+	}
 
-	// Fill remaining data for first sector
-	remainingInFirst := int(sectorSize - firstOffset)
-	if remainingInFirst > len(data) {
-		remainingInFirst = len(data)
+	if len(p) == 0 {
+		return 0, nil
 	}
-	sectorAddr := f.getSectorAddr(firstSectorIdx)
-	sectorData := f.fs.disk.MustGetSector(sectorAddr)
-	copy(sectorData[firstOffset:], data[:remainingInFirst])
-	f.fs.disk.PutSector(sectorAddr, sectorData)
-	data = data[remainingInFirst:]
 
-	if firstSectorIdx == 0 {
-		// fileHeader was modified, read it again
-		f.header = fileHeader(f.fs.disk.MustGetSector(f.headerAddr))
+	f.st.mutex.Lock()
+	defer f.st.mutex.Unlock()
+
+	// The header is written below if the file grows or if p overlaps its
+	// data; otherwise, it needs an extra write for the new time stamp.
+	stamped := f.st.header.touch(f.fs.clock())
+	oldSize := f.size_locked()
+	firstNew, err := f.ensureSize(uint32(off) + uint32(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	if stamped && f.size_locked() == oldSize && off >= sectorSize-headerSize {
+		if err := f.fs.disk.PutSector(f.headerAddr, disk.Sector(f.st.header)); err != nil {
+			return 0, err
+		}
+	}
+	if uint32(off) > oldSize {
+		if err := f.zeroRange(oldSize, uint32(off), firstNew); err != nil {
+			return 0, err
+		}
 	}
 
-	// Fill full sectors in the middle
-	sectorIdx := firstSectorIdx + 1
-	for len(data) >= sectorSize {
-		sectorAddr := f.getSectorAddr(sectorIdx)
-		sectorData := f.fs.disk.MustGetSector(sectorAddr)
-		copy(sectorData[:], data[:sectorSize])
-		f.fs.disk.PutSector(sectorAddr, sectorData)
-		data = data[sectorSize:]
-		sectorIdx++
+	written := 0
+	for written < len(p) {
+		sectorIdx, offset := f.physicalPos(uint32(off) + uint32(written))
+		n := min(len(p)-written, int(sectorSize-offset))
+		if err := f.updateSector(sectorIdx, offset, p[written:written+n], sectorIdx >= firstNew); err != nil {
+			return written, err
+		}
+		written += n
 	}
+	return written, nil
+}
 
-	// Fill remaining data for last sector
-	if len(data) > 0 {
-		sectorAddr := f.getSectorAddr(sectorIdx)
-		sectorData := f.fs.disk.MustGetSector(sectorAddr)
-		copy(sectorData[:], data[:])
-		f.fs.disk.PutSector(sectorAddr, sectorData)
+// Truncate changes the size of the file. When shrinking, the sectors that
+// are no longer needed are released; when growing, the new part of the file
+// reads as zeros.
+func (f *File) Truncate(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("Truncate: negative size %d", size)
+	}
+	if size > MaxFileSize {
+		return fmt.Errorf("%w: %d bytes", ErrFileTooLarge, size)
 	}
 
+	f.st.mutex.Lock()
+	defer f.st.mutex.Unlock()
+
+	oldSize := f.size_locked()
+	newSize := uint32(size)
+	if newSize != oldSize {
+		// Written together with the new size
+		f.st.header.touch(f.fs.clock())
+	}
+	switch {
+	case newSize > oldSize:
+		firstNew, err := f.ensureSize(newSize)
+		if err != nil {
+			return err
+		}
+		return f.zeroRange(oldSize, newSize, firstNew)
+	case newSize < oldSize:
+		return f.shrink(newSize)
+	}
 	return nil
 }
 
-func (f *File) ReadAt(pos uint32, l uint32) ([]byte, error) {
-	if pos+l > f.Size() {
-		l = f.Size() - pos
+// shrink cuts the file down to l bytes.
+func (f *File) shrink(l uint32) error {
+	curSecs := numSectors(f.size_locked())
+	newSecs := numSectors(l)
+
+	// Don't leave stale data behind the new end of file
+	lastIdx, offset := f.physicalPos(l)
+	if offset != 0 {
+		zeros := make([]byte, sectorSize-offset)
+		if lastIdx == 0 {
+			// Header sector is written below anyway
+			copy(f.st.header[offset:], zeros)
+		} else if err := f.updateSector(lastIdx, offset, zeros, false); err != nil {
+			return err
+		}
 	}
-	var data []byte
 
-	firstSectorIdx, firstOffset := f.physicalPos(pos)
+	f.setLength(l)
+	return f.releaseSectors(newSecs, curSecs)
+}
 
-	// Fill data from first sector
-	sectorAddr := f.getSectorAddr(firstSectorIdx)
-	sectorData := f.fs.disk.MustGetSector(sectorAddr)
-	remainingInFirst := sectorSize - firstOffset
-	if l < remainingInFirst {
-		remainingInFirst = l
+// releaseSectors removes the file's sectors from..to-1 from the sector table
+// and the index sectors, and gives them back to the allocator along with
+// index sectors that are no longer needed. The header is written to disk
+// before the index sectors are touched, so that a crash in between never
+// leaves the header pointing at cleared index entries.
+func (f *File) releaseSectors(from, to uint32) error {
+	var freed []uint32
+	for i := from; i < min(to, secTabSize); i++ {
+		if addr := f.st.header.sectorTableEntry(i); addr != 0 {
+			freed = append(freed, addr)
+		}
+		f.st.header.setSectorTableEntry(i, 0)
 	}
-	data = append(data, sectorData[firstOffset:firstOffset+remainingInFirst]...)
-	l -= remainingInFirst
 
-	// Read full sectors in the middle
-	sectorIdx := firstSectorIdx + 1
-	for l > sectorSize {
-		sectorAddr := f.getSectorAddr(sectorIdx)
-		sectorData := f.fs.disk.MustGetSector(sectorAddr)
-		data = append(data, sectorData[:]...)
-		l -= sectorSize
-		sectorIdx++
+	extTable := f.st.header.getExtensionTable()
+	keep := 0
+	if from > secTabSize {
+		keep = int((from - secTabSize + indexSize - 1) / indexSize)
+	}
+	type indexUpdate struct {
+		addr uint32
+		sec  indexSector
 	}
+	var updates []indexUpdate
+	for k := keep - 1; k < len(extTable); k++ {
+		if k < 0 {
+			continue
+		}
+		// Range of file sectors covered by index block k
+		first := secTabSize + uint32(k)*indexSize
+		lo, hi := max(from, first), min(to, first+indexSize)
+		if lo >= hi {
+			if k >= keep {
+				freed = append(freed, extTable[k])
+			}
+			continue
+		}
+		sec, err := f.fs.disk.GetSector(extTable[k])
+		if err != nil {
+			return err
+		}
+		isec := indexSector(sec)
+		for i := lo; i < hi; i++ {
+			if addr := isec.entry(i - first); addr != 0 {
+				freed = append(freed, addr)
+			}
+			isec.setEntry(i-first, 0)
+		}
+		if k >= keep {
+			freed = append(freed, extTable[k])
+		} else {
+			updates = append(updates, indexUpdate{extTable[k], isec})
+		}
+	}
+	if keep < len(extTable) {
+		f.st.header.setExtensionTable(extTable[:keep])
+	}
+
+	if err := f.fs.disk.PutSector(f.headerAddr, disk.Sector(f.st.header)); err != nil {
+		return err
+	}
+	for _, u := range updates {
+		if err := f.fs.disk.PutSector(u.addr, disk.Sector(u.sec)); err != nil {
+			return err
+		}
+	}
+	for _, addr := range freed {
+		if err := f.fs.FreeSector(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Get partial last sector
-	if l > 0 {
-		sectorAddr := f.getSectorAddr(sectorIdx)
-		sectorData := f.fs.disk.MustGetSector(sectorAddr)
-		data = append(data, sectorData[:l]...)
+// zeroRange clears the bytes from..to-1 of the file. Sectors from firstNew
+// on were just allocated and are overwritten completely.
+func (f *File) zeroRange(from, to, firstNew uint32) error {
+	for pos := from; pos < to; {
+		sectorIdx, offset := f.physicalPos(pos)
+		n := min(to-pos, sectorSize-offset)
+		if sectorIdx >= firstNew {
+			n = sectorSize - offset
+		}
+		if err := f.updateSector(sectorIdx, offset, make([]byte, n), sectorIdx >= firstNew); err != nil {
+			return err
+		}
+		pos += n
 	}
+	return nil
+}
+
+// Read implements io.Reader, reading from the handle's current position.
+func (f *File) Read(p []byte) (int, error) {
+	f.posMutex.Lock()
+	defer f.posMutex.Unlock()
 
-	return data, nil
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
 }
 
-func (f *File) ensureSize(l uint32) {
-	if l <= f.Size() {
-		// The file is already large enough
-		return
+// Write implements io.Writer, writing at the handle's current position.
+func (f *File) Write(p []byte) (int, error) {
+	f.posMutex.Lock()
+	defer f.posMutex.Unlock()
+
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker. Seeking beyond the end of the file is allowed.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.posMutex.Lock()
+	defer f.posMutex.Unlock()
+
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = f.pos + offset
+	case io.SeekEnd:
+		pos = int64(f.Size()) + offset
+	default:
+		return f.pos, fmt.Errorf("Seek: invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return f.pos, fmt.Errorf("Seek: negative position %d", pos)
 	}
+	f.pos = pos
+	return pos, nil
+}
+
+// Open returns a new handle on the file. Unlike the handles returned by
+// Find, it keeps the file's sectors from being freed when the file is
+// removed, until it's closed.
+func (f *File) Open() *File {
+	f.st.mutex.Lock()
+	defer f.st.mutex.Unlock()
 
+	f.st.open++
+	return &File{fs: f.fs, st: f.st, headerAddr: f.headerAddr, opened: true}
+}
+
+// Close implements io.Closer. All data is written through to the image, so
+// there is nothing to flush; the directory is written by FileSystem.Close.
+// If this is the last handle returned by Open on a file that was removed,
+// the file's sectors are freed.
+func (f *File) Close() error {
+	f.st.mutex.Lock()
+	defer f.st.mutex.Unlock()
+
+	if !f.opened {
+		return nil
+	}
+	f.opened = false
+	f.st.open--
+	if f.st.open == 0 && f.st.removed {
+		return f.free_locked()
+	}
+	return nil
+}
+
+// free_locked frees all sectors of a file that isn't in the directory any
+// more, and forgets its state.
+func (f *File) free_locked() error {
+	secs, err := f.sectors_locked()
+	if err != nil {
+		return err
+	}
+	if err := f.release_locked(); err != nil {
+		return err
+	}
+	f.fs.statesMutex.Lock()
+	if f.fs.states[f.headerAddr] == f.st {
+		delete(f.fs.states, f.headerAddr)
+	}
+	f.fs.statesMutex.Unlock()
+	for _, addr := range secs {
+		if err := f.fs.FreeSector(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateSector copies data into the file's i-th sector, starting at offset.
+// If fresh is set, the sector was just allocated and its old contents are
+// replaced by zeros instead of being preserved.
+func (f *File) updateSector(i, offset uint32, data []byte, fresh bool) error {
+	if i == 0 {
+		// The first data bytes live in the header sector
+		copy(f.st.header[offset:], data)
+		return f.fs.disk.PutSector(f.headerAddr, disk.Sector(f.st.header))
+	}
+	sectorAddr, err := f.getSectorAddr(i)
+	if err != nil {
+		return err
+	}
+	var sectorData disk.Sector
+	if len(data) < sectorSize && !fresh {
+		// Partial update, need to keep the rest of the sector
+		sectorData, err = f.fs.disk.GetSector(sectorAddr)
+		if err != nil {
+			return err
+		}
+	}
+	copy(sectorData[offset:], data)
+	return f.fs.disk.PutSector(sectorAddr, sectorData)
+}
+
+// getSector reads the file's i-th sector.
+func (f *File) getSector(i uint32) (disk.Sector, error) {
+	if i == 0 {
+		return disk.Sector(f.st.header), nil
+	}
+	sectorAddr, err := f.getSectorAddr(i)
+	if err != nil {
+		return disk.Sector{}, err
+	}
+	return f.fs.disk.GetSector(sectorAddr)
+}
+
+// ensureSize grows the file to at least l bytes. It returns the index of the
+// first sector that was added; the contents of the new sectors are
+// undefined, it's up to the caller to overwrite them.
+func (f *File) ensureSize(l uint32) (uint32, error) {
 	// Find current # of sectors the file occupies
-	size := f.Size() + headerSize
-	curSecs := (size + sectorSize - 1) / sectorSize
+	curSecs := numSectors(f.size_locked())
+	if l <= f.size_locked() {
+		// The file is already large enough
+		return curSecs, nil
+	}
 
 	// Find the requested # of sectors
-	newSize := l + headerSize
-	newSecs := (newSize + sectorSize - 1) / sectorSize
+	newSecs := numSectors(l)
+	if newSecs > secTabSize+exTabSize*indexSize {
+		return 0, fmt.Errorf("%w: %d bytes", ErrFileTooLarge, l)
+	}
 
-	// Allocate additional sectors if needed
-	// TODO(asigner): Clear the data?
+	// Get all additional sectors, including new index sectors, at once, so
+	// that they can be placed right after the file's last sector. Without a
+	// reservation, expect the file to keep growing at the same rate.
+	hint, err := f.getSectorAddr(curSecs - 1)
+	if err != nil {
+		return 0, err
+	}
+	n := f.sectorsNeeded_locked(newSecs)
+	secs, err := f.takeSectors_locked(hint, n, max(n, int(curSecs)))
+	if err != nil {
+		return 0, err
+	}
+	p := 0
 	for i := curSecs; i < newSecs; i++ {
-		newSecAddr := f.fs.AllocSector(rand.Uint32() % uint32(f.fs.disk.Size()/disk.SectorMultiplier) * disk.SectorMultiplier)
-		f.addSector(uint32(i), newSecAddr)
+		// Index sectors go right before the first sector they map
+		if i >= secTabSize && (i-secTabSize)%indexSize == 0 && len(f.st.header.getExtensionTable()) <= int((i-secTabSize)/indexSize) {
+			err = f.addIndexSector(secs[p])
+			if err == nil {
+				p++
+			}
+		}
+		if err == nil {
+			err = f.addSector(i, secs[p])
+		}
+		if err != nil {
+			// Give back what we got so far
+			for _, addr := range secs[p:] {
+				f.fs.FreeSector(addr)
+			}
+			if rerr := f.releaseSectors(curSecs, i); rerr != nil {
+				log.Error().Err(rerr).Msgf("Can't release sectors of %s", f.st.header.name())
+			}
+			return 0, err
+		}
+		p++
+	}
+
+	f.setLength(l)
+	return curSecs, f.fs.disk.PutSector(f.headerAddr, disk.Sector(f.st.header))
+}
+
+// sectorsNeeded_locked returns how many sectors, including index sectors,
+// have to be added for the file to have newSecs sectors.
+func (f *File) sectorsNeeded_locked(newSecs uint32) int {
+	curSecs := numSectors(f.size_locked())
+	if newSecs <= curSecs {
+		return 0
+	}
+	numIndex := 0
+	if newSecs > secTabSize {
+		numIndex = int((newSecs-secTabSize+indexSize-1)/indexSize) - len(f.st.header.getExtensionTable())
+	}
+	return int(newSecs-curSecs) + max(numIndex, 0)
+}
+
+// takeSectors_locked returns n sectors for the file to grow into: the ones
+// set aside by Reserve first, then new ones placed after hint. want is
+// passed on to the allocator.
+func (f *File) takeSectors_locked(hint uint32, n, want int) ([]uint32, error) {
+	k := min(n, len(f.st.reserved))
+	secs := f.st.reserved[:k:k]
+	f.st.reserved = f.st.reserved[k:]
+	if k == n {
+		return secs, nil
+	}
+	if k > 0 {
+		hint = secs[k-1]
+	}
+	more, err := f.fs.allocSectors(hint, n-k, want-k)
+	if err != nil {
+		// All reserved sectors were taken, so they're simply put back
+		f.st.reserved = secs
+		return nil, err
+	}
+	return append(secs, more...), nil
+}
+
+// Reserve sets aside the sectors the file needs to grow to size bytes, so
+// that they can be placed together even if the file is then written in
+// small pieces, e.g. by io.Copy. The size of the file doesn't change.
+// Reserving no more than the current size gives back the sectors that
+// weren't used.
+func (f *File) Reserve(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("Reserve: negative size %d", size)
+	}
+	if size > MaxFileSize {
+		return fmt.Errorf("%w: %d bytes", ErrFileTooLarge, size)
+	}
+
+	f.st.mutex.Lock()
+	defer f.st.mutex.Unlock()
+
+	n := f.sectorsNeeded_locked(numSectors(uint32(size)))
+	if n == 0 {
+		return f.release_locked()
 	}
+	if n <= len(f.st.reserved) {
+		return nil
+	}
+	hint, err := f.getSectorAddr(numSectors(f.size_locked()) - 1)
+	if err != nil {
+		return err
+	}
+	if len(f.st.reserved) > 0 {
+		hint = f.st.reserved[len(f.st.reserved)-1]
+	}
+	more := n - len(f.st.reserved)
+	secs, err := f.fs.allocSectors(hint, more, more)
+	if err != nil {
+		return err
+	}
+	f.st.reserved = append(f.st.reserved, secs...)
+	return nil
+}
+
+// release_locked gives back the sectors set aside by Reserve.
+func (f *File) release_locked() error {
+	for len(f.st.reserved) > 0 {
+		if err := f.fs.FreeSector(f.st.reserved[0]); err != nil {
+			return err
+		}
+		f.st.reserved = f.st.reserved[1:]
+	}
+	f.st.reserved = nil
+	return nil
+}
 
-	// Update aleng and bleng in header
-	f.header.setAleng(uint16(newSize / sectorSize))
-	f.header.setBleng(uint16(newSize % sectorSize))
+// setLength updates aleng and bleng in the in-memory header.
+func (f *File) setLength(l uint32) {
+	newSize := l + headerSize
+	f.st.header.setAleng(uint16(newSize / sectorSize))
+	f.st.header.setBleng(uint16(newSize % sectorSize))
+}
 
-	f.fs.disk.PutSector(f.headerAddr, disk.Sector(f.header))
+// numSectors returns the number of sectors (including the header) a file of
+// l bytes occupies.
+func numSectors(l uint32) uint32 {
+	return (l + headerSize + sectorSize - 1) / sectorSize
 }
 
-func (f *File) addSector(index, addr uint32) {
+func (f *File) addSector(index, addr uint32) error {
 	if index < secTabSize {
 		// Sector table
-		util.WriteLEUint32(f.header[:], int(96+index*4), addr)
-		return
+		f.st.header.setSectorTableEntry(index, addr)
+		return nil
 	}
 
 	// Find correct index block
@@ -202,59 +664,108 @@ func (f *File) addSector(index, addr uint32) {
 
 	indexBlockIndex := index / indexSize
 	if indexBlockIndex >= exTabSize {
-		panic("file too large")
+		return ErrFileTooLarge
 	}
 
-	extTable := f.header.getExtensionTable()
+	extTable := f.st.header.getExtensionTable()
 	for len(extTable) <= int(indexBlockIndex) {
 		// Allocate new index block
 		hint := uint32(0)
 		if len(extTable) > 0 {
 			hint = extTable[len(extTable)-1]
 		}
-		newIndexBlockAddr := f.fs.AllocSector(hint)
-		extTable = append(extTable, newIndexBlockAddr)
-		f.header.setExtensionTable(extTable)
-
-		// Make sure index block is empty!
-		f.fs.disk.MustPutSector(newIndexBlockAddr, disk.Sector{})
+		newIndexBlockAddr, err := f.fs.AllocSector(hint)
+		if err != nil {
+			return err
+		}
+		if err := f.addIndexSector(newIndexBlockAddr); err != nil {
+			f.fs.FreeSector(newIndexBlockAddr)
+			return err
+		}
+		extTable = f.st.header.getExtensionTable()
 	}
 	indexBlockAddr := extTable[indexBlockIndex]
 
-	indexBlock := indexSector(f.fs.disk.MustGetSector(indexBlockAddr))
+	sec, err := f.fs.disk.GetSector(indexBlockAddr)
+	if err != nil {
+		return err
+	}
+	indexBlock := indexSector(sec)
 	indexBlock.setEntry(index%indexSize, addr)
-	f.fs.disk.PutSector(indexBlockAddr, disk.Sector(indexBlock))
+	return f.fs.disk.PutSector(indexBlockAddr, disk.Sector(indexBlock))
 }
 
-func (f *File) SetName(name string) {
-	f.header.setName(name)
-	f.fs.disk.MustPutSector(f.headerAddr, disk.Sector(f.header))
+// addIndexSector clears the sector at addr and appends it to the extension
+// table.
+func (f *File) addIndexSector(addr uint32) error {
+	if err := f.fs.disk.PutSector(addr, disk.Sector{}); err != nil {
+		return err
+	}
+	f.st.header.setExtensionTable(append(f.st.header.getExtensionTable(), addr))
+	return nil
 }
 
-func (f *File) Register() error {
-	existingFile, err := f.fs.Find(f.Name())
-	if err != nil {
-		return fmt.Errorf("error checking existing file: %s", err)
+func (f *File) SetName(name string) error {
+	if err := ValidateFilename(name); err != nil {
+		return err
 	}
-	if existingFile != nil {
-		return fmt.Errorf("file %s already exists", f.Name())
+
+	f.st.mutex.Lock()
+	defer f.st.mutex.Unlock()
+
+	f.st.header.setName(name)
+	return f.fs.disk.PutSector(f.headerAddr, disk.Sector(f.st.header))
+}
+
+// SetCreationTime sets the time stamp of the file to the wall clock time of
+// t in t's location.
+func (f *File) SetCreationTime(t time.Time) error {
+	f.st.mutex.Lock()
+	defer f.st.mutex.Unlock()
+
+	f.st.header.setCreationTime(t)
+	return f.fs.disk.PutSector(f.headerAddr, disk.Sector(f.st.header))
+}
+
+// Discard frees all sectors of a file that isn't registered, e.g. because
+// writing it failed half-way. The file must not be used afterwards.
+func (f *File) Discard() error {
+	f.fs.filesMutex.RLock()
+	for _, entry := range f.fs.files {
+		if entry.adr == f.headerAddr {
+			f.fs.filesMutex.RUnlock()
+			return fmt.Errorf("can't discard %s: file is registered", entry.name)
+		}
+	}
+	f.fs.filesMutex.RUnlock()
+
+	if err := f.Truncate(0); err != nil {
+		return err
 	}
-	err = f.fs.Insert(f)
+	if err := f.Reserve(0); err != nil {
+		return err
+	}
+	f.fs.statesMutex.Lock()
+	delete(f.fs.states, f.headerAddr)
+	f.fs.statesMutex.Unlock()
+	return f.fs.FreeSector(f.headerAddr)
+}
+
+func (f *File) Register() error {
+	err := f.fs.Insert(f)
 	if err != nil {
-		return fmt.Errorf("error inserting file: %s", err)
+		return fmt.Errorf("error inserting file: %w", err)
 	}
 	return nil
 }
 
+// Unregister removes the file from the directory, but keeps its sectors, so
+// that it can be registered again or discarded.
 func (f *File) Unregister() error {
-	existingFile, err := f.fs.Find(f.Name())
-	if err != nil {
-		return fmt.Errorf("error checking existing file: %s", err)
-	}
-	if existingFile == nil {
+	err := f.fs.remove(f.Name(), false)
+	if errors.Is(err, ErrNotFound) {
 		// File not registered -> nothing to do
 		return nil
 	}
-	f.fs.Remove(f.Name())
-	return nil
+	return err
 }
@@ -135,6 +135,13 @@ func (f *fileHeader) setCreationTime(t time.Time) {
 	util.WriteLEUint32(f[:], ofsTime, time)
 }
 
+// touch sets the time stamp to t and tells whether that changed it.
+func (f *fileHeader) touch(t time.Time) bool {
+	date, tm := util.ReadLEUint32(f[:], ofsDate), util.ReadLEUint32(f[:], ofsTime)
+	f.setCreationTime(t)
+	return date != util.ReadLEUint32(f[:], ofsDate) || tm != util.ReadLEUint32(f[:], ofsTime)
+}
+
 func (f *fileHeader) getExtensionTable() []uint32 {
 	ext := make([]uint32, 0, exTabSize)
 	for i := 0; i < exTabSize; i++ {
@@ -173,3 +180,7 @@ func (f *fileHeader) setSectorTableEntry(index uint32, addr uint32) {
 	}
 	util.WriteLEUint32(f[:], int(ofsSecTable+index*4), addr)
 }
+
+func (f *fileHeader) sectorTableEntry(index uint32) uint32 {
+	return util.ReadLEUint32(f[:], int(ofsSecTable+index*4))
+}
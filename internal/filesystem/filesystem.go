@@ -19,8 +19,8 @@
 package filesystem
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
 	"sort"
 	"sync"
 	"time"
@@ -37,64 +37,91 @@ const (
 	fnLength   = 32
 	sectorSize = 2048
 	dirRootAdr = 29
+
+	// MaxNameLength is the maximum length of a file name.
+	MaxNameLength = fnLength
 )
 
+// FileSystem is safe for concurrent use. Locks are always acquired in this
+// order: filesMutex (directory), a file's fileState.mutex, sectorMapMutex
+// (allocator). statesMutex only protects the states map and is never held
+// while acquiring one of the other locks.
 type FileSystem struct {
 	disk *disk.Disk
 
 	sectorMapMutex       sync.RWMutex
 	sectorReservationMap util.BitSet
 	numUsedSectors       uint32
+	allocator            Allocator
+	lastAllocated        uint32 // hint for new headers
 
 	filesMutex sync.RWMutex
 	files      []dirEntry
 	dirPages   []uint32
+	dirDepth   int // of the tree on disk
 	filesDirty bool
+
+	statesMutex sync.Mutex
+	states      map[uint32]*fileState // keyed by header address
+
+	clock func() time.Time
 }
 
-func New(d *disk.Disk) *FileSystem {
+func New(d *disk.Disk) (*FileSystem, error) {
 	fs := &FileSystem{
 		disk:                 d,
-		sectorReservationMap: util.NewBitSet(d.Size() / disk.SectorMultiplier), // For simplicity, keep it 1-based
+		sectorReservationMap: util.NewBitSet(d.Size()/disk.SectorMultiplier + 1), // For simplicity, keep it 1-based
+		states:               make(map[uint32]*fileState),
+		allocator:            NextFreeAllocator{},
+		clock:                time.Now,
+	}
+	if err := fs.init(); err != nil {
+		return nil, err
 	}
-	fs.init()
-	return fs
+	return fs, nil
+}
+
+// Format writes an empty directory to d, which is then ready for New. The
+// rest of the disk is left alone; it's expected to be zero.
+func Format(d *disk.Disk) error {
+	root := &dirPage{addr: dirRootAdr}
+	return root.writeToDisk(d)
 }
 
 func (fs *FileSystem) Close() error {
 	log.Debug().Msg("Closing filesystem")
-	if fs.filesDirty {
-		err := fs.writeDirectoryToDisk()
-		if err != nil {
-			return err
-		}
-
+	err := fs.writeDirectoryToDisk()
+	if err != nil {
+		return err
 	}
 	log.Debug().Msg("Filesystem closed")
 
 	return nil
 }
 
-func (fs *FileSystem) writeDirectoryToDisk() error {
-	log.Debug().Msg("Writing directory to disk")
+// Flush writes the directory to disk if it was changed.
+func (fs *FileSystem) Flush() error {
+	return fs.writeDirectoryToDisk()
+}
 
+func (fs *FileSystem) writeDirectoryToDisk() error {
 	fs.filesMutex.Lock()
 	defer fs.filesMutex.Unlock()
 
+	if !fs.filesDirty {
+		return nil
+	}
+	log.Debug().Msg("Writing directory to disk")
+
 	// Ensure all files are sorted by name
 	sort.Slice(fs.files, func(i, j int) bool {
 		return fs.files[i].name < fs.files[j].name
 	})
 
-	// Free all existing dirPages, we will rebuild the tree
-	for _, addr := range fs.dirPages {
-		fs.FreeSector(addr)
-	}
-
 	// dirPage Address Provider: reuse existing dirPages first.
 	nextPageAddr := 0
 	newDirPages := []uint32{}
-	dirPageAddrProvider := func() uint32 {
+	dirPageAddrProvider := func() (uint32, error) {
 		var addr uint32
 		if nextPageAddr < len(fs.dirPages) {
 			// Reuse existing page
@@ -102,44 +129,77 @@ func (fs *FileSystem) writeDirectoryToDisk() error {
 			nextPageAddr++
 		} else {
 			// Allocate new page
-			addr = fs.AllocSector(0)
-			fs.markSectorUsed(addr)
+			var err error
+			addr, err = fs.AllocSector(0)
+			if err != nil {
+				return 0, err
+			}
 		}
 		newDirPages = append(newDirPages, addr)
-		return addr
+		return addr, nil
 	}
 
 	// Build a new directory tree.
 	filesWritten := 0
 	pagesWritten := 0
-	rootDir := fs.buildDirTree(
+	rootDir, err := fs.buildDirTree(
 		nil,
 		fs.files,
 		dirPageAddrProvider,
 		func(do *dirPage, de *dirEntry) { filesWritten++ },
 		func(dp *dirPage) { pagesWritten++ },
 	)
+	if err != nil {
+		// Give back the pages we allocated so far; the old tree is still intact on disk.
+		for _, addr := range newDirPages[nextPageAddr:] {
+			fs.FreeSector(addr)
+		}
+		return err
+	}
+	if rootDir == nil {
+		// Without files, the root page is still there, empty. It's the first
+		// of the old pages, so it stays at dirRootAdr.
+		addr, err := dirPageAddrProvider()
+		if err != nil {
+			return err
+		}
+		rootDir = &dirPage{addr: addr}
+		pagesWritten++
+	}
 
-	sectorsFreed := len(fs.dirPages) - len(newDirPages)
+	// Free the existing dirPages we did not reuse
+	for _, addr := range fs.dirPages[nextPageAddr:] {
+		if err := fs.FreeSector(addr); err != nil {
+			return err
+		}
+	}
+	sectorsFreed := len(fs.dirPages) - nextPageAddr
 
 	// Write root dir page to disk now
-	rootDir.writeToDisk(fs.disk)
+	if err := rootDir.writeToDisk(fs.disk); err != nil {
+		return err
+	}
 	fs.filesDirty = false
 	fs.dirPages = newDirPages
+	fs.dirDepth = rootDir.depth()
 
 	log.Info().Msgf("Wrote %d files in %d dir pages, freed %d unused dir pages", filesWritten, pagesWritten, sectorsFreed)
 
 	return nil
 }
 
-func (fs *FileSystem) buildDirTree(parent *dirPage, entries []dirEntry, addrProvider func() uint32, fileCallback func(*dirPage, *dirEntry), pageCallback func(*dirPage)) *dirPage {
+func (fs *FileSystem) buildDirTree(parent *dirPage, entries []dirEntry, addrProvider func() (uint32, error), fileCallback func(*dirPage, *dirEntry), pageCallback func(*dirPage)) (*dirPage, error) {
 	if len(entries) == 0 {
-		return nil
+		return nil, nil
 	}
 
+	addr, err := addrProvider()
+	if err != nil {
+		return nil, err
+	}
 	node := &dirPage{
 		parent: parent,
-		addr:   addrProvider(),
+		addr:   addr,
 	}
 
 	if len(entries) <= dirPgSize {
@@ -147,7 +207,7 @@ func (fs *FileSystem) buildDirTree(parent *dirPage, entries []dirEntry, addrProv
 		node.entries = make([]dirEntry, len(entries))
 		copy(node.entries, entries)
 		pageCallback(node)
-		return node
+		return node, nil
 	}
 
 	// internal node: split into buckets, pick a root element for each bucket, build subtrees and node
@@ -170,10 +230,16 @@ func (fs *FileSystem) buildDirTree(parent *dirPage, entries []dirEntry, addrProv
 		bucketEntries := entries[start:end]
 		if i == 0 {
 			// first bucket
-			node.p0 = fs.buildDirTree(node, bucketEntries, addrProvider, fileCallback, pageCallback)
+			node.p0, err = fs.buildDirTree(node, bucketEntries, addrProvider, fileCallback, pageCallback)
+			if err != nil {
+				return nil, err
+			}
 		} else {
 			e := bucketEntries[0]
-			e.p = fs.buildDirTree(node, bucketEntries[1:], addrProvider, fileCallback, pageCallback)
+			e.p, err = fs.buildDirTree(node, bucketEntries[1:], addrProvider, fileCallback, pageCallback)
+			if err != nil {
+				return nil, err
+			}
 			node.entries = append(node.entries, e)
 			for _, e := range bucketEntries {
 				fileCallback(node, &e)
@@ -181,10 +247,10 @@ func (fs *FileSystem) buildDirTree(parent *dirPage, entries []dirEntry, addrProv
 		}
 		start = end
 	}
-	return node
+	return node, nil
 }
 
-func (fs *FileSystem) init() {
+func (fs *FileSystem) init() error {
 	fs.filesMutex.Lock()
 	defer fs.filesMutex.Unlock()
 
@@ -192,15 +258,24 @@ func (fs *FileSystem) init() {
 	fs.numUsedSectors = 0
 
 	// Ignore existing index and scan files. Make sure that index is invalidated.
-	sec := fs.disk.MustGetSector(fs.disk.Size())
+	sec, err := fs.disk.GetSector(fs.disk.Size())
+	if err != nil {
+		return err
+	}
 	util.WriteLEUint32(sec[:], 0, 0)
-	fs.disk.MustPutSector(fs.disk.Size(), sec)
+	if err := fs.disk.PutSector(fs.disk.Size(), sec); err != nil {
+		return err
+	}
+	// The index lives in the last sector, so we must never hand it out for files.
+	if err := fs.markSectorUsed(fs.disk.Size()); err != nil {
+		return err
+	}
 
 	log.Info().Msg("Loading directory from disk")
 	seen := make(map[uint32]struct{})
 	rootDirPage, err := loadDirFromDisk(fs.disk, dirRootAdr, seen, 0)
 	if err != nil {
-		panic(fmt.Errorf("failed to load root dir page: %w", err))
+		return fmt.Errorf("failed to load root dir page: %w", err)
 	}
 	log.Info().Msg("Directory loaded, scanning files")
 
@@ -213,32 +288,70 @@ func (fs *FileSystem) init() {
 	rootDirPage.collectDirPageAddresses(func(addr uint32) {
 		fs.dirPages = append(fs.dirPages, addr)
 	})
+	fs.dirDepth = rootDirPage.depth()
 	fs.filesDirty = false
 
 	// mark all dirPages sectors as used
 	for _, addr := range fs.dirPages {
-		fs.markSectorUsed(addr)
+		if err := fs.markSectorUsed(addr); err != nil {
+			return err
+		}
 	}
 
-	// Mark all sectors of all files as used
+	// Mark all sectors of all files as used. A broken file must not prevent
+	// the rest of the image from being usable, so we only log problems here;
+	// they are reported as errors when the file is accessed.
 	for _, entry := range fs.files {
-		// Add all "primary sectors"
-		fh := fileHeader(fs.disk.MustGetSector(entry.adr))
-		for _, secAddr := range fh.getSectorTable() {
-			fs.markSectorUsed(secAddr)
+		if err := fs.markFileSectorsUsed(entry.adr); err != nil {
+			log.Warn().Err(err).Msgf("File %s is damaged", entry.name)
+		}
+	}
+	log.Info().Msgf("%d files allocating %d sectors found", len(fs.files), fs.numUsedSectors)
+	return nil
+}
+
+func (fs *FileSystem) markFileSectorsUsed(headerAddr uint32) error {
+	if err := fs.markSectorUsed(headerAddr); err != nil {
+		return corrupt(headerAddr, "invalid file header address")
+	}
+	sec, err := fs.disk.GetSector(headerAddr)
+	if err != nil {
+		return err
+	}
+	fh := fileHeader(sec)
+	if !fh.IsValid() {
+		return corrupt(headerAddr, "invalid file header mark")
+	}
+
+	// Add all "primary sectors"; the first one is the header itself
+	for _, secAddr := range fh.getSectorTable() {
+		if secAddr == headerAddr {
+			continue
+		}
+		if err := fs.markSectorUsed(secAddr); err != nil {
+			return corrupt(headerAddr, "invalid sector address %d in sector table", secAddr)
+		}
+	}
+	// Add sectors via index tables
+	for _, extAdr := range fh.getExtensionTable() {
+		if err := fs.markSectorUsed(extAdr); err != nil {
+			return corrupt(headerAddr, "invalid index sector address %d in extension table", extAdr)
 		}
-		// Add sectors via index tables
-		for _, extAdr := range fh.getExtensionTable() {
-			fs.markSectorUsed(extAdr)
-			isec := indexSector(fs.disk.MustGetSector(extAdr))
-			for _, dataAdr := range isec.entries() {
-				fs.markSectorUsed(dataAdr)
+		sec, err := fs.disk.GetSector(extAdr)
+		if err != nil {
+			return err
+		}
+		isec := indexSector(sec)
+		for _, dataAdr := range isec.entries() {
+			if err := fs.markSectorUsed(dataAdr); err != nil {
+				return corrupt(extAdr, "invalid sector address %d in index sector", dataAdr)
 			}
 		}
 	}
-	log.Info().Msgf("%d files allocating %d sectors found", len(fs.files), fs.numUsedSectors)
+	return nil
 }
 
+// Find returns the file called name, or ErrNotFound.
 func (fs *FileSystem) Find(name string) (*File, error) {
 	fs.filesMutex.RLock()
 	defer fs.filesMutex.RUnlock()
@@ -246,16 +359,53 @@ func (fs *FileSystem) Find(name string) (*File, error) {
 	return fs.find_locked(name)
 }
 
+// Open is like Find, but the returned handle keeps the file's sectors from
+// being freed if the file is removed, until it's closed; see File.Open.
+func (fs *FileSystem) Open(name string) (*File, error) {
+	fs.filesMutex.RLock()
+	defer fs.filesMutex.RUnlock()
+
+	f, err := fs.find_locked(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.Open(), nil
+}
+
+// Create creates a new, empty file and registers it in the directory. It
+// fails with ErrExists if there already is a file called name.
+func (fs *FileSystem) Create(name string) (*File, error) {
+	f, err := fs.NewFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Register(); err != nil {
+		if derr := f.Discard(); derr != nil {
+			log.Error().Err(derr).Msgf("Can't free header of %s", name)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
 func (fs *FileSystem) find_locked(name string) (*File, error) {
 	for _, entry := range fs.files {
 		if entry.name == name {
 			return fs.NewFileFromFileHeader(entry.adr)
 		}
 	}
-	return nil, nil
+	return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
 }
 
-func (fs *FileSystem) Remove(name string) bool {
+// Remove deletes name from the directory and frees its sectors. If the file
+// is open (see File.Open), the sectors are freed when the last handle is
+// closed. Handles returned by Find must not be used afterwards.
+func (fs *FileSystem) Remove(name string) error {
+	return fs.remove(name, true)
+}
+
+// remove deletes name from the directory, and if free is set, its sectors.
+func (fs *FileSystem) remove(name string, free bool) error {
 	fs.filesMutex.Lock()
 	defer fs.filesMutex.Unlock()
 
@@ -264,10 +414,217 @@ func (fs *FileSystem) Remove(name string) bool {
 			// Remove file entry
 			fs.files = append(fs.files[:idx], fs.files[idx+1:]...)
 			fs.filesDirty = true
-			return true
+			if free {
+				fs.freeRemoved_locked(entry.adr)
+			}
+			return nil
 		}
 	}
-	return false
+	return fmt.Errorf("%w: %s", ErrNotFound, name)
+}
+
+// freeRemoved_locked frees the sectors of the file at adr, which was just
+// removed from the directory, unless another entry shares its header. If
+// the file is open, that happens when it's closed. If the sectors can't be
+// found, they're only free the next time the image is opened. The caller
+// must hold filesMutex.
+func (fs *FileSystem) freeRemoved_locked(adr uint32) {
+	for _, entry := range fs.files {
+		if entry.adr == adr {
+			return
+		}
+	}
+	f, err := fs.NewFileFromFileHeader(adr)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Can't free the sectors of the file at %d", adr)
+		return
+	}
+	f.st.mutex.Lock()
+	defer f.st.mutex.Unlock()
+
+	if f.st.open > 0 {
+		f.st.removed = true
+		return
+	}
+	if err := f.free_locked(); err != nil {
+		log.Warn().Err(err).Msgf("Can't free the sectors of the file at %d", adr)
+	}
+}
+
+// Rename renames the file oldName to newName. If there already is a file
+// called newName, it's replaced if replace is set, like rename(2) does;
+// otherwise, Rename fails with ErrExists. Either way, the directory changes
+// all at once.
+func (fs *FileSystem) Rename(oldName, newName string, replace bool) error {
+	if err := ValidateFilename(oldName); err != nil {
+		return err
+	}
+	if err := ValidateFilename(newName); err != nil {
+		return err
+	}
+
+	fs.filesMutex.Lock()
+	defer fs.filesMutex.Unlock()
+
+	idx, existing := -1, -1
+	for i, entry := range fs.files {
+		if entry.name == newName && newName != oldName {
+			if !replace {
+				return fmt.Errorf("%w: %s", ErrExists, newName)
+			}
+			existing = i
+		}
+		if entry.name == oldName {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, oldName)
+	}
+
+	// Update the header first; if that fails, nothing has changed
+	f, err := fs.NewFileFromFileHeader(fs.files[idx].adr)
+	if err != nil {
+		return err
+	}
+	if err := f.SetName(newName); err != nil {
+		return err
+	}
+	fs.files[idx].name = newName
+	fs.filesDirty = true
+	if existing >= 0 {
+		adr := fs.files[existing].adr
+		fs.files = append(fs.files[:existing], fs.files[existing+1:]...)
+		fs.freeRemoved_locked(adr)
+	}
+	return nil
+}
+
+// ReplaceContents replaces the contents and creation time of the file name
+// with the ones of src, which must not be registered. The file keeps its
+// header address, and the switch is a single write of the header, so name
+// has either its old or its new contents. src must not be used afterwards.
+func (fs *FileSystem) ReplaceContents(name string, src *File) error {
+	fs.filesMutex.Lock()
+	defer fs.filesMutex.Unlock()
+
+	for _, entry := range fs.files {
+		if entry.adr == src.headerAddr {
+			return fmt.Errorf("can't replace %s by %s: file is registered", name, entry.name)
+		}
+	}
+	dst, err := fs.find_locked(name)
+	if err != nil {
+		return err
+	}
+	return fs.replaceContents_locked(name, dst, src)
+}
+
+// RegisterOrReplace registers f, which must not be registered yet. If there
+// already is a file with the same name, its contents are replaced by the
+// ones of f instead, see ReplaceContents. The decision and the change are
+// made in one go.
+func (fs *FileSystem) RegisterOrReplace(f *File) error {
+	name := f.Name()
+
+	fs.filesMutex.Lock()
+	defer fs.filesMutex.Unlock()
+
+	for _, entry := range fs.files {
+		if entry.adr == f.headerAddr {
+			return fmt.Errorf("can't register %s: file is already registered", name)
+		}
+	}
+	dst, err := fs.find_locked(name)
+	switch {
+	case err == nil:
+		return fs.replaceContents_locked(name, dst, f)
+	case !errors.Is(err, ErrNotFound):
+		return err
+	}
+	fs.files = append(fs.files, dirEntry{name: name, adr: f.headerAddr})
+	fs.filesDirty = true
+	return nil
+}
+
+// replaceContents_locked does the work of ReplaceContents. The caller must
+// hold filesMutex.
+func (fs *FileSystem) replaceContents_locked(name string, dst, src *File) error {
+	dst.st.mutex.Lock()
+	defer dst.st.mutex.Unlock()
+	src.st.mutex.Lock()
+	defer src.st.mutex.Unlock()
+
+	old, err := dst.sectors_locked()
+	if err != nil {
+		return err
+	}
+	if err := src.release_locked(); err != nil {
+		return err
+	}
+
+	// The header sector also holds the first bytes of data
+	header := src.st.header
+	header.setName(name)
+	header.setSectorTableEntry(0, dst.headerAddr)
+	if err := fs.disk.PutSector(dst.headerAddr, disk.Sector(header)); err != nil {
+		return err
+	}
+	dst.st.header = header
+
+	fs.statesMutex.Lock()
+	delete(fs.states, src.headerAddr)
+	fs.statesMutex.Unlock()
+	for _, addr := range append(old[1:], src.headerAddr) {
+		if err := fs.FreeSector(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterWithBackup registers f, which must not be registered yet. If there
+// already is a file with the same name, it is renamed to backup first,
+// replacing any file called backup, like Oberon's editors do with ".Bak"
+// files. The directory changes all at once.
+func (fs *FileSystem) RegisterWithBackup(f *File, backup string) error {
+	if err := ValidateFilename(backup); err != nil {
+		return err
+	}
+	name := f.Name()
+
+	fs.filesMutex.Lock()
+	defer fs.filesMutex.Unlock()
+
+	old, bak := -1, -1
+	for i, entry := range fs.files {
+		switch {
+		case entry.adr == f.headerAddr:
+			return fmt.Errorf("can't register %s: file is already registered", name)
+		case entry.name == name:
+			old = i
+		case entry.name == backup:
+			bak = i
+		}
+	}
+	if old >= 0 {
+		oldFile, err := fs.NewFileFromFileHeader(fs.files[old].adr)
+		if err != nil {
+			return err
+		}
+		if err := oldFile.SetName(backup); err != nil {
+			return err
+		}
+		fs.files[old].name = backup
+		if bak >= 0 {
+			adr := fs.files[bak].adr
+			fs.files = append(fs.files[:bak], fs.files[bak+1:]...)
+			fs.freeRemoved_locked(adr)
+		}
+	}
+	fs.files = append(fs.files, dirEntry{name: name, adr: f.headerAddr})
+	fs.filesDirty = true
+	return nil
 }
 
 type ListFileFilter func(*File) bool
@@ -276,13 +633,35 @@ var AllFiles ListFileFilter = func(f *File) bool {
 	return true
 }
 
+// DirEntry is a file in the directory.
+type DirEntry struct {
+	Name       string
+	HeaderAddr uint32
+}
+
+// ListEntries returns the files in the directory, without looking at their
+// headers. Unlike ListFiles, it doesn't fail on damaged files.
+func (fs *FileSystem) ListEntries() []DirEntry {
+	fs.filesMutex.RLock()
+	defer fs.filesMutex.RUnlock()
+
+	entries := make([]DirEntry, len(fs.files))
+	for i, entry := range fs.files {
+		entries[i] = DirEntry{Name: entry.name, HeaderAddr: entry.adr}
+	}
+	return entries
+}
+
 func (fs *FileSystem) ListFiles(pred ListFileFilter) ([]*File, error) {
 	fs.filesMutex.RLock()
 	defer fs.filesMutex.RUnlock()
 
 	var files []*File
 	for _, entry := range fs.files {
-		f, _ := fs.NewFileFromFileHeader(entry.adr)
+		f, err := fs.NewFileFromFileHeader(entry.adr)
+		if err != nil {
+			return nil, fmt.Errorf("file %s: %w", entry.name, err)
+		}
 		if pred(f) {
 			files = append(files, f)
 		}
@@ -290,78 +669,175 @@ func (fs *FileSystem) ListFiles(pred ListFileFilter) ([]*File, error) {
 	return files, nil
 }
 
-func (fs *FileSystem) IsSectorFree(addr uint32) bool {
+func (fs *FileSystem) checkSectorAddr(addr uint32) error {
 	if addr%disk.SectorMultiplier != 0 {
-		panic(fmt.Sprintf("IsSectorFree: addr not a multiple of %d", disk.SectorMultiplier))
+		return fmt.Errorf("%w %d: not a multiple of %d", disk.ErrInvalidSector, addr, disk.SectorMultiplier)
+	}
+	if addr == 0 || addr > fs.disk.Size() {
+		return fmt.Errorf("%w %d: not in %d..%d", disk.ErrInvalidSector, addr, disk.SectorMultiplier, fs.disk.Size())
+	}
+	return nil
+}
+
+func (fs *FileSystem) IsSectorFree(addr uint32) (bool, error) {
+	fs.sectorMapMutex.RLock()
+	defer fs.sectorMapMutex.RUnlock()
+
+	if err := fs.checkSectorAddr(addr); err != nil {
+		return false, err
 	}
-	return !fs.sectorReservationMap.Test(addr / disk.SectorMultiplier)
+	return !fs.sectorReservationMap.Test(addr / disk.SectorMultiplier), nil
 }
 
-func (fs *FileSystem) FreeSector(addr uint32) {
+func (fs *FileSystem) FreeSector(addr uint32) error {
 	fs.sectorMapMutex.Lock()
 	defer fs.sectorMapMutex.Unlock()
 
-	if addr%disk.SectorMultiplier != 0 {
-		panic(fmt.Sprintf("FreeSector: addr not a multiple of %d", disk.SectorMultiplier))
+	if err := fs.checkSectorAddr(addr); err != nil {
+		return err
+	}
+	if fs.sectorReservationMap.Test(addr / disk.SectorMultiplier) {
+		fs.sectorReservationMap.Clear(addr / disk.SectorMultiplier)
+		fs.numUsedSectors--
 	}
-	fs.sectorReservationMap.Clear(addr / disk.SectorMultiplier)
-	fs.numUsedSectors--
+	return nil
 }
 
-func (fs *FileSystem) markSectorUsed(addr uint32) {
+func (fs *FileSystem) markSectorUsed(addr uint32) error {
 	fs.sectorMapMutex.Lock()
 	defer fs.sectorMapMutex.Unlock()
 
-	if addr%disk.SectorMultiplier != 0 {
-		panic(fmt.Sprintf("markSectorUsed: addr not a multiple of %d", disk.SectorMultiplier))
+	if err := fs.checkSectorAddr(addr); err != nil {
+		return err
+	}
+	if !fs.sectorReservationMap.Test(addr / disk.SectorMultiplier) {
+		fs.sectorReservationMap.Set(addr / disk.SectorMultiplier)
+		fs.numUsedSectors++
+	}
+	return nil
+}
+
+// claimSector marks sector addr as used if it's free, and tells whether it
+// was.
+func (fs *FileSystem) claimSector(addr uint32) (bool, error) {
+	fs.sectorMapMutex.Lock()
+	defer fs.sectorMapMutex.Unlock()
+
+	if err := fs.checkSectorAddr(addr); err != nil {
+		return false, err
+	}
+	if fs.sectorReservationMap.Test(addr / disk.SectorMultiplier) {
+		return false, nil
 	}
 	fs.sectorReservationMap.Set(addr / disk.SectorMultiplier)
 	fs.numUsedSectors++
+	return true, nil
+}
+
+// SetAllocator sets the policy used to place new sectors. The default is
+// NextFreeAllocator.
+func (fs *FileSystem) SetAllocator(a Allocator) {
+	fs.sectorMapMutex.Lock()
+	defer fs.sectorMapMutex.Unlock()
+
+	fs.allocator = a
+}
+
+// SetClock sets the function used to get the time stamps of new and
+// modified files. The default is time.Now. SetClock must not be called
+// while the file system is in use.
+func (fs *FileSystem) SetClock(clock func() time.Time) {
+	fs.clock = clock
+}
+
+// Now returns the current time of the clock set with SetClock.
+func (fs *FileSystem) Now() time.Time {
+	return fs.clock()
 }
 
 // AllocSector allocates a new sector. "hint" can be previously allocated
 // sector to preserve adjacency, or 0 if previous sector not known.
-func (fs *FileSystem) AllocSector(hint uint32) uint32 {
+func (fs *FileSystem) AllocSector(hint uint32) (uint32, error) {
+	secs, err := fs.AllocSectors(hint, 1)
+	if err != nil {
+		return 0, err
+	}
+	return secs[0], nil
+}
+
+// AllocSectors allocates n sectors at once, so that the allocator can place
+// them next to each other. "hint" is the same as for AllocSector.
+func (fs *FileSystem) AllocSectors(hint uint32, n int) ([]uint32, error) {
+	return fs.allocSectors(hint, n, n)
+}
+
+// allocSectors is AllocSectors, telling the allocator that the file is
+// expected to need want sectors from hint on.
+func (fs *FileSystem) allocSectors(hint uint32, n, want int) ([]uint32, error) {
 	fs.sectorMapMutex.Lock()
 	defer fs.sectorMapMutex.Unlock()
 
 	if hint%disk.SectorMultiplier != 0 {
-		panic(fmt.Sprintf("AllocSector: hint not a multiple of %d", disk.SectorMultiplier))
+		return nil, fmt.Errorf("AllocSectors: %w %d (hint)", disk.ErrInvalidSector, hint)
 	}
-
-	if hint > fs.disk.Size() {
+	if hint >= fs.disk.Size() {
 		hint = 0
 	}
-	sec := hint + 29
-	for {
-		if sec == hint {
-			panic("Disk full")
-		}
-		if fs.IsSectorFree(sec) {
-			fs.sectorReservationMap.Set(sec / disk.SectorMultiplier)
-			fs.numUsedSectors++
-			return sec
-		}
-		sec += disk.SectorMultiplier
-		if sec > fs.disk.Size() {
-			sec = 29
-		}
+	if free := fs.disk.Size()/disk.SectorMultiplier - fs.numUsedSectors; uint32(n) > free {
+		return nil, fmt.Errorf("%w: need %d sectors, %d free", ErrDiskFull, n, free)
 	}
+
+	secs := fs.allocator.Pick(sectorMap{fs}, hint, n, want)
+	for _, sec := range secs {
+		fs.sectorReservationMap.Set(sec / disk.SectorMultiplier)
+		fs.numUsedSectors++
+	}
+	if n > 0 {
+		fs.lastAllocated = secs[n-1]
+	}
+	return secs, nil
 }
 
+// NewFileFromFileHeader returns a new handle for the file whose header is
+// at headerAddr. All handles for a file share the same state.
 func (fs *FileSystem) NewFileFromFileHeader(headerAddr uint32) (*File, error) {
-	header := fileHeader(fs.disk.MustGetSector(headerAddr))
-	if !header.IsValid() {
-		return nil, fmt.Errorf("invalid file header")
+	st, err := fs.fileState(headerAddr)
+	if err != nil {
+		return nil, err
 	}
-
 	return &File{
-		header:     header,
+		st:         st,
 		headerAddr: headerAddr,
 		fs:         fs,
 	}, nil
 }
 
+// fileState returns the shared state of the file at headerAddr, loading the
+// header from disk if the file has not been accessed before.
+func (fs *FileSystem) fileState(headerAddr uint32) (*fileState, error) {
+	if err := fs.checkSectorAddr(headerAddr); err != nil {
+		return nil, corrupt(headerAddr, "invalid file header address")
+	}
+
+	fs.statesMutex.Lock()
+	defer fs.statesMutex.Unlock()
+
+	if st, ok := fs.states[headerAddr]; ok {
+		return st, nil
+	}
+	sec, err := fs.disk.GetSector(headerAddr)
+	if err != nil {
+		return nil, err
+	}
+	header := fileHeader(sec)
+	if !header.IsValid() {
+		return nil, corrupt(headerAddr, "invalid file header mark")
+	}
+	st := &fileState{header: header}
+	fs.states[headerAddr] = st
+	return st, nil
+}
+
 func isLetter(c byte) bool {
 	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
 }
@@ -370,57 +846,78 @@ func isDigit(c byte) bool {
 	return c >= '0' && c <= '9'
 }
 
-func (fs *FileSystem) validateFilename(name string) error {
+// ValidateFilename checks that name is a valid Oberon file name: it starts
+// with a letter, and contains only letters, digits and dots.
+func ValidateFilename(name string) error {
 	if len(name) > fnLength {
-		return fmt.Errorf("file name too long: %d > %d", len(name), fnLength)
+		return fmt.Errorf("%w %q: too long (%d > %d)", ErrInvalidName, name, len(name), fnLength)
 	}
 	if len(name) == 0 {
-		return fmt.Errorf("file name cannot be empty")
+		return fmt.Errorf("%w: file name cannot be empty", ErrInvalidName)
 	}
 	// Must start with a letter
 	if !isLetter(name[0]) {
-		return fmt.Errorf("file name must start with a letter")
+		return fmt.Errorf("%w %q: must start with a letter", ErrInvalidName, name)
 	}
 	// Only allow letters, digits, dot
 	for i := 0; i < len(name); i++ {
 		c := name[i]
 		if !isLetter(c) && !isDigit(c) && c != '.' {
-			return fmt.Errorf("file name contains invalid character: %c", c)
+			return fmt.Errorf("%w %q: contains invalid character %q", ErrInvalidName, name, c)
 		}
 	}
 	return nil
 }
 
 func (fs *FileSystem) NewFile(name string) (*File, error) {
-	if err := fs.validateFilename(name); err != nil {
+	if err := ValidateFilename(name); err != nil {
 		return nil, err
 	}
 	fileHeader := fileHeader{}
-	headerAddr := fs.AllocSector(rand.Uint32() % uint32(fs.disk.Size()/disk.SectorMultiplier) * disk.SectorMultiplier)
+	// Place the header near the sectors allocated last, which likely belong
+	// to the previous file written, rather than searching from the start
+	fs.sectorMapMutex.RLock()
+	hint := fs.lastAllocated
+	fs.sectorMapMutex.RUnlock()
+	headerAddr, err := fs.AllocSector(hint)
+	if err != nil {
+		return nil, err
+	}
 	fileHeader.setMark()
 	fileHeader.setName(name)
 	fileHeader.setAleng(0)
 	fileHeader.setBleng(headerSize)
 	fileHeader.setSectorTableEntry(0, headerAddr)
-	fileHeader.setCreationTime(time.Now())
-	fs.disk.PutSector(headerAddr, disk.Sector(fileHeader))
+	fileHeader.setCreationTime(fs.clock())
+	if err := fs.disk.PutSector(headerAddr, disk.Sector(fileHeader)); err != nil {
+		fs.FreeSector(headerAddr)
+		return nil, err
+	}
+
+	// The sector was free, so any state we still have for it is stale.
+	st := &fileState{header: fileHeader}
+	fs.statesMutex.Lock()
+	fs.states[headerAddr] = st
+	fs.statesMutex.Unlock()
 
 	return &File{
-		header:     fileHeader,
+		st:         st,
 		headerAddr: headerAddr,
 		fs:         fs,
 	}, nil
 }
 
 func (fs *FileSystem) Insert(f *File) error {
+	name := f.Name()
+
+	fs.filesMutex.Lock()
+	defer fs.filesMutex.Unlock()
+
 	// Check if the file already exists
-	name := f.header.name()
-	existing, err := fs.Find(name)
-	if err != nil {
-		return err
-	}
-	if existing != nil {
-		return fmt.Errorf("File %s already exists", name)
+	for _, entry := range fs.files {
+		if entry.name == name {
+			return fmt.Errorf("%w: %s", ErrExists, name)
+		}
 	}
 
 	fs.files = append(fs.files, dirEntry{
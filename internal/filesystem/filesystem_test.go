@@ -0,0 +1,1166 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asig/odit/internal/disk"
+	"github.com/asig/odit/internal/util"
+	"github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// newTestImage creates an image with a single, empty Native Oberon
+// partition of numSectors sectors and returns its path.
+func newTestImage(t *testing.T, numSectors uint32) string {
+	t.Helper()
+
+	const (
+		blockSize  = 512
+		partStart  = 1 // partition starts right after the MBR
+		rootOffset = 1 // file system starts right after the boot block
+	)
+	partLen := rootOffset + numSectors*disk.SectorSize/blockSize
+	img := make([]byte, (partStart+partLen)*blockSize)
+
+	// MBR with one Oberon partition
+	e := 0x1BE
+	img[e+4] = 79
+	util.WriteLEUint32(img, e+8, partStart)
+	util.WriteLEUint32(img, e+12, partLen)
+	img[510] = 0x55
+	img[511] = 0xAA
+
+	// Boot block
+	b := img[partStart*blockSize:]
+	copy(b[3:], "OBERON")
+	util.WriteLEUint16(b, 0xe, rootOffset)
+
+	// Empty root directory page at sector 1
+	r := img[(partStart+rootOffset)*blockSize:]
+	util.WriteLEUint32(r, 0, dirMark)
+
+	path := filepath.Join(t.TempDir(), "test.img")
+	if err := os.WriteFile(path, img, 0644); err != nil {
+		t.Fatalf("Can't write test image: %v", err)
+	}
+	return path
+}
+
+func openTestFS(t *testing.T, path string) *FileSystem {
+	t.Helper()
+
+	d, err := disk.Open(path)
+	if err != nil {
+		t.Fatalf("Can't open image: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	fs, err := New(d)
+	if err != nil {
+		t.Fatalf("Can't load file system: %v", err)
+	}
+	return fs
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestWriteRead(t *testing.T) {
+	path := newTestImage(t, 1000)
+	fs := openTestFS(t, path)
+
+	// Large enough to need an index sector
+	data := testData(100 * sectorSize)
+	f, err := fs.NewFile("Test.Data")
+	if err != nil {
+		t.Fatalf("NewFile failed: %v", err)
+	}
+	if err := f.Register(); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	fs = openTestFS(t, path)
+	f, err = fs.Find("Test.Data")
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Read back %d bytes, want the %d bytes written", len(got), len(data))
+	}
+}
+
+func TestErrors(t *testing.T) {
+	fs := openTestFS(t, newTestImage(t, 20))
+
+	if _, err := fs.Find("Missing.Mod"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Find(missing): got %v, want ErrNotFound", err)
+	}
+	if err := fs.Remove("Missing.Mod"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Remove(missing): got %v, want ErrNotFound", err)
+	}
+	if _, err := fs.NewFile("0Bad_Name"); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("NewFile(invalid): got %v, want ErrInvalidName", err)
+	}
+
+	f, err := fs.NewFile("Dup.Mod")
+	if err != nil {
+		t.Fatalf("NewFile failed: %v", err)
+	}
+	if err := f.Register(); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	f2, err := fs.NewFile("Dup.Mod")
+	if err != nil {
+		t.Fatalf("NewFile failed: %v", err)
+	}
+	if err := f2.Register(); !errors.Is(err, ErrExists) {
+		t.Errorf("Register(duplicate): got %v, want ErrExists", err)
+	}
+
+	if _, err := f.WriteAt([]byte{1}, sectorSize*(secTabSize+exTabSize*indexSize)); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("WriteAt(beyond max size): got %v, want ErrFileTooLarge", err)
+	}
+	if _, err := f.WriteAt(testData(30*sectorSize), 0); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("WriteAt(more than disk size): got %v, want ErrDiskFull", err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	fs := openTestFS(t, newTestImage(t, 100))
+	used := fs.Stats().UsedSectors
+	data := testData(20 * sectorSize)
+	write := func(name string) {
+		t.Helper()
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	// The image only has room for a few of these at a time
+	for i := 0; i < 20; i++ {
+		write("Tmp.Data")
+		if err := fs.Remove("Tmp.Data"); err != nil {
+			t.Fatalf("Remove failed: %v", err)
+		}
+	}
+	if got := fs.Stats().UsedSectors; got != used {
+		t.Errorf("%d sectors used after removing the files, want %d", got, used)
+	}
+
+	// An open file keeps its sectors until it's closed
+	write("Open.Data")
+	f, err := fs.Open("Open.Data")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := fs.Remove("Open.Data"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if got := fs.Stats().UsedSectors; got == used {
+		t.Errorf("Sectors of an open file were freed")
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Content of the removed file differs")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if got := fs.Stats().UsedSectors; got != used {
+		t.Errorf("%d sectors used after closing the removed file, want %d", got, used)
+	}
+}
+
+func TestCorruptHeader(t *testing.T) {
+	path := newTestImage(t, 20)
+	fs := openTestFS(t, path)
+
+	f, err := fs.NewFile("Broken.Mod")
+	if err != nil {
+		t.Fatalf("NewFile failed: %v", err)
+	}
+	if err := f.Register(); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := fs.disk.PutSector(f.HeaderAddr(), disk.Sector{}); err != nil {
+		t.Fatalf("PutSector failed: %v", err)
+	}
+
+	fs = openTestFS(t, path)
+	_, err = fs.Find("Broken.Mod")
+	var corrupt *ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Find(broken): got %v, want ErrCorrupt", err)
+	}
+	if corrupt.Sector != f.HeaderAddr() {
+		t.Errorf("ErrCorrupt.Sector = %d, want %d", corrupt.Sector, f.HeaderAddr())
+	}
+
+	// A damaged file isn't silently replaced
+	for name, register := range map[string]func(*File) error{
+		"RegisterOrReplace":  fs.RegisterOrReplace,
+		"RegisterWithBackup": func(f *File) error { return fs.RegisterWithBackup(f, "Broken.Mod.Bak") },
+	} {
+		f, err := fs.NewFile("Broken.Mod")
+		if err != nil {
+			t.Fatalf("NewFile failed: %v", err)
+		}
+		if err := register(f); !errors.As(err, &corrupt) {
+			t.Errorf("%s(broken): got %v, want ErrCorrupt", name, err)
+		}
+		if entries := fs.ListEntries(); len(entries) != 1 || entries[0].HeaderAddr != corrupt.Sector {
+			t.Errorf("Entries after %s(broken): %v", name, entries)
+		}
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	fs := openTestFS(t, newTestImage(t, 100))
+
+	f, err := fs.Create("Stream.Data")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	data := testData(3 * sectorSize)
+	if _, err := io.Copy(f, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	// Seek relative to the end and overwrite the last bytes
+	if pos, err := f.Seek(-4, io.SeekEnd); err != nil || pos != int64(len(data)-4) {
+		t.Fatalf("Seek: got %d, %v, want %d", pos, err, len(data)-4)
+	}
+	if _, err := f.Write([]byte("tail")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	copy(data[len(data)-4:], "tail")
+
+	h, err := fs.Open("Stream.Data")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	got, err := io.ReadAll(h)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Read back data differs from what was written")
+	}
+
+	// ReadAt across the end of the file returns what is there, and io.EOF
+	buf := make([]byte, 10)
+	n, err := h.ReadAt(buf, int64(len(data)-6))
+	if n != 6 || err != io.EOF {
+		t.Errorf("ReadAt at end: got %d, %v, want 6, EOF", n, err)
+	}
+	if !bytes.Equal(buf[:n], data[len(data)-6:]) {
+		t.Errorf("ReadAt at end: got %q, want %q", buf[:n], data[len(data)-6:])
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	path := newTestImage(t, 1000)
+	fs := openTestFS(t, path)
+	usedBefore := fs.numUsedSectors
+
+	f, err := fs.Create("Trunc.Data")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	// Needs two index sectors
+	data := testData((secTabSize + indexSize + 10) * sectorSize)
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	for _, size := range []int{(secTabSize + 5) * sectorSize, 3*sectorSize + 17, 100, 0} {
+		if err := f.Truncate(int64(size)); err != nil {
+			t.Fatalf("Truncate(%d) failed: %v", size, err)
+		}
+		if f.Size() != uint32(size) {
+			t.Fatalf("Size() = %d after Truncate(%d)", f.Size(), size)
+		}
+		want := numSectors(uint32(size))
+		if size > secTabSize*sectorSize {
+			want++ // index sector
+		}
+		if got := fs.numUsedSectors - usedBefore; got != want {
+			t.Errorf("After Truncate(%d): %d sectors in use, want %d", size, got, want)
+		}
+		got := make([]byte, size)
+		if _, err := f.ReadAt(got, 0); err != nil && size > 0 {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+		if !bytes.Equal(got, data[:size]) {
+			t.Errorf("After Truncate(%d): content differs", size)
+		}
+	}
+
+	// An index sector without entries, as left by a failed grow, is freed
+	// too, even if the file stays within the sector table
+	if err := f.Truncate(secTabSize*sectorSize - headerSize); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	idx, err := fs.AllocSector(0)
+	if err != nil {
+		t.Fatalf("AllocSector failed: %v", err)
+	}
+	if err := fs.disk.PutSector(idx, disk.Sector{}); err != nil {
+		t.Fatal(err)
+	}
+	f.st.header.setExtensionTable([]uint32{idx})
+	if err := f.Truncate(sectorSize); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if free, _ := fs.IsSectorFree(idx); !free {
+		t.Errorf("Empty index sector %d not freed", idx)
+	}
+
+	// Growing again must not bring back the old content
+	if err := f.Truncate(5000); err != nil {
+		t.Fatalf("Truncate(5000) failed: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("end"), 9000); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	want := make([]byte, 9003)
+	copy(want[9000:], "end")
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	fs = openTestFS(t, path)
+	f, err = fs.Open("Trunc.Data")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if got, want := fs.numUsedSectors-usedBefore, numSectors(9003); got != want {
+		t.Errorf("After reopening: %d sectors in use, want %d", got, want)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Grown file doesn't read back as zeros")
+	}
+}
+
+func TestIndexSectorPlacement(t *testing.T) {
+	fs := openTestFS(t, newTestImage(t, 1000))
+	f, err := fs.Create("Index.Data")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	// The index sector is allocated along with the data sectors, so it
+	// doesn't end up after them
+	if _, err := f.Write(testData((secTabSize + 10) * sectorSize)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if n, err := f.Fragments(); err != nil || n != 1 {
+		t.Errorf("Fragments() = %d, %v, want 1", n, err)
+	}
+}
+
+func TestAllocators(t *testing.T) {
+	// fileSectors returns the addresses of all of f's sectors, header first.
+	fileSectors := func(f *File) []uint32 {
+		var res []uint32
+		for i := uint32(0); i < numSectors(f.Size()); i++ {
+			addr, err := f.getSectorAddr(i)
+			if err != nil {
+				t.Fatalf("getSectorAddr(%d) failed: %v", i, err)
+			}
+			res = append(res, addr)
+		}
+		return res
+	}
+	contiguous := func(secs []uint32) bool {
+		for i := 1; i < len(secs); i++ {
+			if secs[i] != secs[i-1]+disk.SectorMultiplier {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, tc := range []struct {
+		name       string
+		alloc      Allocator
+		contiguous bool
+	}{
+		{"next", NextFreeAllocator{}, true},
+		{"firstfit", FirstFitAllocator{}, true},
+		{"random", NewRandomAllocator(1), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := openTestFS(t, newTestImage(t, 1000))
+			fs.SetAllocator(tc.alloc)
+
+			f, err := fs.Create("Alloc.Data")
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			if _, err := f.Write(testData(20 * sectorSize)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			secs := fileSectors(f)
+			if got := contiguous(secs); got != tc.contiguous {
+				t.Errorf("Sectors %v: contiguous = %v, want %v", secs, got, tc.contiguous)
+			}
+		})
+	}
+
+	// With a hole that is too small, first fit skips it while next-free
+	// fills it.
+	for _, tc := range []struct {
+		name       string
+		alloc      Allocator
+		contiguous bool
+	}{
+		{"next", NextFreeAllocator{}, false},
+		{"firstfit", FirstFitAllocator{}, true},
+	} {
+		t.Run(tc.name+"/hole", func(t *testing.T) {
+			fs := openTestFS(t, newTestImage(t, 1000))
+			fs.SetAllocator(tc.alloc)
+
+			f, err := fs.NewFile("Alloc.Data")
+			if err != nil {
+				t.Fatalf("NewFile failed: %v", err)
+			}
+			// Occupy the sectors after the header, then free two of them
+			var used []uint32
+			for i := 0; i < 10; i++ {
+				addr, err := fs.AllocSector(0)
+				if err != nil {
+					t.Fatalf("AllocSector failed: %v", err)
+				}
+				used = append(used, addr)
+			}
+			fs.FreeSector(used[3])
+			fs.FreeSector(used[4])
+
+			if _, err := f.Write(testData(5 * sectorSize)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			data := fileSectors(f)[1:]
+			if got := contiguous(data); got != tc.contiguous {
+				t.Errorf("Data sectors %v: contiguous = %v, want %v", data, got, tc.contiguous)
+			}
+		})
+	}
+}
+
+func TestReserve(t *testing.T) {
+	const size = 40 * sectorSize
+	for _, tc := range []struct {
+		name         string
+		reserve      bool
+		maxFragments int
+	}{
+		{"reserved", true, 1},
+		// Without a reservation, the allocator expects the file to keep
+		// growing and soon stops filling the holes
+		{"growing", false, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := openTestFS(t, newTestImage(t, 1000))
+			fs.SetAllocator(FirstFitAllocator{})
+
+			// Holes of one sector at the start of the disk
+			var holes []uint32
+			for i := 0; i < 60; i++ {
+				addr, err := fs.AllocSector(0)
+				if err != nil {
+					t.Fatalf("AllocSector failed: %v", err)
+				}
+				if i%3 == 0 {
+					holes = append(holes, addr)
+				}
+			}
+			for _, addr := range holes {
+				fs.FreeSector(addr)
+			}
+			f, err := fs.Create("Reserve.Data")
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			// Nothing fits right after the header
+			if _, err := fs.AllocSector(f.HeaderAddr()); err != nil {
+				t.Fatalf("AllocSector failed: %v", err)
+			}
+			used := fs.numUsedSectors
+
+			if tc.reserve {
+				if err := f.Reserve(size); err != nil {
+					t.Fatalf("Reserve failed: %v", err)
+				}
+				if got, want := fs.numUsedSectors-used, numSectors(size)-1; got != want {
+					t.Errorf("Reserve allocated %d sectors, want %d", got, want)
+				}
+			}
+			data := testData(size)
+			for off := 0; off < size; off += sectorSize / 2 {
+				if _, err := f.Write(data[off : off+sectorSize/2]); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+			}
+			if err := f.Reserve(0); err != nil {
+				t.Fatalf("Reserve(0) failed: %v", err)
+			}
+			if got, want := fs.numUsedSectors-used, numSectors(size)-1; got != want {
+				t.Errorf("File uses %d new sectors, want %d", got, want)
+			}
+			secs, err := f.Sectors()
+			if err != nil {
+				t.Fatalf("Sectors failed: %v", err)
+			}
+			secs = secs[1:]
+			if n := fragments(secs); n > tc.maxFragments {
+				t.Errorf("Data sectors %v are in %d fragments, want at most %d", secs, n, tc.maxFragments)
+			}
+			got := make([]byte, size)
+			if _, err := f.ReadAt(got, 0); err != nil {
+				t.Fatalf("ReadAt failed: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("Content differs")
+			}
+		})
+	}
+
+	// Reserved sectors that aren't used are given back when the file is
+	// discarded
+	fs := openTestFS(t, newTestImage(t, 200))
+	used := fs.numUsedSectors
+	f, err := fs.NewFile("Gone.Data")
+	if err != nil {
+		t.Fatalf("NewFile failed: %v", err)
+	}
+	if err := f.Reserve(10 * sectorSize); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	if err := f.Discard(); err != nil {
+		t.Fatalf("Discard failed: %v", err)
+	}
+	if fs.numUsedSectors != used {
+		t.Errorf("%d sectors in use after Discard, want %d", fs.numUsedSectors, used)
+	}
+}
+
+func TestHeaderPlacement(t *testing.T) {
+	fs := openTestFS(t, newTestImage(t, 1000))
+	// A hole before the first file
+	hole, err := fs.AllocSector(0)
+	if err != nil {
+		t.Fatalf("AllocSector failed: %v", err)
+	}
+	a, err := fs.Create("A.Data")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := a.Write(testData(5 * sectorSize)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	fs.FreeSector(hole)
+
+	// The next header goes after the previous file, not into the hole
+	b, err := fs.Create("B.Data")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	secs, err := a.Sectors()
+	if err != nil {
+		t.Fatalf("Sectors failed: %v", err)
+	}
+	if last := secs[len(secs)-1]; b.HeaderAddr() != last+disk.SectorMultiplier {
+		t.Errorf("Header of B.Data is at %d, want %d", b.HeaderAddr(), last+disk.SectorMultiplier)
+	}
+}
+
+func TestDefrag(t *testing.T) {
+	path := newTestImage(t, 2000)
+	fs := openTestFS(t, path)
+	fs.SetAllocator(NewRandomAllocator(1))
+
+	sizes := map[string]int{
+		"Small.Data": 3 * sectorSize,
+		"Large.Data": (secTabSize + indexSize + 10) * sectorSize, // two index sectors
+		"Other.Mod":  10 * sectorSize,
+	}
+	for name, size := range sizes {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("Create(%s) failed: %v", name, err)
+		}
+		if _, err := f.Write(testData(size)); err != nil {
+			t.Fatalf("Write(%s) failed: %v", name, err)
+		}
+	}
+	usedBefore := fs.numUsedSectors
+
+	var done int
+	stats, err := fs.Defrag(NameMatches("*.Data"), func(_, _ int, _ string) { done++ })
+	if err != nil {
+		t.Fatalf("Defrag failed: %v", err)
+	}
+	if stats.Files != 2 || done != 2 {
+		t.Errorf("Defrag looked at %d files (%d progress calls), want 2", stats.Files, done)
+	}
+	if stats.FragmentsAfter >= stats.FragmentsBefore {
+		t.Errorf("Fragments went from %d to %d", stats.FragmentsBefore, stats.FragmentsAfter)
+	}
+	if fs.numUsedSectors != usedBefore {
+		t.Errorf("%d sectors in use after defrag, want %d", fs.numUsedSectors, usedBefore)
+	}
+
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	fs = openTestFS(t, path)
+	if fs.numUsedSectors != usedBefore {
+		t.Errorf("%d sectors in use after reopening, want %d", fs.numUsedSectors, usedBefore)
+	}
+	for name, size := range sizes {
+		f, err := fs.Find(name)
+		if err != nil {
+			t.Fatalf("Find(%s) failed: %v", name, err)
+		}
+		frags, err := f.Fragments()
+		if err != nil {
+			t.Fatalf("Fragments(%s) failed: %v", name, err)
+		}
+		// The header stays where it is, so the rest might not fit right after it
+		if wantMoved := name != "Other.Mod"; wantMoved && frags > 2 {
+			t.Errorf("%s has %d fragments after defrag", name, frags)
+		} else if !wantMoved && frags == 1 {
+			t.Errorf("%s was defragmented although it doesn't match", name)
+		}
+		got, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("ReadAll(%s) failed: %v", name, err)
+		}
+		if !bytes.Equal(got, testData(size)) {
+			t.Errorf("%s: content changed by defrag", name)
+		}
+	}
+}
+
+func TestDefragSharedHeader(t *testing.T) {
+	fs := openTestFS(t, newTestImage(t, 500))
+	fs.SetAllocator(NewRandomAllocator(1))
+	f, err := fs.Create("A.Data")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := f.Write(testData(10 * sectorSize)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// A damaged directory can have two entries for the same header
+	fs.files = append(fs.files, dirEntry{name: "B.Data", adr: f.headerAddr})
+
+	done := make(chan error)
+	go func() {
+		_, err := fs.Defrag(AllFiles, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Defrag failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Defrag deadlocked")
+	}
+	if n, err := f.Fragments(); err != nil || n != 1 {
+		t.Errorf("Fragments() = %d, %v, want 1", n, err)
+	}
+}
+
+func TestAllocationMap(t *testing.T) {
+	fs := openTestFS(t, newTestImage(t, 1000))
+
+	f, err := fs.Create("Map.Data")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := f.Write(testData((secTabSize + 10) * sectorSize)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := fs.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	m, err := fs.AllocationMap()
+	if err != nil {
+		t.Fatalf("AllocationMap failed: %v", err)
+	}
+	wantData := int(numSectors(f.Size())) - 1
+	for u, want := range map[SectorUse]int{
+		SectorDirPage:  1,
+		SectorHeader:   1,
+		SectorIndex:    1,
+		SectorData:     wantData,
+		SectorReserved: 1, // the last sector
+		SectorFree:     1000 - wantData - 4,
+	} {
+		if got := m.Count(u); got != want {
+			t.Errorf("Count(%s) = %d, want %d", u, got, want)
+		}
+	}
+	if len(m.Files) != 1 || m.Files[0].Sectors != wantData+2 || m.Files[0].Runs != 1 {
+		t.Errorf("Files = %+v, want Map.Data with %d sectors in 1 run", m.Files, wantData+2)
+	}
+	if got, want := m.LargestFreeExtent(), 1000-wantData-4; got != want {
+		t.Errorf("LargestFreeExtent() = %d, want %d", got, want)
+	}
+	if m.DirDepth != 1 {
+		t.Errorf("DirDepth = %d, want 1", m.DirDepth)
+	}
+}
+
+func TestStats(t *testing.T) {
+	fs := openTestFS(t, newTestImage(t, 100))
+
+	for name, size := range map[string]int{"A.Data": 100, "B.Data": 5000} {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if _, err := f.Write(testData(size)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	s := fs.Stats()
+	// Directory page, last sector, 1 + 3 sectors for the files
+	want := Stats{
+		TotalSectors: 100, UsedSectors: 6, FreeSectors: 94,
+		TotalBytes: 100 * sectorSize, UsedBytes: 6 * sectorSize, FreeBytes: 94 * sectorSize,
+		Files: 2, DirPages: 1, LargestFile: "B.Data", LargestFileSize: 5000,
+	}
+	if s != want {
+		t.Errorf("Stats() = %+v, want %+v", s, want)
+	}
+}
+
+func TestRename(t *testing.T) {
+	path := newTestImage(t, 200)
+	fs := openTestFS(t, path)
+
+	data := testData(5 * sectorSize)
+	for _, name := range []string{"Old.Mod", "Other.Mod"} {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	old, _ := fs.Find("Old.Mod")
+	created := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := old.SetCreationTime(created); err != nil {
+		t.Fatalf("SetCreationTime failed: %v", err)
+	}
+
+	if err := fs.Rename("Old.Mod", "Other.Mod", false); !errors.Is(err, ErrExists) {
+		t.Errorf("Rename(to existing): got %v, want ErrExists", err)
+	}
+	if err := fs.Rename("Old.Mod", "0New", false); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("Rename(to invalid): got %v, want ErrInvalidName", err)
+	}
+	if err := fs.Rename("Missing.Mod", "New.Mod", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Rename(missing): got %v, want ErrNotFound", err)
+	}
+	if err := fs.Rename("Old.Mod", "New.Mod", false); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	fs = openTestFS(t, path)
+	if _, err := fs.Find("Old.Mod"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Find(Old.Mod) after rename: got %v, want ErrNotFound", err)
+	}
+	f, err := fs.Find("New.Mod")
+	if err != nil {
+		t.Fatalf("Find(New.Mod) failed: %v", err)
+	}
+	if f.Name() != "New.Mod" {
+		t.Errorf("Header of New.Mod says %s", f.Name())
+	}
+	if !f.CreationTime().Equal(created) {
+		t.Errorf("Creation time %v, want %v", f.CreationTime(), created)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Content differs")
+	}
+	if f.HeaderAddr() != old.HeaderAddr() {
+		t.Errorf("Rename moved the header from %d to %d", old.HeaderAddr(), f.HeaderAddr())
+	}
+
+	// Replacing an existing file; if the rename fails, the file stays
+	if err := fs.Rename("Missing.Mod", "Other.Mod", true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Rename(missing, replace): got %v, want ErrNotFound", err)
+	}
+	if _, err := fs.Find("Other.Mod"); err != nil {
+		t.Errorf("Find(Other.Mod) after failed rename: %v", err)
+	}
+	if err := fs.Rename("New.Mod", "Other.Mod", true); err != nil {
+		t.Fatalf("Rename(replace) failed: %v", err)
+	}
+	entries := fs.ListEntries()
+	if len(entries) != 1 || entries[0].Name != "Other.Mod" || entries[0].HeaderAddr != old.HeaderAddr() {
+		t.Errorf("Entries after replacing rename: %v", entries)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	path := newTestImage(t, 300)
+	fs := openTestFS(t, path)
+
+	write := func(name string, data []byte) *File {
+		t.Helper()
+		f, err := fs.NewFile(name)
+		if err != nil {
+			t.Fatalf("NewFile failed: %v", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		return f
+	}
+	oldData := testData(70 * sectorSize) // needs an index sector
+	newData := bytes.Repeat([]byte("new"), 1000)
+	if err := write("A.Mod", oldData).Register(); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	a, _ := fs.Find("A.Mod")
+	headerAddr := a.HeaderAddr()
+	usedBefore := fs.numUsedSectors
+
+	if err := fs.ReplaceContents("Missing.Mod", write("Missing.Mod", newData)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ReplaceContents(missing): got %v, want ErrNotFound", err)
+	}
+	if err := fs.ReplaceContents("A.Mod", a); err == nil {
+		t.Errorf("ReplaceContents with a registered file succeeded")
+	}
+	f := write("A.Mod", newData)
+	usedBefore += numSectors(uint32(len(newData))) // the file from the failed call above
+	if err := fs.ReplaceContents("A.Mod", f); err != nil {
+		t.Fatalf("ReplaceContents failed: %v", err)
+	}
+	if got, want := fs.numUsedSectors, usedBefore-numSectors(uint32(len(oldData)))-1+numSectors(uint32(len(newData))); got != want {
+		t.Errorf("%d sectors used after ReplaceContents, want %d", got, want)
+	}
+	if got, _ := io.ReadAll(a); !bytes.Equal(got, newData) {
+		t.Errorf("Open handle doesn't see the new contents")
+	}
+	if a, _ := fs.Find("A.Mod"); a.HeaderAddr() != headerAddr {
+		t.Errorf("ReplaceContents moved the header from %d to %d", headerAddr, a.HeaderAddr())
+	}
+
+	if err := fs.RegisterOrReplace(write("C.Mod", []byte("c"))); err != nil {
+		t.Fatalf("RegisterOrReplace(new file) failed: %v", err)
+	}
+	c, _ := fs.Find("C.Mod")
+	if err := fs.RegisterOrReplace(write("C.Mod", []byte("cc"))); err != nil {
+		t.Fatalf("RegisterOrReplace failed: %v", err)
+	}
+	if c2, _ := fs.Find("C.Mod"); c2.HeaderAddr() != c.HeaderAddr() {
+		t.Errorf("RegisterOrReplace moved the header from %d to %d", c.HeaderAddr(), c2.HeaderAddr())
+	}
+
+	if err := fs.RegisterWithBackup(write("B.Mod", []byte("b")), "B.Mod.Bak"); err != nil {
+		t.Fatalf("RegisterWithBackup(new file) failed: %v", err)
+	}
+	if err := fs.RegisterWithBackup(write("A.Mod", []byte("newest")), "A.Mod.Bak"); err != nil {
+		t.Fatalf("RegisterWithBackup failed: %v", err)
+	}
+	if err := fs.RegisterWithBackup(write("A.Mod", []byte("even newer")), "A.Mod.Bak"); err != nil {
+		t.Fatalf("RegisterWithBackup failed: %v", err)
+	}
+
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	fs = openTestFS(t, path)
+	for name, want := range map[string][]byte{
+		"A.Mod":     []byte("even newer"),
+		"A.Mod.Bak": []byte("newest"),
+		"B.Mod":     []byte("b"),
+		"C.Mod":     []byte("cc"),
+	} {
+		f, err := fs.Find(name)
+		if err != nil {
+			t.Fatalf("Find(%s) failed: %v", name, err)
+		}
+		if f.Name() != name {
+			t.Errorf("Header of %s says %s", name, f.Name())
+		}
+		got, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	files, _ := fs.ListFiles(AllFiles)
+	if len(files) != 4 {
+		t.Errorf("%d files after replacing, want 4", len(files))
+	}
+	if _, err := fs.Find("B.Mod.Bak"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Find(B.Mod.Bak): got %v, want ErrNotFound", err)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	path := newTestImage(t, 200)
+	fs := openTestFS(t, path)
+	now := time.Date(1998, 7, 6, 5, 4, 3, 0, time.UTC)
+	fs.SetClock(func() time.Time { return now })
+
+	check := func(name string, want time.Time) {
+		t.Helper()
+		f, err := fs.Find(name)
+		if err != nil {
+			t.Fatalf("Find(%s) failed: %v", name, err)
+		}
+		if got := f.CreationTime(); !got.Equal(want) {
+			t.Errorf("%s: time stamp is %v, want %v", name, got, want)
+		}
+	}
+
+	f, err := fs.Create("A.Text")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	created := now
+	check("A.Text", created)
+
+	// Contents that live in the header sector, and contents that don't
+	for _, off := range []int64{10, 3 * sectorSize} {
+		now = now.Add(time.Hour)
+		if _, err := f.WriteAt([]byte("data"), off); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+		check("A.Text", now)
+	}
+	now = now.Add(time.Hour)
+	if _, err := f.WriteAt([]byte("more"), 3*sectorSize); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	check("A.Text", now)
+
+	// Truncating to the same size doesn't change anything
+	modified := now
+	now = now.Add(time.Hour)
+	if err := f.Truncate(int64(f.Size())); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	check("A.Text", modified)
+	if err := f.Truncate(5); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	check("A.Text", now)
+
+	if err := f.SetCreationTime(created); err != nil {
+		t.Fatalf("SetCreationTime failed: %v", err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	fs = openTestFS(t, path)
+	check("A.Text", created)
+	f, _ = fs.Find("A.Text")
+	if got, want := f.ModTime(), time.Date(1998, 7, 6, 5, 4, 3, 0, time.Local); !got.Equal(want) {
+		t.Errorf("ModTime is %v, want %v", got, want)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "new.img")
+	d, err := disk.Create(path, disk.Layout{Size: 1024, Heads: 16, SectorsPerTrack: 63, PartitionStart: 1, Reserved: 1})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := Format(d); err != nil {
+		t.Fatalf("Format failed: %v", err)
+	}
+	fs, err := New(d)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if files, _ := fs.ListFiles(AllFiles); len(files) != 0 {
+		t.Errorf("New file system has %d files", len(files))
+	}
+	f, err := fs.Create("Test.Mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("MODULE Test; END Test."))
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	fs = openTestFS(t, path)
+	if _, err := fs.Find("Test.Mod"); err != nil {
+		t.Errorf("Find after reopening failed: %v", err)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	fs := openTestFS(t, newTestImage(t, 200))
+	f, err := fs.Create("Big.Obj")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	// 70 sectors need an index sector
+	size := 70*disk.SectorSize - headerSize - 100
+	if _, err := f.Write(testData(size)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := fs.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	root, err := fs.Disk().GetSector(RootDirPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := DecodeDirPage(root)
+	if !page.Valid || page.M != 1 || page.P0 != 0 || len(page.Entries) != 1 || page.Entries[0].Name != "Big.Obj" {
+		t.Fatalf("DecodeDirPage = %+v", page)
+	}
+
+	addr := page.Entries[0].Adr
+	sec, err := fs.Disk().GetSector(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := DecodeHeader(sec)
+	if !h.Valid || h.Name != "Big.Obj" || h.Aleng != 69 || h.Bleng != disk.SectorSize-100 {
+		t.Errorf("DecodeHeader = %+v", h)
+	}
+	if h.SecTab[0] != addr || h.SecTab[63] == 0 || h.ExtTab[0] == 0 || h.ExtTab[1] != 0 {
+		t.Errorf("DecodeHeader tables: sec %v, ext %v", h.SecTab, h.ExtTab)
+	}
+
+	sec, err = fs.Disk().GetSector(h.ExtTab[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := DecodeIndex(sec)
+	if len(index) != indexSize || index[5] == 0 || index[6] != 0 {
+		t.Errorf("DecodeIndex = %v", index[:8])
+	}
+	if DecodeDirPage(sec).Valid || DecodeHeader(sec).Valid {
+		t.Errorf("Index sector decodes as valid directory page or header")
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	path := newTestImage(t, 100)
+	fs := openTestFS(t, path)
+	for _, name := range []string{"A.Mod", "B.Mod", "X.Txt"} {
+		if _, err := fs.Create(name); err != nil {
+			t.Fatalf("Create(%s) failed: %v", name, err)
+		}
+	}
+	if err := fs.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	for _, name := range []string{"A.Mod", "B.Mod", "X.Txt"} {
+		if err := fs.Remove(name); err != nil {
+			t.Fatalf("Remove(%s) failed: %v", name, err)
+		}
+	}
+	if err := fs.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if free, _ := fs.IsSectorFree(dirRootAdr); free {
+		t.Errorf("Root page freed")
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	fs = openTestFS(t, path)
+	if files, _ := fs.ListFiles(AllFiles); len(files) != 0 {
+		t.Errorf("%d files after removing all of them", len(files))
+	}
+	f, err := fs.Create("Y.Txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if f.HeaderAddr() == dirRootAdr {
+		t.Errorf("New file got the root page as header")
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	fs = openTestFS(t, path)
+	if _, err := fs.Find("Y.Txt"); err != nil {
+		t.Errorf("Find after reopening failed: %v", err)
+	}
+}
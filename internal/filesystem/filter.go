@@ -0,0 +1,146 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filesystem
+
+import (
+	"strings"
+	"time"
+)
+
+// IsPattern tells whether s contains wildcards.
+func IsPattern(s string) bool {
+	return strings.ContainsAny(s, "*?")
+}
+
+// MatchPattern tells whether name matches pattern. Like in Oberon's
+// Directory command, "*" matches any sequence of characters; "?" matches a
+// single character. Matching is case sensitive.
+func MatchPattern(pattern, name string) bool {
+	// Classic backtracking over the last "*" seen
+	p, n := 0, 0
+	starP, starN := -1, 0
+	for n < len(name) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == name[n]):
+			p++
+			n++
+		case p < len(pattern) && pattern[p] == '*':
+			starP, starN = p, n
+			p++
+		case starP >= 0:
+			starN++
+			p, n = starP+1, starN
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// NameMatches returns a filter for the files whose name matches pattern,
+// see MatchPattern.
+func NameMatches(pattern string) ListFileFilter {
+	return func(f *File) bool {
+		return MatchPattern(pattern, f.Name())
+	}
+}
+
+// SizeBetween returns a filter for the files of at least min and at most
+// max bytes.
+func SizeBetween(min, max uint32) ListFileFilter {
+	return func(f *File) bool {
+		size := f.Size()
+		return size >= min && size <= max
+	}
+}
+
+// CreatedBefore returns a filter for the files created before t.
+func CreatedBefore(t time.Time) ListFileFilter {
+	return func(f *File) bool {
+		return f.CreationTime().Before(t)
+	}
+}
+
+// CreatedAfter returns a filter for the files created after t.
+func CreatedAfter(t time.Time) ListFileFilter {
+	return func(f *File) bool {
+		return f.CreationTime().After(t)
+	}
+}
+
+// Fragmented returns a filter for the files whose sectors aren't all
+// adjacent. Damaged files don't match.
+func Fragmented() ListFileFilter {
+	return func(f *File) bool {
+		n, err := f.Fragments()
+		return err == nil && n > 1
+	}
+}
+
+// UsesSectors returns a filter for the files that have a sector, including
+// header and index sectors, with an address between from and to. Damaged
+// files don't match.
+func UsesSectors(from, to uint32) ListFileFilter {
+	return func(f *File) bool {
+		secs, err := f.Sectors()
+		if err != nil {
+			return false
+		}
+		for _, addr := range secs {
+			if addr >= from && addr <= to {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// And returns a filter for the files that match all of filters.
+func And(filters ...ListFileFilter) ListFileFilter {
+	return func(f *File) bool {
+		for _, filter := range filters {
+			if !filter(f) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or returns a filter for the files that match any of filters.
+func Or(filters ...ListFileFilter) ListFileFilter {
+	return func(f *File) bool {
+		for _, filter := range filters {
+			if filter(f) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not returns a filter for the files that don't match filter.
+func Not(filter ListFileFilter) ListFileFilter {
+	return func(f *File) bool {
+		return !filter(f)
+	}
+}
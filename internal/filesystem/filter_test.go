@@ -0,0 +1,117 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filesystem
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.Mod", "System.Mod", true},
+		{"*.Mod", "System.Obj", false},
+		{"System.*", "System.Mod", true},
+		{"System.*", "SystemX.Mod", false},
+		{"*", "A", true},
+		{"Net*.Obj", "NetSystem.Obj", true},
+		{"Net*.Obj", "Net.Obj", true},
+		{"Net*.Obj", "Network.Obj.Bak", false},
+		{"*.*.Bak", "Net.Obj.Bak", true},
+		{"?.Mod", "A.Mod", true},
+		{"?.Mod", "AB.Mod", false},
+		{"system.mod", "System.Mod", false},
+		{"System.Mod", "System.Mod", true},
+		{"**a", "bba", true},
+	}
+	for _, tc := range tests {
+		if got := MatchPattern(tc.pattern, tc.name); got != tc.want {
+			t.Errorf("MatchPattern(%q, %q) = %v, want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	fs := openTestFS(t, newTestImage(t, 100))
+	for name, size := range map[string]int{"A.Mod": 10, "B.Mod": 5000, "A.Obj": 300} {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if _, err := f.Write(testData(size)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	b, err := fs.Find("B.Mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter ListFileFilter
+		want   []string
+	}{
+		{"name", NameMatches("*.Mod"), []string{"A.Mod", "B.Mod"}},
+		{"size", SizeBetween(100, 1000), []string{"A.Obj"}},
+		{"and", And(NameMatches("A.*"), SizeBetween(0, 100)), []string{"A.Mod"}},
+		{"or", Or(NameMatches("B.*"), SizeBetween(100, 1000)), []string{"A.Obj", "B.Mod"}},
+		{"not", Not(NameMatches("*.Mod")), []string{"A.Obj"}},
+		{"fragmented", Fragmented(), nil},
+		{"sectors", UsesSectors(b.HeaderAddr(), b.HeaderAddr()), []string{"B.Mod"}},
+	}
+	for _, tc := range tests {
+		files, err := fs.ListFiles(tc.filter)
+		if err != nil {
+			t.Fatalf("%s: ListFiles failed: %v", tc.name, err)
+		}
+		var got []string
+		for _, f := range files {
+			got = append(got, f.Name())
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFragmentedFilter(t *testing.T) {
+	fs := openTestFS(t, newTestImage(t, 100))
+	a, _ := fs.Create("A.Mod")
+	b, _ := fs.Create("B.Mod")
+	// Interleave the sectors of A and B
+	for i := 0; i < 3; i++ {
+		a.Write(testData(sectorSize))
+		b.Write(testData(sectorSize))
+	}
+	files, err := fs.ListFiles(Fragmented())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("Got %d fragmented files, want 2", len(files))
+	}
+	if entries := fs.ListEntries(); len(entries) != 2 || entries[0].HeaderAddr != a.HeaderAddr() {
+		t.Errorf("ListEntries returned %v", entries)
+	}
+}
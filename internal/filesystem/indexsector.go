@@ -55,3 +55,7 @@ func (i *indexSector) setEntry(index uint32, addr uint32) {
 	}
 	util.WriteLEUint32(i[:], int(index*4), addr)
 }
+
+func (i *indexSector) entry(index uint32) uint32 {
+	return util.ReadLEUint32(i[:], int(index*4))
+}
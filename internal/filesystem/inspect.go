@@ -0,0 +1,115 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filesystem
+
+import (
+	"time"
+
+	"github.com/asig/odit/internal/disk"
+	"github.com/asig/odit/internal/util"
+)
+
+// RootDirPage is the address of the root page of the directory.
+const RootDirPage = dirRootAdr
+
+// Disk returns the disk fs is on, for looking at it sector by sector.
+func (fs *FileSystem) Disk() *disk.Disk {
+	return fs.disk
+}
+
+// HeaderInfo is a file header sector as it is on disk, whether it's valid
+// or not.
+type HeaderInfo struct {
+	Mark   uint32
+	Valid  bool // Mark is right
+	Name   string
+	Aleng  uint16 // number of full sectors after the first one
+	Bleng  uint16 // bytes used in the last sector
+	Date   time.Time
+	ExtTab []uint32 // all entries, including the unused ones
+	SecTab []uint32
+}
+
+// DecodeHeader decodes sec as file header.
+func DecodeHeader(sec disk.Sector) HeaderInfo {
+	h := fileHeader(sec)
+	info := HeaderInfo{
+		Mark:   util.ReadLEUint32(sec[:], 0),
+		Valid:  h.IsValid(),
+		Name:   h.name(),
+		Aleng:  h.aleng(),
+		Bleng:  h.bleng(),
+		Date:   h.creationTime(),
+		ExtTab: make([]uint32, exTabSize),
+		SecTab: make([]uint32, secTabSize),
+	}
+	for i := range info.ExtTab {
+		info.ExtTab[i] = util.ReadLEUint32(sec[:], ofsExtTable+i*4)
+	}
+	for i := range info.SecTab {
+		info.SecTab[i] = h.sectorTableEntry(uint32(i))
+	}
+	return info
+}
+
+// DirPageInfo is a directory page as it is on disk.
+type DirPageInfo struct {
+	Mark    uint32
+	Valid   bool // Mark is right
+	M       uint16
+	P0      uint32
+	Entries []DirPageEntry // the first M ones, at most all of them
+}
+
+// DirPageEntry is an entry of a directory page.
+type DirPageEntry struct {
+	Name string
+	Adr  uint32 // of the file header
+	P    uint32 // of the page with the names after Name
+}
+
+// DecodeDirPage decodes sec as directory page.
+func DecodeDirPage(sec disk.Sector) DirPageInfo {
+	info := DirPageInfo{
+		Mark: util.ReadLEUint32(sec[:], 0),
+		M:    util.ReadLEUint16(sec[:], 4),
+		P0:   util.ReadLEUint32(sec[:], 8),
+	}
+	info.Valid = info.Mark == dirMark
+	for i := 0; i < int(min(info.M, dirPgSize)); i++ {
+		offset := 48 + i*dirEntrySize
+		info.Entries = append(info.Entries, DirPageEntry{
+			Name: util.StringFromBytes(sec[offset : offset+fnLength]),
+			Adr:  util.ReadLEUint32(sec[:], offset+fnLength),
+			P:    util.ReadLEUint32(sec[:], offset+fnLength+4),
+		})
+	}
+	return info
+}
+
+// DecodeIndex decodes sec as index sector, returning all entries including
+// the unused ones.
+func DecodeIndex(sec disk.Sector) []uint32 {
+	x := indexSector(sec)
+	entries := make([]uint32, indexSize)
+	for i := range entries {
+		entries[i] = x.entry(uint32(i))
+	}
+	return entries
+}
@@ -0,0 +1,222 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filesystem
+
+import (
+	"slices"
+	"sort"
+
+	"github.com/asig/odit/internal/disk"
+	"github.com/rs/zerolog/log"
+)
+
+// SectorUse tells what a sector is used for.
+type SectorUse uint8
+
+const (
+	SectorFree SectorUse = iota
+	SectorDirPage
+	SectorHeader
+	SectorIndex
+	SectorData
+	SectorReserved // in use, but not by anything in the directory
+)
+
+func (u SectorUse) String() string {
+	switch u {
+	case SectorFree:
+		return "free"
+	case SectorDirPage:
+		return "directory page"
+	case SectorHeader:
+		return "file header"
+	case SectorIndex:
+		return "index sector"
+	case SectorData:
+		return "data"
+	case SectorReserved:
+		return "reserved"
+	}
+	return "unknown"
+}
+
+// FileAllocation describes where a file is stored.
+type FileAllocation struct {
+	Name       string
+	HeaderAddr uint32
+	Sectors    int // including header and index sectors
+	Runs       int // runs of adjacent sectors
+}
+
+// AllocationMap describes what every sector of the file system is used for.
+type AllocationMap struct {
+	// Use is indexed by sector number, i.e. sector address / 29. Entry 0
+	// doesn't correspond to a sector and is always SectorReserved.
+	Use      []SectorUse
+	Files    []FileAllocation // in directory order; damaged files are left out
+	DirPages int
+	DirDepth int
+}
+
+// AllocationMap returns the current allocation map. It doesn't write to the
+// image: if the directory was changed, Use shows its pages on disk, while
+// DirPages and DirDepth are the figures it has once it's written.
+func (fs *FileSystem) AllocationMap() (*AllocationMap, error) {
+	fs.filesMutex.RLock()
+	defer fs.filesMutex.RUnlock()
+
+	m := &AllocationMap{
+		Use: make([]SectorUse, fs.disk.Size()/disk.SectorMultiplier+1),
+	}
+	m.DirPages, m.DirDepth = fs.dirShape_locked()
+	fs.sectorMapMutex.RLock()
+	for i := range m.Use {
+		if fs.sectorReservationMap.Test(uint32(i)) {
+			m.Use[i] = SectorReserved
+		}
+	}
+	fs.sectorMapMutex.RUnlock()
+
+	for _, addr := range fs.dirPages {
+		m.Use[addr/disk.SectorMultiplier] = SectorDirPage
+	}
+	for _, entry := range fs.files {
+		f, err := fs.NewFileFromFileHeader(entry.adr)
+		if err != nil {
+			log.Warn().Err(err).Msgf("File %s is damaged", entry.name)
+			continue
+		}
+		f.st.mutex.RLock()
+		secs, err := f.sectors_locked()
+		extTable := f.st.header.getExtensionTable()
+		f.st.mutex.RUnlock()
+		if err != nil {
+			log.Warn().Err(err).Msgf("File %s is damaged", entry.name)
+			continue
+		}
+
+		for _, addr := range secs[1:] {
+			m.Use[addr/disk.SectorMultiplier] = SectorData
+		}
+		for _, addr := range extTable {
+			m.Use[addr/disk.SectorMultiplier] = SectorIndex
+		}
+		m.Use[entry.adr/disk.SectorMultiplier] = SectorHeader
+		m.Files = append(m.Files, FileAllocation{
+			Name:       entry.name,
+			HeaderAddr: entry.adr,
+			Sectors:    len(secs),
+			Runs:       fragments(secs),
+		})
+	}
+	return m, nil
+}
+
+// dirShape_locked returns the number of pages and the depth of the
+// directory as it is written by Flush. The caller must hold filesMutex.
+func (fs *FileSystem) dirShape_locked() (pages, depth int) {
+	if !fs.filesDirty {
+		return len(fs.dirPages), fs.dirDepth
+	}
+	entries := slices.Clone(fs.files)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	root, _ := fs.buildDirTree(nil, entries,
+		func() (uint32, error) { pages++; return 0, nil },
+		func(*dirPage, *dirEntry) {},
+		func(*dirPage) {},
+	)
+	if root == nil {
+		// Just the empty root page
+		return 1, 1
+	}
+	return pages, root.depth()
+}
+
+// Count returns the number of sectors used for u.
+func (m *AllocationMap) Count(u SectorUse) int {
+	n := 0
+	for _, v := range m.Use[1:] {
+		if v == u {
+			n++
+		}
+	}
+	return n
+}
+
+// LargestFreeExtent returns the length of the longest run of free sectors.
+func (m *AllocationMap) LargestFreeExtent() int {
+	best, cur := 0, 0
+	for _, v := range m.Use[1:] {
+		if v == SectorFree {
+			cur++
+			best = max(best, cur)
+		} else {
+			cur = 0
+		}
+	}
+	return best
+}
+
+// Stats summarizes how much of the file system is used.
+type Stats struct {
+	TotalSectors uint32
+	UsedSectors  uint32
+	FreeSectors  uint32
+	TotalBytes   uint64
+	UsedBytes    uint64
+	FreeBytes    uint64
+
+	Files           int
+	DirPages        int
+	LargestFile     string // empty if there are no files
+	LargestFileSize uint32
+}
+
+// Stats returns the current usage figures. Damaged files are not taken
+// into account for the largest file.
+func (fs *FileSystem) Stats() Stats {
+	fs.filesMutex.RLock()
+	defer fs.filesMutex.RUnlock()
+
+	s := Stats{
+		TotalSectors: fs.disk.Size() / disk.SectorMultiplier,
+		Files:        len(fs.files),
+	}
+	s.DirPages, _ = fs.dirShape_locked()
+	fs.sectorMapMutex.RLock()
+	s.UsedSectors = fs.numUsedSectors
+	fs.sectorMapMutex.RUnlock()
+	s.FreeSectors = s.TotalSectors - s.UsedSectors
+	s.TotalBytes = uint64(s.TotalSectors) * sectorSize
+	s.UsedBytes = uint64(s.UsedSectors) * sectorSize
+	s.FreeBytes = uint64(s.FreeSectors) * sectorSize
+
+	for _, entry := range fs.files {
+		f, err := fs.NewFileFromFileHeader(entry.adr)
+		if err != nil {
+			continue
+		}
+		if size := f.Size(); s.LargestFile == "" || size > s.LargestFileSize {
+			s.LargestFile, s.LargestFileSize = entry.name, size
+		}
+	}
+	return s
+}
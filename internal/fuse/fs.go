@@ -20,12 +20,16 @@ package fuse
 
 import (
 	"context"
+	"errors"
+	"io"
 	"os"
 	"sync"
 	"syscall"
+	"time"
 
 	fuse "bazil.org/fuse"
 	fuse_fs "bazil.org/fuse/fs"
+	"github.com/asig/odit/internal/disk"
 	"github.com/asig/odit/internal/filesystem"
 	"github.com/rs/zerolog/log"
 )
@@ -54,6 +58,7 @@ type fileNode struct {
 
 type fileHandle struct {
 	file *fileNode
+	open *filesystem.File // keeps the file's sectors if it's removed
 }
 
 func NewFS(fs *filesystem.FileSystem) fuse_fs.FS {
@@ -64,10 +69,46 @@ func NewFS(fs *filesystem.FileSystem) fuse_fs.FS {
 	}
 }
 
+// errno maps file system errors to the error numbers FUSE reports to the
+// kernel. Unknown errors end up as EIO.
+func errno(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, filesystem.ErrNotFound):
+		return syscall.ENOENT
+	case errors.Is(err, filesystem.ErrExists):
+		return syscall.EEXIST
+	case errors.Is(err, filesystem.ErrInvalidName):
+		return syscall.EINVAL
+	case errors.Is(err, filesystem.ErrDiskFull):
+		return syscall.ENOSPC
+	case errors.Is(err, filesystem.ErrFileTooLarge):
+		return syscall.EFBIG
+	}
+	return syscall.EIO
+}
+
 func (f filesys) Root() (fuse_fs.Node, error) {
 	return &dirNode{fs: f.fs, uid: f.uid, gid: f.gid}, nil
 }
 
+func (f filesys) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	log.Debug().Msgf("FUSE Statfs")
+
+	stats := f.fs.Stats()
+	resp.Blocks = uint64(stats.TotalSectors)
+	resp.Bfree = uint64(stats.FreeSectors)
+	resp.Bavail = uint64(stats.FreeSectors)
+	// Every file needs a header sector, so each free sector is a free inode
+	resp.Ffree = uint64(stats.FreeSectors)
+	resp.Files = resp.Ffree + uint64(stats.Files)
+	resp.Bsize = disk.SectorSize
+	resp.Frsize = disk.SectorSize
+	resp.Namelen = filesystem.MaxNameLength
+	return nil
+}
+
 func (d *dirNode) Attr(ctx context.Context, a *fuse.Attr) error {
 	log.Debug().Msgf("FUSE Attr for root directory")
 
@@ -90,11 +131,7 @@ func (d *dirNode) Lookup(ctx context.Context, name string) (fuse_fs.Node, error)
 	file, err := d.fs.Find(name)
 	if err != nil {
 		log.Debug().Msgf("FUSE Lookup: error finding file %s: %v", name, err)
-		return nil, err
-	}
-	if file == nil {
-		log.Debug().Msgf("FUSE Lookup: file %s not found", name)
-		return nil, syscall.ENOENT
+		return nil, errno(err)
 	}
 
 	return &fileNode{file: file, uid: d.uid, gid: d.gid}, nil
@@ -109,7 +146,7 @@ func (d *dirNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	var res []fuse.Dirent
 	entries, err := d.fs.ListFiles(filesystem.AllFiles)
 	if err != nil {
-		return nil, err
+		return nil, errno(err)
 	}
 	for _, entry := range entries {
 		res = append(res, fuse.Dirent{
@@ -126,25 +163,28 @@ func (d *dirNode) Create(ctx context.Context, req *fuse.CreateRequest, resp *fus
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
-	file, err := d.fs.Find(req.Name)
-	if err != nil {
-		log.Debug().Msgf("FUSE Create: error finding file %s: %v", req.Name, err)
-		return nil, nil, err
-	}
-	if file != nil {
+	_, err := d.fs.Find(req.Name)
+	if err == nil {
 		log.Debug().Msgf("FUSE Create: file %s already exists", req.Name)
 		return nil, nil, syscall.EEXIST
 	}
+	if !errors.Is(err, filesystem.ErrNotFound) {
+		log.Debug().Msgf("FUSE Create: error finding file %s: %v", req.Name, err)
+		return nil, nil, errno(err)
+	}
 
 	f, err := d.fs.NewFile(req.Name)
 	if err != nil {
 		log.Debug().Msgf("FUSE Create: error creating file %s: %v", req.Name, err)
-		return nil, nil, err
+		return nil, nil, errno(err)
+	}
+	if err := f.Register(); err != nil {
+		log.Debug().Msgf("FUSE Create: error registering file %s: %v", req.Name, err)
+		return nil, nil, errno(err)
 	}
-	f.Register()
 
 	node := &fileNode{file: f, uid: d.uid, gid: d.gid}
-	handle := &fileHandle{file: node}
+	handle := &fileHandle{file: node, open: f.Open()}
 	return node, handle, nil
 }
 
@@ -154,17 +194,11 @@ func (d *dirNode) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
-	f, err := d.fs.Find(req.Name)
+	err := d.fs.Remove(req.Name)
 	if err != nil {
-		log.Debug().Msgf("FUSE Remove: error finding file %s: %v", req.Name, err)
-		return err
-	}
-	if f == nil {
-		log.Debug().Msgf("FUSE Remove: file %s not found", req.Name)
-		return syscall.ENOENT
+		log.Debug().Msgf("FUSE Remove: error removing file %s: %v", req.Name, err)
+		return errno(err)
 	}
-
-	d.fs.Remove(req.Name)
 	return nil
 }
 
@@ -185,21 +219,12 @@ func (d *dirNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fu
 		return syscall.EXDEV
 	}
 
-	oldF, err := d.fs.Find(req.OldName)
-	if err != nil {
-		log.Debug().Msgf("FUSE Rename: error finding file %s: %v", req.OldName, err)
-		return err
-	}
-	if oldF == nil {
-		log.Debug().Msgf("FUSE Rename: file %s not found", req.OldName)
-		return syscall.ENOENT
+	// Like rename(2), replace an existing file
+	if err := d.fs.Rename(req.OldName, req.NewName, true); err != nil {
+		log.Debug().Msgf("FUSE Rename: error renaming %s to %s: %v", req.OldName, req.NewName, err)
+		return errno(err)
 	}
-
-	oldF.Unregister()
-	oldF.SetName(req.NewName)
-	err = oldF.Register()
-
-	return err
+	return nil
 }
 
 func (f *fileNode) Attr(ctx context.Context, a *fuse.Attr) error {
@@ -211,22 +236,57 @@ func (f *fileNode) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Inode = uint64(f.file.HeaderAddr())
 	a.Mode = 0666 // regular file with rw-rw-rw- permissions
 	a.Size = uint64(f.file.Size())
-	creationTime := f.file.CreationTime()
-	a.Ctime = creationTime
-	a.Mtime = creationTime
-	a.Atime = creationTime
+	modTime := f.file.ModTime()
+	a.Ctime = modTime
+	a.Mtime = modTime
+	a.Atime = modTime
 	a.Uid = f.uid
 	a.Gid = f.gid
 	return nil
 }
 
+func (f *fileNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	log.Debug().Msgf("FUSE Setattr for file %s: req = %+v", f.file.Name(), req)
+
+	if req.Valid.Size() {
+		f.mutex.Lock()
+		err := f.file.Truncate(int64(req.Size))
+		f.mutex.Unlock()
+		if err != nil {
+			log.Debug().Msgf("FUSE Setattr for file %s: error truncating: %v", f.file.Name(), err)
+			return errno(err)
+		}
+	}
+	// Oberon has a single time stamp, so utimens only sets the mtime
+	if req.Valid.Mtime() || req.Valid.MtimeNow() {
+		t := req.Mtime
+		if req.Valid.MtimeNow() {
+			t = time.Now()
+		}
+		f.mutex.Lock()
+		err := f.file.SetCreationTime(t.Local())
+		f.mutex.Unlock()
+		if err != nil {
+			log.Debug().Msgf("FUSE Setattr for file %s: error setting time: %v", f.file.Name(), err)
+			return errno(err)
+		}
+	}
+	return f.Attr(ctx, &resp.Attr)
+}
+
 func (f *fileNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fuse_fs.Handle, error) {
 	log.Debug().Msgf("FUSE Open for file %s: req = %+v", f.file.Name(), req)
 
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
-	return &fileHandle{file: f}, nil
+	if req.Flags&fuse.OpenTruncate != 0 {
+		if err := f.file.Truncate(0); err != nil {
+			log.Debug().Msgf("FUSE Open for file %s: error truncating: %v", f.file.Name(), err)
+			return nil, errno(err)
+		}
+	}
+	return &fileHandle{file: f, open: f.file.Open()}, nil
 }
 
 func (h *fileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
@@ -235,23 +295,14 @@ func (h *fileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse
 	h.file.mutex.RLock()
 	defer h.file.mutex.RUnlock()
 
-	if req.Offset >= int64(h.file.file.Size()) {
-		log.Debug().Msgf("FUSE Read for file %s: offset beyond EOF, returning empty data", h.file.file.Name())
-		resp.Data = []byte{}
-		return nil
-	}
-	if req.Offset+int64(req.Size) > int64(h.file.file.Size()) {
-		log.Debug().Msgf("FUSE Read for file %s: adjusting read size to avoid EOF", h.file.file.Name())
-		req.Size = int(h.file.file.Size() - uint32(req.Offset))
-		log.Debug().Msgf("FUSE Read for file %s: new size = %d", h.file.file.Name(), req.Size)
-	}
-	buf, err := h.file.file.ReadAt(uint32(req.Offset), uint32(req.Size))
-	if err != nil {
+	buf := make([]byte, req.Size)
+	n, err := h.file.file.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
 		log.Debug().Msgf("FUSE Read for file %s: error reading data: %v", h.file.file.Name(), err)
-		return err
+		return errno(err)
 	}
-	log.Debug().Msgf("FUSE Read for file %s: read %d bytes", h.file.file.Name(), len(buf))
-	resp.Data = buf
+	log.Debug().Msgf("FUSE Read for file %s: read %d bytes", h.file.file.Name(), n)
+	resp.Data = buf[:n]
 	return nil
 }
 
@@ -261,8 +312,12 @@ func (h *fileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fu
 	h.file.mutex.Lock()
 	defer h.file.mutex.Unlock()
 
-	h.file.file.WriteAt(uint32(req.Offset), req.Data)
-	resp.Size = len(req.Data)
+	n, err := h.file.file.WriteAt(req.Data, req.Offset)
+	resp.Size = n
+	if err != nil {
+		log.Debug().Msgf("FUSE Write for file %s: error writing data: %v", h.file.file.Name(), err)
+		return errno(err)
+	}
 	return nil
 }
 
@@ -273,5 +328,5 @@ func (h *fileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
 
 func (h *fileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
 	log.Debug().Msgf("FUSE Release for file %s", h.file.file.Name())
-	return nil
+	return errno(h.open.Close())
 }
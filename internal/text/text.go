@@ -0,0 +1,158 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package text decodes Oberon Text documents, as written by Texts.Store.
+package text
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Tags at the start of a text file
+const (
+	tag   = 0xF1 // Project Oberon
+	tagV4 = 0xF0 // Oberon V4, followed by the version byte 0x01
+)
+
+var (
+	ErrNotText = errors.New("not an Oberon text")
+	ErrDamaged = errors.New("damaged text header")
+)
+
+// IsText tells whether data starts like an Oberon Text document.
+func IsText(data []byte) bool {
+	return len(data) >= 1 && data[0] == tag || len(data) >= 2 && data[0] == tagV4 && data[1] == 0x01
+}
+
+// Decode returns the characters of the Oberon Text document in data,
+// without the header that holds the fonts, colors and offsets of the runs.
+// Lines end with "\n" instead of CR. It fails with ErrNotText if data isn't
+// a text document, and with ErrDamaged if its header can't be read.
+func Decode(data []byte) (string, error) {
+	var start, length int
+	var err error
+	switch {
+	case len(data) >= 1 && data[0] == tag:
+		start, length, err = readRuns(data, 1, false)
+	case IsText(data):
+		start, length, err = readRuns(data, 2, true)
+	default:
+		return "", ErrNotText
+	}
+	if err != nil {
+		return "", err
+	}
+	return decodeChars(data[start : start+length]), nil
+}
+
+// readRuns reads the header starting at pos, and returns where the
+// characters start and how many there are.
+func readRuns(data []byte, pos int, v4 bool) (int, int, error) {
+	readInt := func() (int, error) {
+		if pos+4 > len(data) {
+			return 0, ErrDamaged
+		}
+		v := int32(binary.LittleEndian.Uint32(data[pos:]))
+		pos += 4
+		return int(v), nil
+	}
+	readByte := func() (byte, error) {
+		if pos >= len(data) {
+			return 0, ErrDamaged
+		}
+		pos++
+		return data[pos-1], nil
+	}
+
+	start, err := readInt()
+	if err != nil {
+		return 0, 0, err
+	}
+	if start < pos || start > len(data) {
+		return 0, 0, ErrDamaged
+	}
+	// Oberon V4 texts can contain elements, which are stored in between;
+	// take everything after the header then.
+	length, elements := 0, false
+	fonts := 1
+	for {
+		fno, err := readByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		if fno == 0 {
+			break
+		}
+		if int(fno) == fonts {
+			// Font name, 0X terminated
+			end := bytes.IndexByte(data[pos:], 0)
+			if end < 0 {
+				return 0, 0, ErrDamaged
+			}
+			pos += end + 1
+			fonts++
+		} else if int(fno) > fonts {
+			return 0, 0, ErrDamaged
+		}
+		pos += 2 // color and vertical offset
+		n, err := readInt()
+		if err != nil {
+			return 0, 0, err
+		}
+		if n < 0 {
+			if !v4 {
+				return 0, 0, ErrDamaged
+			}
+			elements = true
+			break
+		}
+		length += n
+	}
+	if elements || start+length > len(data) {
+		if !v4 {
+			return 0, 0, ErrDamaged
+		}
+		length = len(data) - start
+	}
+	return start, length, nil
+}
+
+// decodeChars turns Oberon's CRs into newlines, and its characters above
+// 7FX into Unicode.
+func decodeChars(data []byte) string {
+	var sb strings.Builder
+	for _, b := range data {
+		switch {
+		case b == '\r':
+			sb.WriteByte('\n')
+		case b < 0x80:
+			sb.WriteByte(b)
+		case int(b-0x80) < len(oberonChars):
+			sb.WriteRune(oberonChars[b-0x80])
+		default:
+			sb.WriteRune(rune(b))
+		}
+	}
+	return sb.String()
+}
+
+// oberonChars are the characters from 80X on in Oberon's fonts.
+var oberonChars = []rune("ÄÖÜäöüâêîôûàèìòùéëïçáñß")
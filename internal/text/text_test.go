@@ -0,0 +1,90 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package text
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+type run struct {
+	font string // "" to reuse the previous font
+	len  int
+}
+
+// makeText builds a Project Oberon text like Texts.Store does.
+func makeText(chars string, runs []run) []byte {
+	header := []byte{tag, 0, 0, 0, 0}
+	fonts := 0
+	for _, r := range runs {
+		if r.font != "" {
+			fonts++
+			header = append(header, byte(fonts))
+			header = append(header, r.font...)
+			header = append(header, 0)
+		} else {
+			header = append(header, byte(fonts))
+		}
+		header = append(header, 0, 0)
+		header = binary.LittleEndian.AppendUint32(header, uint32(r.len))
+	}
+	header = append(header, 0)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(chars)))
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(header)))
+	return append(header, chars...)
+}
+
+func TestDecode(t *testing.T) {
+	chars := "MODULE M;\rIMPORT Texts;\r  PROCEDURE P*;\rEND M.\r"
+	data := makeText(chars, []run{{"Oberon10.Scn.Fnt", 10}, {"Oberon10b.Scn.Fnt", 16}, {"", len(chars) - 26}})
+	got, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	want := "MODULE M;\nIMPORT Texts;\n  PROCEDURE P*;\nEND M.\n"
+	if got != want {
+		t.Errorf("Decode = %q, want %q", got, want)
+	}
+
+	if got, err := Decode(makeText("Gr\x85\x96e", []run{{"Oberon10.Scn.Fnt", 5}})); err != nil || got != "Grüße" {
+		t.Errorf("Decode = %q, %v, want %q", got, err, "Grüße")
+	}
+
+	// Oberon V4, with the characters after an element taken as they are
+	v4 := []byte{tagV4, 1, 0, 0, 0, 0, 1}
+	v4 = append(v4, "Syntax10.Scn.Fnt\x00"...)
+	v4 = append(v4, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 0)
+	binary.LittleEndian.PutUint32(v4[2:], uint32(len(v4)))
+	v4 = append(v4, "abc\rdef"...)
+	if got, err := Decode(v4); err != nil || got != "abc\ndef" {
+		t.Errorf("Decode(V4) = %q, %v, want %q", got, err, "abc\ndef")
+	}
+
+	if _, err := Decode([]byte("MODULE M;")); !errors.Is(err, ErrNotText) {
+		t.Errorf("Decode(ASCII) = %v, want ErrNotText", err)
+	}
+	unknownFont := makeText("abc", []run{{"F", 3}})
+	unknownFont[5] = 2
+	for _, damaged := range [][]byte{data[:3], data[:20], data[:len(data)-1], unknownFont} {
+		if _, err := Decode(damaged); !errors.Is(err, ErrDamaged) {
+			t.Errorf("Decode(%q) = %v, want ErrDamaged", damaged, err)
+		}
+	}
+}
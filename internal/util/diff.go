@@ -0,0 +1,171 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+type diffKind byte
+
+const (
+	diffEqual  diffKind = ' '
+	diffDelete diffKind = '-'
+	diffInsert diffKind = '+'
+)
+
+type diffOp struct {
+	kind diffKind
+	a, b int // line indices in a and b; for inserts, a is where it goes
+}
+
+// diffLines returns the shortest edit script turning a into b, using Myers'
+// algorithm.
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	off := max + 1
+	v := make([]int, 2*max+3)
+	// trace[d] is v[off-d-1 .. off+d+1] before step d
+	var trace [][]int
+
+	var d int
+search:
+	for d = 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk back from the end
+	var ops []diffOp
+	x, y := n, m
+	for ; d >= 0; d-- {
+		tv := trace[d]
+		get := func(k int) int { return tv[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := get(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{diffEqual, x, y})
+		}
+		if d > 0 {
+			if x == prevX {
+				y--
+				ops = append(ops, diffOp{diffInsert, x, y})
+			} else {
+				x--
+				ops = append(ops, diffOp{diffDelete, x, y})
+			}
+		}
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// UnifiedDiff returns the differences between a and b in unified diff
+// format, with context lines around each change. It returns "" if a and b
+// are equal.
+func UnifiedDiff(nameA, nameB string, a, b []string, context int) string {
+	ops := diffLines(a, b)
+
+	var sb strings.Builder
+	for i := 0; i < len(ops); {
+		if ops[i].kind == diffEqual {
+			i++
+			continue
+		}
+		// A hunk starts context lines before the change and goes on as long
+		// as changes are less than 2*context lines apart.
+		start := max(i-context, 0)
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != diffEqual {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+		end = min(end+context, len(ops))
+
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		aStart, bStart := ops[start].a, ops[start].b
+		aLen, bLen := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != diffInsert {
+				aLen++
+			}
+			if op.kind != diffDelete {
+				bLen++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+		for _, op := range ops[start:end] {
+			line := ""
+			if op.kind == diffInsert {
+				line = b[op.b]
+			} else {
+				line = a[op.a]
+			}
+			fmt.Fprintf(&sb, "%c%s\n", op.kind, line)
+		}
+		i = end
+	}
+	return sb.String()
+}
+
+// hunkRange formats a range of lines like diff -u does; start is 0-based.
+func hunkRange(start, n int) string {
+	switch n {
+	case 0:
+		// An empty range is given as the line before it
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
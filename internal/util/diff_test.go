@@ -0,0 +1,109 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	lines := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(s, "\n")
+	}
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"a\nb\nc", "a\nb\nc", ""},
+		{"", "x", "--- A\n+++ B\n@@ -0,0 +1 @@\n+x\n"},
+		{"x", "", "--- A\n+++ B\n@@ -1 +0,0 @@\n-x\n"},
+		{
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12",
+			"1\n2\n3\n4\nfour\n5\n6\n7\n8\n9\n11\n12",
+			"--- A\n+++ B\n" +
+				"@@ -2,11 +2,11 @@\n 2\n 3\n 4\n+four\n 5\n 6\n 7\n 8\n 9\n-10\n 11\n 12\n",
+		},
+		{
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15",
+			"one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\nfifteen",
+			"--- A\n+++ B\n" +
+				"@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n" +
+				"@@ -12,4 +12,4 @@\n 12\n 13\n 14\n-15\n+fifteen\n",
+		},
+	}
+	for _, tc := range tests {
+		if got := UnifiedDiff("A", "B", lines(tc.a), lines(tc.b), 3); got != tc.want {
+			t.Errorf("UnifiedDiff(%q, %q) =\n%s\nwant\n%s", tc.a, tc.b, got, tc.want)
+		}
+	}
+
+	// The edit script must turn a into b, and not be longer than needed
+	rnd := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		res := make([]string, rnd.Intn(30))
+		for i := range res {
+			res[i] = string(rune('a' + rnd.Intn(4)))
+		}
+		return res
+	}
+	for i := 0; i < 500; i++ {
+		a, b := randomLines(), randomLines()
+		var got []string
+		edits := 0
+		for _, op := range diffLines(a, b) {
+			switch op.kind {
+			case diffEqual:
+				got = append(got, a[op.a])
+			case diffInsert:
+				got = append(got, b[op.b])
+				edits++
+			default:
+				edits++
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(b, ",") {
+			t.Fatalf("Edit script for %v -> %v yields %v", a, b, got)
+		}
+		if want := len(a) + len(b) - 2*lcs(a, b); edits != want {
+			t.Fatalf("Edit script for %v -> %v has %d edits, want %d", a, b, edits, want)
+		}
+	}
+}
+
+func lcs(a, b []string) int {
+	dp := make([][]int, len(a)+1)
+	for i := range dp {
+		dp[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				dp[i][j] = dp[i+1][j+1] + 1
+			} else {
+				dp[i][j] = max(dp[i+1][j], dp[i][j+1])
+			}
+		}
+	}
+	return dp[0][0]
+}
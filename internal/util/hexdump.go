@@ -55,3 +55,13 @@ func HexDump(data []byte, start, len int) string {
 	}
 	return res
 }
+
+// HexDumpAt is like HexDump for all of data, but the offsets shown start at
+// base, e.g. when data was read from the middle of a file.
+func HexDumpAt(data []byte, base int) string {
+	res := ""
+	for start := 0; start < len(data); start += 16 {
+		res += fmt.Sprintf("%08x: %s\n", base+start, hexLine(data[start:], min(16, len(data)-start)))
+	}
+	return res
+}
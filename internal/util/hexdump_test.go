@@ -0,0 +1,36 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import "testing"
+
+func TestHexDumpAt(t *testing.T) {
+	data := []byte("0123456789abcdefXY")
+	want := "00001000: 30  31  32  33  34  35  36  37  38  39  61  62  63  64  65  66  | 0123456789abcdef\n" +
+		"00001010: 58  59  | XY\n"
+	if got := HexDumpAt(data, 0x1000); got != want {
+		t.Errorf("HexDumpAt = %q, want %q", got, want)
+	}
+	if got, want := HexDumpAt(data, 0), HexDump(data, 0, len(data)); got != want {
+		t.Errorf("HexDumpAt(0) = %q, HexDump gives %q", got, want)
+	}
+	if got := HexDumpAt(nil, 16); got != "" {
+		t.Errorf("HexDumpAt(nil) = %q, want \"\"", got)
+	}
+}
@@ -19,10 +19,13 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -32,7 +35,6 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
-	"github.com/asig/odit/internal/disk"
 	"github.com/asig/odit/internal/filesystem"
 	"github.com/asig/odit/internal/fuse"
 )
@@ -44,8 +46,24 @@ const (
 var (
 	flagImage    = flag.String("image", "", "Image to work on")
 	flagLogLevel = newLogLevelFlag(zerolog.ErrorLevel, "log-level", "Log level (trace, debug, info, warn, error, fatal, panic)")
+	flagAlloc    = flag.String("alloc", "next", "Sector allocation policy (next, firstfit, random)")
+	flagFormat   = flag.String("format", formatText, "Output format (text, json, csv)")
 )
 
+// newAllocator returns the allocation policy called name. seed is only
+// used by the random policy.
+func newAllocator(name string, seed int64) (filesystem.Allocator, error) {
+	switch name {
+	case "next":
+		return filesystem.NextFreeAllocator{}, nil
+	case "firstfit":
+		return filesystem.FirstFitAllocator{}, nil
+	case "random":
+		return filesystem.NewRandomAllocator(seed), nil
+	}
+	return nil, fmt.Errorf("%w: unknown allocation policy %q", errUsage, name)
+}
+
 func newLogLevelFlag(value zerolog.Level, name string, usage string) *logLevelFlag {
 	p := &logLevelFlag{level: value}
 	flag.Var(p, name, usage)
@@ -79,114 +97,673 @@ func usage() {
 
 Flags:  
    -image <image>
-       Specifies the image to work on
+       Specifies the image to work on. Only help, build, cp, diff, shell
+       and script can do without.
 
    -log-level <level>
        Sets the log level (trace, debug, info, warn, error, fatal, panic)
 	   Default is 'error'
+
+   -alloc <policy>
+       Sets where new sectors are placed: 'next' puts them on the first free
+       sector after the file's last one (like Oberon does), 'firstfit' looks
+       for a free extent large enough for the whole file, and 'random'
+       scatters them over the disk. Default is 'next'
+
+   -format <format>
+       Sets the output format of the commands: 'text', 'json' or 'csv'.
+       Default is 'text'. Dates are Oberon's local time, so they're written
+       without a time zone, e.g. 2025-03-01T12:30:00
        
+Patterns can contain "*", which matches any sequence of characters, and
+"?", which matches any single character. Quote them to keep the shell from
+expanding them. Commands can be chained. A command always takes the
+arguments it requires, even if they're named like a command; optional
+arguments end at the next command name. Use ";" to end a command's
+arguments explicitly, or "--" to make it take everything up to the next ";".
+
 Commands:
    help:
 	   Shows this help message
 
-   list:
-       Lists files in the image   
-
-   info <file>:
-       Shows information about <file> in the image
+   build [-o <image>] <spec>:
+       Creates the image described by the JSON file <spec> at <image>, or
+       at the "output" given in <spec>. <spec> gives the image's geometry,
+       its Oberon partition, an optional boot block and boot file, the
+       allocation policy, and the files, read from the host or given
+       inline, together with their dates. Files without a date get the one
+       given in <spec>, or SOURCE_DATE_EPOCH. With fixed dates, the same
+       <spec> always gives the same image, byte for byte. See README.md
+       for the format.
+
+   list [-l] [-sort name|size|date] [-r] [<pattern>]:
+       Lists files in the image, or the ones matching <pattern>. With -l,
+       also shows size, creation time, header address, number of sectors
+       and number of fragments. -sort sets the order, -r reverses it.
+
+   info <pattern>:
+       Shows information about the files matching <pattern> in the image
+
+   find [<expression>] [-print|-print0|-json|-export <dir>|-delete]...:
+       Runs the actions on the files matching <expression>, which is made
+       of -name <pattern>, -regex <re>, -size N|+N|-N|MIN..MAX,
+       -before <date>, -after <date>, -fragmented, -sectors A[..B] and
+       -damaged, joined with -and (implied), -or, ! and parentheses.
+       -print lists the names and is the default, -print0 separates them
+       with NUL, -json shows details as JSON, -export copies the files to
+       <dir>, and -delete removes them.
 
    read <src> <dest>:
-       Copies file from <src> in the image to <dest> on host's file system
-
-   write <src> <dest>:
-       Copies file from <src> on host's file system to <dest> in the image
+       Copies file from <src> in the image to <dest> on host's file system.
+       If <dest> is "-", the file is written to stdout.
+
+   read -r <pattern> <dir>:
+       Copies all files matching <pattern> to directory <dir> on host's
+       file system. <dir> is created if it doesn't exist.
+
+   write [-f|-backup] [-mtime] <src> <dest>:
+       Copies file from <src> on host's file system to <dest> in the image.
+       If <src> is "-", the file is read from stdin.
+
+   write -r [-f|-backup] [-mtime] <src>...:
+       Copies all files <src> on host's file system to the image, using
+       their base names. <src> can contain wildcards.
+
+       By default, write fails if the file already exists in the image.
+       With -f, its contents are replaced, keeping its header sector.
+       With -backup, the old file is renamed to <dest>.Bak first.
+       With -mtime, the file's date is set to the modification time of
+       <src> instead of the current time.
+
+   import [-map base|dotted] [-invalid reject|transliterate] [-manifest]
+          [-mtime] [-f|-backup] [-dry-run] <hostdir>
+   import [options] -tar <file>
+   import [options] -zip <file>:
+       Copies all files below <hostdir> to the image. Hidden files and
+       directories (e.g. .git) are skipped. With -map base (default),
+       sub/Foo.Mod becomes Foo.Mod; with -map dotted, Sub.Foo.Mod. Names
+       Oberon doesn't accept are rejected, or with -invalid transliterate,
+       changed ("foo_bar.Mod" becomes "fooBar.Mod"). Nothing is written if
+       two files map to the same name, or if a file exists in the image and
+       neither -f nor -backup is given (see write). If writing fails, e.g.
+       because the disk is full, the files imported so far stay in the
+       image. With -manifest, the names and dates recorded in
+       <hostdir>/odit-manifest.json by export are restored. With -mtime, the
+       files' dates are set to their modification times (see write). With
+       -dry-run, only shows what would be imported.
+       With -tar or -zip, the files are taken from a tar (optionally gzip
+       compressed) or zip archive instead, and get the dates recorded in
+       the archive.
+
+   export <dir>
+   export -tar <file>
+   export -zip <file>:
+       Copies all files to directory <dir> on host's file system, setting
+       their modification times to the files' dates, and writes
+       odit-manifest.json with the name, size, date and header address of
+       each file. With -tar or -zip, the files are written to a tar or zip
+       archive instead, or to stdout if <file> is "-".
+
+   sync [-reverse] [-delete] [-force] [-dry-run] [-state <file>] <hostdir>:
+       Brings the image up to date with the files in <hostdir>, or with
+       -reverse, <hostdir> up to date with the image. Files are compared by
+       content; existing files are updated in place (see write -f). With
+       -delete, files missing on the other side are deleted. The contents
+       after each sync are recorded in <hostdir>/.odit-sync.json, or in
+       <file> given with -state, to tell which side changed since. Files
+       that changed on both sides, or that are newer in the destination if
+       there was no sync yet, are conflicts and left alone unless -force is
+       given. Files changed only in the destination are skipped. With
+       -dry-run, only shows what would be done.
+
+   touch [-d <date>] <pattern>...:
+       Sets the date of the files matching <pattern> to <date>, or to the
+       current time. <date> is "YYYY-MM-DD [hh:mm:ss]" or RFC 3339. A file
+       that doesn't exist is created, unless <pattern> contains wildcards.
+
+   rm <pattern>...:
+       Removes the files matching <pattern> from the directory. Like in
+       Oberon, their sectors are only freed when the image is opened again.
+
+   mv <old> <new>:
+       Renames file <old> in the image to <new>. Fails if <new> exists.
+
+   cp [-conflict fail|skip|overwrite|backup] <src> <dst>
+   cp [-conflict ...] -from [<image>:]<pattern> -to [<image>:][<name>]:
+       Copies file <src> in the image to <dst>, keeping its creation time.
+       With -from and -to, copies the files matching <pattern> from one
+       image to another, e.g. -from a.img:*.Tool -to b.img: . Without
+       <image>, the image given with -image is used; without <name>, the
+       copies keep their names. -conflict tells what to do if a copy
+       exists: fail (default), skip the file, overwrite it (see write -f),
+       or keep the old version as <name>.Bak (see write -backup).
+
+   diff [-u] [-ignore-dates] <image|dir> <image|dir>:
+       Compares two images, or an image and a host directory as written by
+       export, and lists the files that were added, removed or changed in
+       size, date or content. With -u, shows the changes in text files as
+       unified diff. With -ignore-dates, differing dates are ignored.
+
+   grep [-i] [-l] [-text] <regexp> [<pattern>]:
+       Shows the lines matching <regexp> in all files, or in the files
+       matching <pattern>. -i ignores case, -l only shows the names of the
+       files. With -text, Oberon Text documents are searched without their
+       header, which otherwise makes them binary files, of which only a
+       match is reported.
+
+   hash [<pattern>]:
+       Shows name, size, date and SHA-256 of all files, or of the files
+       matching <pattern>. Save the output as manifest for verify.
+
+   verify [-ignore-dates] <manifest>:
+       Checks the image against <manifest>, as written by hash in any
+       format, or read from stdin if <manifest> is "-". Reports files whose
+       size, date or hash differ, files that are missing, and files that
+       aren't listed. With -ignore-dates, differing dates are ignored.
+
+   dump sector <addr>
+   dump file [-offset <n>] [-len <n>] <name>
+   dump header <name>
+   dump dirpage [<addr>]
+   dump index <addr>
+   dump bootblock
+   dump mbr:
+       Shows the raw structures on disk. sector and file show a hex dump of
+       the sector at <addr>, or of <n> bytes of file <name> from -offset
+       on. The others decode a structure: the header of file <name> with
+       its mark, name, aleng, bleng, date, extension and sector tables;
+       the directory page at <addr> (default is the root) with m, p0 and
+       its entries; the index sector at <addr>; the boot block of the
+       Oberon partition; and the partition table in the MBR. Sector
+       addresses are multiples of 29, as in the tables.
+
+   defrag [-files <pattern>]:
+       Moves the sectors of all files, or of the files matching <pattern>,
+       so that every file occupies consecutive sectors. Sectors of other
+       files might be moved out of the way.
+
+   df:
+       Shows the number of total, used and free sectors and bytes, the
+       number of files and directory pages, and the largest file
+
+   usage [-png <file>]:
+       Shows which sectors are used for what, how many sectors and runs of
+       adjacent sectors every file has, and a summary. With -png, the
+       allocation map is also written to <file>, one pixel per sector.
 
    mount <mountpoint>:
        Mounts the image at <mountpoint> using FUSE; does not return until unmounted
+
+   shell:
+       Reads commands from the terminal until "exit" or end of input, all
+       on the image opened once. Words are separated by blanks; quote them
+       with '...', "..." or \. "#" starts a comment. Failing commands are
+       reported, but don't end the shell. Tab completes command and file
+       names; the history is kept in ~/.odit_history.
+
+   script [-stop-on-error] <file>:
+       Runs the commands in <file>, or read from stdin if <file> is "-",
+       one line at a time like shell does. Failing lines are reported and
+       make script fail at the end; with -stop-on-error, the first one
+       ends the script.
+
+Exit status:
+   0 on success, 1 on general errors, 2 on usage errors, 3 if a file was not
+   found, 4 if a file already exists, 5 for invalid file names, 6 if the disk
+   is full, 7 if a file grows too large, 8 if the image is corrupt, 9 if sync
+   found conflicts, 10 if verify found differences, 11 if grep found no
+   match, and 12 if diff found differences.
 `, os.Args[0])
-	os.Exit(1)
 }
 
-func readFromImage(fs *filesystem.FileSystem, src, dest string) {
-	f, err := fs.Find(src)
+func readFromImage(fs *filesystem.FileSystem, src, dest string) error {
+	f, err := fs.Open(src)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error finding file %s: %s\n", src, err)
-		return
+		return fmt.Errorf("error finding file %s: %w", src, err)
 	}
-	if f == nil {
-		fmt.Fprintf(os.Stderr, "File not found: %s\n", src)
-		return
+	defer f.Close()
+
+	var out io.Writer = os.Stdout
+	if dest != "-" {
+		outFile, err := os.Create(dest)
+		if err != nil {
+			return fmt.Errorf("error creating file %s: %w", dest, err)
+		}
+		defer outFile.Close()
+		out = outFile
 	}
 
-	buf, err := f.ReadAt(0, f.Size())
+	n, err := io.Copy(out, f)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading file %s: %s\n", src, err)
-		return
+		return fmt.Errorf("error copying %s to %s: %w", src, dest, err)
 	}
 
-	outFile, err := os.Create(dest)
+	fmt.Fprintf(os.Stderr, "Copied %d bytes from %s to %s\n", n, src, dest)
+	return nil
+}
+
+// writeMode tells what write does if the target file already exists.
+type writeMode int
+
+const (
+	writeNew     writeMode = iota // fail with ErrExists
+	writeReplace                  // replace the contents, keeping the header
+	writeBackup                   // rename the old file to <name>.Bak
+)
+
+// writeToImage copies the host file src to dest in the image. If keepMtime is
+// set, dest's date is set to src's modification time.
+func writeToImage(fs *filesystem.FileSystem, src, dest string, mode writeMode, keepMtime bool) error {
+	if src == "-" {
+		return storeFile(fs, os.Stdin, -1, time.Time{}, src, dest, mode)
+	}
+	in, err := os.Open(src)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating file %s: %s\n", dest, err)
-		return
+		return fmt.Errorf("error opening file %s: %w", src, err)
+	}
+	defer in.Close()
+	size := int64(-1)
+	var date time.Time
+	if fi, err := in.Stat(); err == nil {
+		if fi.Mode().IsRegular() {
+			size = fi.Size()
+		}
+		if keepMtime {
+			date = fi.ModTime()
+		}
+	}
+	return storeFile(fs, in, size, date, src, dest, mode)
+}
+
+// storeFile copies in, which has size bytes unless size is negative, to dest
+// in the image. If date isn't zero, it becomes dest's date. src is the name
+// of in for messages.
+func storeFile(fs *filesystem.FileSystem, in io.Reader, size int64, date time.Time, src, dest string, mode writeMode) error {
+	// Fail early rather than after copying everything. Whether dest exists
+	// is decided again when the new file is registered.
+	switch _, err := fs.Find(dest); {
+	case err == nil && mode == writeNew:
+		return fmt.Errorf("error creating file %s in image: %w: %s", dest, filesystem.ErrExists, dest)
+	case err != nil && !errors.Is(err, filesystem.ErrNotFound):
+		return fmt.Errorf("error creating file %s in image: %w", dest, err)
 	}
-	defer outFile.Close()
 
-	_, err = outFile.Write(buf)
+	// The new contents go into a file that isn't registered yet, so that
+	// the directory only changes once everything is written.
+	f, err := fs.NewFile(dest)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error writing to file %s: %s\n", dest, err)
-		return
+		return fmt.Errorf("error creating file %s in image: %w", dest, err)
+	}
+	n, err := fillFile(f, in, size)
+	if err == nil && !date.IsZero() {
+		err = f.SetCreationTime(date)
+	}
+	if err == nil {
+		switch mode {
+		case writeNew:
+			err = f.Register()
+		case writeBackup:
+			err = fs.RegisterWithBackup(f, dest+".Bak")
+		default:
+			err = fs.RegisterOrReplace(f)
+		}
+	}
+	if err != nil {
+		if derr := f.Discard(); derr != nil {
+			log.Error().Err(derr).Msgf("Can't free sectors of %s", dest)
+		}
+		return fmt.Errorf("error writing %s to %s: %w", src, dest, err)
 	}
 
-	fmt.Printf("Copied %d bytes from %s to %s\n", len(buf), src, dest)
+	fmt.Fprintf(os.Stderr, "Copied %d bytes from %s to %s\n", n, src, dest)
+	return nil
+}
+
+// fillFile copies in to the empty file f. If size isn't negative, it's the
+// expected number of bytes.
+func fillFile(f *filesystem.File, in io.Reader, size int64) (n int64, err error) {
+	// If we know the size, reserve the sectors up front so that the
+	// allocator can keep them together.
+	if size > 0 && size <= filesystem.MaxFileSize {
+		if err := f.Reserve(size); err != nil {
+			return 0, err
+		}
+		// The input may have shrunk in the meantime
+		defer func() {
+			if rerr := f.Reserve(0); err == nil {
+				err = rerr
+			}
+		}()
+	}
+	return io.Copy(f, in)
 }
 
-func writeToImage(fs *filesystem.FileSystem, src, dest string) {
-	buf, err := os.ReadFile(src)
+// fileColumns are the columns of fileRow.
+var fileColumns = []column{
+	{"name", "Name"},
+	{"size", "Size"},
+	{"created", "Created"},
+	{"header", "Header"},
+	{"sectors", "Sectors"},
+	{"fragments", "Fragments"},
+}
+
+// fileRow returns the details of f shown by "list -l" and "info".
+func fileRow(f *filesystem.File) ([]any, error) {
+	secs, err := f.Sectors()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading file %s: %s\n", src, err)
-		return
+		return nil, fmt.Errorf("file %s: %w", f.Name(), err)
 	}
+	frags, err := f.Fragments()
+	if err != nil {
+		return nil, fmt.Errorf("file %s: %w", f.Name(), err)
+	}
+	return []any{f.Name(), f.Size(), f.CreationTime(), f.HeaderAddr(), len(secs), frags}, nil
+}
 
-	f, err := fs.NewFile(dest)
+// listFiles lists the files matching pattern, sorted by sortBy (name, size
+// or date).
+func listFiles(fs *filesystem.FileSystem, pattern string, long bool, sortBy string, reverse bool) error {
+	files, err := fs.ListFiles(filesystem.NameMatches(pattern))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating file %s in image: %s\n", dest, err)
-		return
+		return fmt.Errorf("error listing files: %w", err)
+	}
+
+	var cmp func(a, b *filesystem.File) int
+	switch sortBy {
+	case "name":
+		cmp = func(a, b *filesystem.File) int { return strings.Compare(a.Name(), b.Name()) }
+	case "size":
+		cmp = func(a, b *filesystem.File) int { return int(a.Size()) - int(b.Size()) }
+	case "date":
+		cmp = func(a, b *filesystem.File) int { return a.CreationTime().Compare(b.CreationTime()) }
+	default:
+		return fmt.Errorf("%w: can't sort by %q, must be one of name, size, date", errUsage, sortBy)
 	}
-	f.Register()
-	err = f.WriteAt(0, buf)
+	slices.SortStableFunc(files, func(a, b *filesystem.File) int {
+		if reverse {
+			return cmp(b, a)
+		}
+		return cmp(a, b)
+	})
+
+	if !long {
+		t := newTable("files", styleBare, column{"name", "Name"})
+		for _, f := range files {
+			t.add(f.Name())
+		}
+		return printTables(t)
+	}
+	t := newTable("files", styleColumns, fileColumns...)
+	for _, f := range files {
+		row, err := fileRow(f)
+		if err != nil {
+			return err
+		}
+		t.add(row...)
+	}
+	return printTables(t)
+}
+
+// matchingFiles returns the files matching pattern. It fails if there are
+// none.
+func matchingFiles(fs *filesystem.FileSystem, pattern string) ([]*filesystem.File, error) {
+	files, err := fs.ListFiles(filesystem.NameMatches(pattern))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error writing to file %s in image: %s\n", dest, err)
-		return
+		return nil, fmt.Errorf("error listing files: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%w: no file matches %s", filesystem.ErrNotFound, pattern)
 	}
+	return files, nil
+}
 
-	fmt.Printf("Copied %d bytes from %s to %s\n", len(buf), src, dest)
+func fileInfo(fs *filesystem.FileSystem, pattern string) error {
+	files, err := matchingFiles(fs, pattern)
+	if err != nil {
+		return fmt.Errorf("error getting file info: %w", err)
+	}
+	t := newTable("files", styleRecord, fileColumns...)
+	for _, f := range files {
+		row, err := fileRow(f)
+		if err != nil {
+			return err
+		}
+		t.add(row...)
+	}
+	return printTables(t)
 }
 
-func listFiles(fs *filesystem.FileSystem) {
-	entries, err := fs.ListFiles(filesystem.AllFiles)
+// readFilesFromImage copies all files matching pattern to dir, which is
+// created if necessary.
+func readFilesFromImage(fs *filesystem.FileSystem, pattern, dir string) error {
+	files, err := matchingFiles(fs, pattern)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error listing files: %s\n", err)
-		return
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating directory %s: %w", dir, err)
 	}
-	for _, de := range entries {
-		fmt.Println(de.Name())
+	for _, f := range files {
+		if err := readFromImage(fs, f.Name(), filepath.Join(dir, f.Name())); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func fileInfo(fs *filesystem.FileSystem, file string) {
-	f, err := fs.Find(file)
+// writeFilesToImage copies the host files in srcs to the image, using their
+// base names. Wildcards in srcs are expanded, in case the shell didn't.
+func writeFilesToImage(fs *filesystem.FileSystem, srcs []string, mode writeMode, keepMtime bool) error {
+	for _, src := range srcs {
+		paths := []string{src}
+		if filesystem.IsPattern(src) {
+			var err error
+			paths, err = filepath.Glob(src)
+			if err != nil {
+				return fmt.Errorf("%w: invalid pattern %s: %s", errUsage, src, err)
+			}
+			if len(paths) == 0 {
+				return fmt.Errorf("%w: no file matches %s", filesystem.ErrNotFound, src)
+			}
+		}
+		for _, path := range paths {
+			if err := writeToImage(fs, path, filepath.Base(path), mode, keepMtime); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeFiles removes the files matching any of patterns from the directory.
+func removeFiles(fs *filesystem.FileSystem, patterns []string) error {
+	for _, pattern := range patterns {
+		if !filesystem.IsPattern(pattern) {
+			if err := filesystem.ValidateFilename(pattern); err != nil {
+				return fmt.Errorf("error removing %s: %w", pattern, err)
+			}
+		}
+		files, err := matchingFiles(fs, pattern)
+		if err != nil {
+			return fmt.Errorf("error removing %s: %w", pattern, err)
+		}
+		for _, f := range files {
+			if err := fs.Remove(f.Name()); err != nil {
+				return fmt.Errorf("error removing %s: %w", f.Name(), err)
+			}
+			fmt.Fprintf(os.Stderr, "Removed %s\n", f.Name())
+		}
+	}
+	return nil
+}
+
+// touchFiles sets the date of the files matching patterns to t. Like the Unix
+// command, it creates files that don't exist, unless a pattern is given.
+func touchFiles(fs *filesystem.FileSystem, patterns []string, t time.Time) error {
+	for _, pattern := range patterns {
+		var files []*filesystem.File
+		if filesystem.IsPattern(pattern) {
+			var err error
+			if files, err = matchingFiles(fs, pattern); err != nil {
+				return fmt.Errorf("error touching %s: %w", pattern, err)
+			}
+		} else {
+			f, err := fs.Find(pattern)
+			if errors.Is(err, filesystem.ErrNotFound) {
+				f, err = fs.Create(pattern)
+			}
+			if err != nil {
+				return fmt.Errorf("error touching %s: %w", pattern, err)
+			}
+			files = []*filesystem.File{f}
+		}
+		for _, f := range files {
+			if err := f.SetCreationTime(t); err != nil {
+				return fmt.Errorf("error touching %s: %w", f.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseDate parses a date given on the command line. Dates without a time
+// zone are local time.
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range []string{time.DateTime, "2006-01-02T15:04:05", time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, use YYYY-MM-DD [hh:mm:ss] or RFC 3339", s)
+	}
+	return t.Local(), nil
+}
+
+func moveFile(fs *filesystem.FileSystem, oldName, newName string) error {
+	if err := fs.Rename(oldName, newName, false); err != nil {
+		return fmt.Errorf("error renaming %s to %s: %w", oldName, newName, err)
+	}
+	fmt.Fprintf(os.Stderr, "Renamed %s to %s\n", oldName, newName)
+	return nil
+}
+
+// What cp does if a target file exists, see the -conflict flag
+const (
+	conflictFail      = "fail"
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictBackup    = "backup"
+)
+
+// splitImageSpec splits "<image>:<name>" into its parts. Without a colon,
+// the image is empty.
+func splitImageSpec(spec string) (image, name string) {
+	// Oberon names can't contain colons, but host paths can
+	if i := strings.LastIndexByte(spec, ':'); i >= 0 {
+		return spec[:i], spec[i+1:]
+	}
+	return "", spec
+}
+
+// specImage returns the file system of the image in spec; fs if it doesn't
+// name one.
+func specImage(fs *filesystem.FileSystem, spec string) (*filesystem.FileSystem, string, error) {
+	image, name := splitImageSpec(spec)
+	if image == "" {
+		if fs == nil {
+			return nil, "", fmt.Errorf("%w: no image specified for %s", errUsage, spec)
+		}
+		return fs, name, nil
+	}
+	imageFS, err := images.open(image)
+	return imageFS, name, err
+}
+
+// copyFiles copies the files matching from, "[<image>:]<pattern>", to to,
+// "[<image>:][<name>]", keeping their dates. Without a name, the copies keep
+// the names of the originals. conflict tells what to do if a copy exists
+// already.
+func copyFiles(fs *filesystem.FileSystem, from, to, conflict string) error {
+	mode := writeNew
+	switch conflict {
+	case conflictFail, conflictSkip:
+	case conflictOverwrite:
+		mode = writeReplace
+	case conflictBackup:
+		mode = writeBackup
+	default:
+		return fmt.Errorf("%w: unknown conflict policy %q, must be %s, %s, %s or %s", errUsage, conflict, conflictFail, conflictSkip, conflictOverwrite, conflictBackup)
+	}
+
+	srcFS, pattern, err := specImage(fs, from)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting file info: %s\n", err)
-		return
+		return err
+	}
+	dstFS, dstName, err := specImage(fs, to)
+	if err != nil {
+		return err
+	}
+	if pattern == "" {
+		pattern = "*"
+	}
+	if !filesystem.IsPattern(pattern) {
+		if err := filesystem.ValidateFilename(pattern); err != nil {
+			return fmt.Errorf("error copying %s: %w", from, err)
+		}
+	}
+	files, err := matchingFiles(srcFS, pattern)
+	if err != nil {
+		return fmt.Errorf("error copying %s: %w", from, err)
+	}
+	if dstName != "" && (filesystem.IsPattern(pattern) || len(files) > 1) {
+		return fmt.Errorf("%w: can't copy several files to %s", errUsage, to)
 	}
-	if f == nil {
-		fmt.Fprintf(os.Stderr, "File not found: %s\n", file)
-		return
+
+	for _, f := range files {
+		name := dstName
+		if name == "" {
+			name = f.Name()
+		}
+		if srcFS == dstFS && name == f.Name() {
+			return fmt.Errorf("error copying %s: %w: source and destination are the same", f.Name(), filesystem.ErrExists)
+		}
+		if conflict == conflictSkip {
+			if _, err := dstFS.Find(name); err == nil {
+				fmt.Fprintf(os.Stderr, "Skipped %s: %s exists\n", f.Name(), name)
+				continue
+			}
+		}
+		in := io.NewSectionReader(f, 0, int64(f.Size()))
+		if err := storeFile(dstFS, in, int64(f.Size()), f.CreationTime(), f.Name(), name, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func defrag(fs *filesystem.FileSystem, pattern string) error {
+	stats, err := fs.Defrag(filesystem.NameMatches(pattern), func(done, total int, name string) {
+		fmt.Fprintf(os.Stderr, "[%d/%d] %s\n", done, total, name)
+	})
+	if err != nil {
+		return fmt.Errorf("error defragmenting: %w", err)
 	}
-	fmt.Printf("File: %s\n", f.Name())
-	fmt.Printf("1st block @ %d\n", f.HeaderAddr())
-	fmt.Printf("Size: %d bytes\n", f.Size())
-	fmt.Printf("Creation Time: %s\n", f.CreationTime().Format(time.DateTime))
+	t := newTable("defrag", styleRecord,
+		column{"files", "Files"},
+		column{"moved", "Files moved"},
+		column{"skipped", "Files that could not be made contiguous"},
+		column{"sectors_moved", "Sectors moved"},
+		column{"fragments_before", "Fragments of these files before"},
+		column{"fragments_after", "Fragments of these files after"},
+		column{"total_fragments_before", "Fragments of all files before"},
+		column{"total_fragments_after", "Fragments of all files after"},
+	)
+	t.add(stats.Files, stats.Moved, stats.Skipped, stats.SectorsMoved,
+		stats.FragmentsBefore, stats.FragmentsAfter, stats.TotalFragmentsBefore, stats.TotalFragmentsAfter)
+	return printTables(t)
 }
 
 func initLogging(level zerolog.Level) {
@@ -207,7 +784,7 @@ func initLogging(level zerolog.Level) {
 
 }
 
-func mount(fs *filesystem.FileSystem, mountpoint string) {
+func mount(fs *filesystem.FileSystem, mountpoint string) error {
 	fmt.Printf("Mounting image to %s...\n", mountpoint)
 
 	// FUSE-Verbindung aufbauen
@@ -217,8 +794,7 @@ func mount(fs *filesystem.FileSystem, mountpoint string) {
 		bazil_fuse.Subtype("native-oberon-fs"),
 	)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error mounting FUSE filesystem: %s\n", err)
-		return
+		return fmt.Errorf("error mounting FUSE filesystem: %w", err)
 	}
 	defer c.Close()
 
@@ -226,85 +802,61 @@ func mount(fs *filesystem.FileSystem, mountpoint string) {
 	fmt.Printf("Image available at %s, unmount to continue.\n", mountpoint)
 	err = bazil_fuse_fs.Serve(c, fuse.NewFS(fs))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error serving FUSE filesystem: %s\n", err)
+		return fmt.Errorf("error serving FUSE filesystem: %w", err)
 	}
+	return nil
 }
 
 func main() {
-	fmt.Printf("Oberon Disk Image Tool %s\n", version)
-	fmt.Printf("Copyright (c) 2025 Andreas Signer <asigner@gmail.com>\n")
-	fmt.Printf("https://github.com/asig/odit\n")
+	os.Exit(run())
+}
+
+func run() int {
+	// Keep stdout clean for the commands' output, e.g. "read <file> -"
+	fmt.Fprintf(os.Stderr, "Oberon Disk Image Tool %s\n", version)
+	fmt.Fprintf(os.Stderr, "Copyright (c) 2025 Andreas Signer <asigner@gmail.com>\n")
+	fmt.Fprintf(os.Stderr, "https://github.com/asig/odit\n")
 
 	flag.Usage = usage
 	flag.Parse()
 
 	initLogging(flagLogLevel.Get())
 
-	if *flagImage == "" {
-		fmt.Fprintf(os.Stderr, "no image specified\n")
+	switch *flagFormat {
+	case formatText, formatJSON, formatCSV:
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *flagFormat)
 		usage()
-		os.Exit(1)
+		return exitUsage
 	}
 
-	disk, err := disk.Open(*flagImage)
+	allocator, err := newAllocator(*flagAlloc, time.Now().UnixNano())
 	if err != nil {
-		log.Error().Err(err).Msg("Can't open image")
-		os.Exit(1)
-	}
-	defer disk.Close()
-
-	fs := filesystem.New(disk)
-	defer fs.Close()
-
-	args := flag.Args()
-	pos := 0
-	for pos < len(args) {
-		switch args[pos] {
-		case "mount":
-			pos++
-			if pos >= len(args) {
-				fmt.Fprintf(os.Stderr, "not enough arguments for mount command. Format is \"mount <mountpoint>\"\n")
-				os.Exit(1)
-			}
-			mountpoint := args[pos]
-			pos++
-			mount(fs, mountpoint)
-		case "list":
-			pos++
-			listFiles(fs)
-		case "info":
-			pos++
-			if pos >= len(args) {
-				fmt.Fprintf(os.Stderr, "not enough arguments for info command. Format is \"info <file>\"\n")
-				os.Exit(1)
-			}
-			file := args[pos]
-			pos++
-			fileInfo(fs, file)
-		case "read":
-			pos++
-			if pos+2 > len(args) {
-				fmt.Fprintf(os.Stderr, "not enough arguments for read command. Format is \"read <src> <dest>\"\n")
-				os.Exit(1)
-			}
-			src := args[pos]
-			dest := args[pos+1]
-			pos += 2
-			readFromImage(fs, src, dest)
-		case "write":
-			pos++
-			if pos+2 > len(args) {
-				fmt.Fprintf(os.Stderr, "not enough arguments for write command. Format is \"write <src> <dest>\"\n")
-				os.Exit(1)
-			}
-			src := args[pos]
-			dest := args[pos+1]
-			pos += 2
-			writeToImage(fs, src, dest)
-		default:
-			fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[pos])
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		usage()
+		return exitUsage
+	}
+
+	// Commands that don't need -image get a nil file system
+	images.allocator = allocator
+	var fs *filesystem.FileSystem
+	if *flagImage != "" {
+		if fs, err = images.open(*flagImage); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return exitCode(err)
+		}
+	}
+
+	err = runCommands(fs, flag.Args())
+	if closeErr := images.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		if errors.Is(err, errUsage) {
 			usage()
-			os.Exit(1)
 		}
+		return exitCode(err)
 	}
+	return exitOK
 }
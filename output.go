@@ -0,0 +1,232 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Output formats, see the -format flag
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+// tableDate is the format of dates in JSON and CSV output. Oberon doesn't
+// know about time zones, so the dates are local time without one.
+const tableDate = "2006-01-02T15:04:05"
+
+// textStyle tells how a table is printed in text format.
+type textStyle int
+
+const (
+	styleColumns textStyle = iota // aligned columns with a header line
+	styleBare                     // aligned columns without a header line
+	styleRecord                   // "label: value" lines, a blank line between rows
+)
+
+type column struct {
+	key   string // used in JSON and CSV
+	label string // used in text
+}
+
+// table is what commands print on stdout. Depending on -format, it's printed
+// as text, JSON or CSV.
+type table struct {
+	name    string // key of the table if a command prints several as JSON
+	columns []column
+	rows    [][]any
+	style   textStyle
+}
+
+func newTable(name string, style textStyle, columns ...column) *table {
+	return &table{name: name, style: style, columns: columns}
+}
+
+func (t *table) add(values ...any) {
+	t.rows = append(t.rows, values)
+}
+
+// printTables prints tables to stdout in the format selected with -format.
+// As JSON, a record table with a single row becomes an object, any other
+// table an array of objects; several tables are wrapped in an object.
+func printTables(tables ...*table) error {
+	return writeTables(os.Stdout, *flagFormat, tables...)
+}
+
+func writeTables(w io.Writer, format string, tables ...*table) error {
+	switch format {
+	case formatJSON:
+		var buf bytes.Buffer
+		if len(tables) == 1 {
+			tables[0].writeJSON(&buf)
+		} else {
+			buf.WriteString("{")
+			for i, t := range tables {
+				if i > 0 {
+					buf.WriteString(",")
+				}
+				writeJSONValue(&buf, t.name)
+				buf.WriteString(":")
+				t.writeJSON(&buf)
+			}
+			buf.WriteString("}")
+		}
+		var out bytes.Buffer
+		if err := json.Indent(&out, buf.Bytes(), "", "  "); err != nil {
+			return err
+		}
+		out.WriteString("\n")
+		_, err := w.Write(out.Bytes())
+		return err
+	case formatCSV:
+		for i, t := range tables {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			if err := t.writeCSV(w); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i, t := range tables {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		if err := t.writeText(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeJSON writes t with the keys in column order, which encoding/json
+// can't do for maps.
+func (t *table) writeJSON(buf *bytes.Buffer) {
+	asObject := t.style == styleRecord && len(t.rows) == 1
+	if !asObject {
+		buf.WriteString("[")
+	}
+	for r, row := range t.rows {
+		if r > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("{")
+		for c, col := range t.columns {
+			if c > 0 {
+				buf.WriteString(",")
+			}
+			writeJSONValue(buf, col.key)
+			buf.WriteString(":")
+			writeJSONValue(buf, row[c])
+		}
+		buf.WriteString("}")
+	}
+	if !asObject {
+		buf.WriteString("]")
+	}
+}
+
+func writeJSONValue(buf *bytes.Buffer, v any) {
+	if t, ok := v.(time.Time); ok {
+		v = t.Format(tableDate)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		// Only happens for types we never put into tables
+		panic(err)
+	}
+	buf.Write(data)
+}
+
+func (t *table) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	header := make([]string, len(t.columns))
+	for i, col := range t.columns {
+		header[i] = col.key
+	}
+	cw.Write(header)
+	for _, row := range t.rows {
+		record := make([]string, len(row))
+		for i, v := range row {
+			switch v := v.(type) {
+			case nil:
+				// Missing value, null in JSON
+			case time.Time:
+				record[i] = v.Format(tableDate)
+			default:
+				record[i] = fmt.Sprint(v)
+			}
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (t *table) writeText(w io.Writer) error {
+	text := func(v any) string {
+		switch v := v.(type) {
+		case nil:
+			return ""
+		case time.Time:
+			return v.Format(time.DateTime)
+		}
+		return fmt.Sprint(v)
+	}
+
+	if t.style == styleRecord {
+		for r, row := range t.rows {
+			if r > 0 {
+				fmt.Fprintln(w)
+			}
+			for c, col := range t.columns {
+				fmt.Fprintf(w, "%s: %s\n", col.label, text(row[c]))
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if t.style == styleColumns {
+		labels := make([]string, len(t.columns))
+		for i, col := range t.columns {
+			labels[i] = col.label
+		}
+		fmt.Fprintln(tw, strings.Join(labels, "\t"))
+	}
+	for _, row := range t.rows {
+		values := make([]string, len(row))
+		for i, v := range row {
+			values[i] = text(v)
+		}
+		fmt.Fprintln(tw, strings.Join(values, "\t"))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,79 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWriteTables(t *testing.T) {
+	created := time.Date(2025, 3, 1, 12, 30, 0, 0, time.UTC)
+	files := newTable("files", styleColumns, column{"name", "Name"}, column{"size", "Size"}, column{"created", "Created"})
+	files.add("Zeta.Mod", 12, created)
+	files.add("Alpha, Beta.Txt", 3456, created)
+	summary := newTable("summary", styleRecord, column{"files", "Files"})
+	summary.add(2)
+
+	tests := []struct {
+		format string
+		tables []*table
+		want   string
+	}{
+		{formatText, []*table{files, summary}, "" +
+			"Name             Size  Created\n" +
+			"Zeta.Mod         12    2025-03-01 12:30:00\n" +
+			"Alpha, Beta.Txt  3456  2025-03-01 12:30:00\n" +
+			"\n" +
+			"Files: 2\n"},
+		{formatCSV, []*table{files}, "" +
+			"name,size,created\n" +
+			"Zeta.Mod,12,2025-03-01T12:30:00\n" +
+			"\"Alpha, Beta.Txt\",3456,2025-03-01T12:30:00\n"},
+		// Keys keep the column order
+		{formatJSON, []*table{files, summary}, `{
+  "files": [
+    {
+      "name": "Zeta.Mod",
+      "size": 12,
+      "created": "2025-03-01T12:30:00"
+    },
+    {
+      "name": "Alpha, Beta.Txt",
+      "size": 3456,
+      "created": "2025-03-01T12:30:00"
+    }
+  ],
+  "summary": {
+    "files": 2
+  }
+}
+`},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		if err := writeTables(&buf, tc.format, tc.tables...); err != nil {
+			t.Fatalf("%s: writeTables failed: %v", tc.format, err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.format, got, tc.want)
+		}
+	}
+}
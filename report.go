@@ -0,0 +1,203 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strings"
+
+	"github.com/asig/odit/internal/filesystem"
+)
+
+const (
+	stripWidth   = 64 // characters per line of the ASCII map
+	stripMaxRows = 32
+	pngWidth     = 256 // sectors per line of the PNG
+)
+
+var (
+	useChars = map[filesystem.SectorUse]byte{
+		filesystem.SectorFree:     '.',
+		filesystem.SectorDirPage:  'D',
+		filesystem.SectorHeader:   'H',
+		filesystem.SectorIndex:    'I',
+		filesystem.SectorData:     '#',
+		filesystem.SectorReserved: 'R',
+	}
+	useColors = map[filesystem.SectorUse]color.RGBA{
+		filesystem.SectorFree:     {0xf0, 0xf0, 0xf0, 0xff},
+		filesystem.SectorDirPage:  {0x20, 0x40, 0xd0, 0xff},
+		filesystem.SectorHeader:   {0xd0, 0x20, 0x20, 0xff},
+		filesystem.SectorIndex:    {0xf0, 0x90, 0x00, 0xff},
+		filesystem.SectorData:     {0x20, 0xa0, 0x40, 0xff},
+		filesystem.SectorReserved: {0x80, 0x80, 0x80, 0xff},
+	}
+)
+
+// usageReport shows the allocation map of the image. It doesn't write to the
+// image.
+func usageReport(fs *filesystem.FileSystem, pngFile string) error {
+	m, err := fs.AllocationMap()
+	if err != nil {
+		return fmt.Errorf("error building allocation map: %w", err)
+	}
+
+	files, summary := usageTables(m)
+	if *flagFormat == formatText {
+		printStrip(m)
+		fmt.Println()
+		if err := printTables(files, summary); err != nil {
+			return err
+		}
+	} else {
+		if err := printTables(extentTable(m), files, summary); err != nil {
+			return err
+		}
+	}
+
+	if pngFile != "" {
+		if err := writeUsagePNG(m, pngFile); err != nil {
+			return fmt.Errorf("error writing %s: %w", pngFile, err)
+		}
+	}
+	return nil
+}
+
+// usageTables returns the tables of usageReport that describe the files and
+// sum up the map.
+func usageTables(m *filesystem.AllocationMap) (files, summary *table) {
+	files = newTable("files", styleColumns, column{"name", "File"}, column{"sectors", "Sectors"}, column{"runs", "Runs"})
+	for _, f := range m.Files {
+		files.add(f.Name, f.Sectors, f.Runs)
+	}
+	total := len(m.Use) - 1
+	free := m.Count(filesystem.SectorFree)
+	summary = newTable("summary", styleRecord,
+		column{"sectors", "Sectors"},
+		column{"used", "Used"},
+		column{"free", "Free"},
+		column{"largest_free_extent", "Largest free extent"},
+		column{"dir_pages", "Directory pages"},
+		column{"dir_depth", "Directory depth"},
+	)
+	summary.add(total, total-free, free, m.LargestFreeExtent(), m.DirPages, m.DirDepth)
+	return files, summary
+}
+
+// extentTable lists the runs of sectors with the same use. It takes the
+// place of the strip in formats other than text.
+func extentTable(m *filesystem.AllocationMap) *table {
+	extents := newTable("map", styleColumns, column{"start", "Start"}, column{"length", "Length"}, column{"use", "Use"})
+	for i := 1; i < len(m.Use); {
+		j := i
+		for j < len(m.Use) && m.Use[j] == m.Use[i] {
+			j++
+		}
+		extents.add(i, j-i, m.Use[i].String())
+		i = j
+	}
+	return extents
+}
+
+// printStrip prints the allocation map. If there are too many sectors, every
+// character stands for several sectors, and shows what most of them are
+// used for.
+func printStrip(m *filesystem.AllocationMap) {
+	secs := m.Use[1:]
+	perChar := (len(secs) + stripWidth*stripMaxRows - 1) / (stripWidth * stripMaxRows)
+
+	var legend []string
+	for u := filesystem.SectorFree; u <= filesystem.SectorReserved; u++ {
+		legend = append(legend, fmt.Sprintf("%c %s", useChars[u], u))
+	}
+	fmt.Printf("Allocation map, %d sector(s) per character: %s\n", perChar, strings.Join(legend, ", "))
+
+	var line strings.Builder
+	for i := 0; i < len(secs); i += perChar {
+		if i%(stripWidth*perChar) == 0 {
+			if line.Len() > 0 {
+				fmt.Println(line.String())
+				line.Reset()
+			}
+			fmt.Fprintf(&line, "%8d ", i+1)
+		}
+		line.WriteByte(useChars[dominantUse(secs[i:min(i+perChar, len(secs))])])
+	}
+	fmt.Println(line.String())
+}
+
+// dominantUse returns the most frequent use in secs. Ties go to anything but
+// free sectors.
+func dominantUse(secs []filesystem.SectorUse) filesystem.SectorUse {
+	var counts [filesystem.SectorReserved + 1]int
+	for _, u := range secs {
+		counts[u]++
+	}
+	best := filesystem.SectorFree
+	for u := range counts {
+		if counts[u] > counts[best] || (counts[u] > 0 && counts[u] == counts[best] && best == filesystem.SectorFree) {
+			best = filesystem.SectorUse(u)
+		}
+	}
+	return best
+}
+
+// writeUsagePNG writes the allocation map as a PNG with one pixel per sector.
+func writeUsagePNG(m *filesystem.AllocationMap, name string) error {
+	secs := m.Use[1:]
+	img := image.NewRGBA(image.Rect(0, 0, pngWidth, (len(secs)+pngWidth-1)/pngWidth))
+	for i, u := range secs {
+		img.SetRGBA(i%pngWidth, i/pngWidth, useColors[u])
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func diskFree(fs *filesystem.FileSystem) error {
+	return printTables(diskFreeTable(fs.Stats()))
+}
+
+func diskFreeTable(s filesystem.Stats) *table {
+	t := newTable("df", styleRecord,
+		column{"total_sectors", "Total sectors"},
+		column{"used_sectors", "Used sectors"},
+		column{"free_sectors", "Free sectors"},
+		column{"total_bytes", "Total bytes"},
+		column{"used_bytes", "Used bytes"},
+		column{"free_bytes", "Free bytes"},
+		column{"files", "Files"},
+		column{"dir_pages", "Directory pages"},
+		column{"largest_file", "Largest file"},
+		column{"largest_file_size", "Largest file size"},
+	)
+	t.add(s.TotalSectors, s.UsedSectors, s.FreeSectors, s.TotalBytes, s.UsedBytes, s.FreeBytes,
+		s.Files, s.DirPages, s.LargestFile, s.LargestFileSize)
+	return t
+}
@@ -0,0 +1,118 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/asig/odit/internal/filesystem"
+)
+
+// openReportImage builds an image with a few files and opens it.
+func openReportImage(t *testing.T) (*filesystem.FileSystem, string) {
+	t.Helper()
+	dir := t.TempDir()
+	spec := filepath.Join(dir, "spec.json")
+	if err := os.WriteFile(spec, []byte(`{"geometry": {"size": "1M"}, "partition": {"start": 1}, "files": [
+		{"name": "A.Mod", "content": "MODULE A; END A."},
+		{"name": "B.Text", "content": "`+string(bytes.Repeat([]byte("b"), 5000))+`"}
+	]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.img")
+	if err := buildImage(spec, path); err != nil {
+		t.Fatalf("buildImage failed: %v", err)
+	}
+	fs, err := images.open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { images.close() })
+	return fs, path
+}
+
+func TestUsageReport(t *testing.T) {
+	fs, path := openReportImage(t)
+	// The directory changes in memory only
+	if err := fs.Remove("A.Mod"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pngFile := filepath.Join(t.TempDir(), "usage.png")
+	if err := usageReport(fs, pngFile); err != nil {
+		t.Fatalf("usageReport failed: %v", err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, before) {
+		t.Errorf("usageReport changed the image")
+	}
+	if _, err := os.Stat(pngFile); err != nil {
+		t.Errorf("No PNG written: %v", err)
+	}
+
+	m, err := fs.AllocationMap()
+	if err != nil {
+		t.Fatalf("AllocationMap failed: %v", err)
+	}
+	files, summary := usageTables(m)
+	if len(files.rows) != 1 || files.rows[0][0] != "B.Text" || files.rows[0][1] != 3 {
+		t.Errorf("Files are %v, want B.Text with 3 sectors", files.rows)
+	}
+	stats := fs.Stats()
+	// sectors, used, free, largest free extent, dir pages, dir depth
+	row := summary.rows[0]
+	if row[0] != int(stats.TotalSectors) || row[1] != int(stats.UsedSectors) || row[2] != int(stats.FreeSectors) || row[4] != 1 || row[5] != 1 {
+		t.Errorf("Summary is %v, want %d sectors, %d used, %d free and one directory page", row, stats.TotalSectors, stats.UsedSectors, stats.FreeSectors)
+	}
+
+	var extents int
+	for _, row := range extentTable(m).rows {
+		extents += row[1].(int)
+	}
+	if extents != int(stats.TotalSectors) {
+		t.Errorf("Extents cover %d sectors, want %d", extents, stats.TotalSectors)
+	}
+}
+
+func TestDiskFree(t *testing.T) {
+	fs, _ := openReportImage(t)
+	s := fs.Stats()
+	if s.UsedSectors+s.FreeSectors != s.TotalSectors {
+		t.Errorf("%d used and %d free sectors don't add up to %d", s.UsedSectors, s.FreeSectors, s.TotalSectors)
+	}
+	// The root page, a header for each file, two data sectors for B.Text,
+	// and the last sector, which holds the index
+	if s.UsedSectors != 6 {
+		t.Errorf("%d sectors used, want 6", s.UsedSectors)
+	}
+
+	row := diskFreeTable(s).rows[0]
+	want := []any{s.TotalSectors, uint32(6), s.FreeSectors, s.TotalBytes, uint64(6 * 2048), s.FreeBytes, 2, 1, "B.Text", uint32(5000)}
+	for i := range want {
+		if row[i] != want[i] {
+			t.Errorf("Column %d is %v (%T), want %v (%T)", i, row[i], row[i], want[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,271 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/asig/odit/internal/filesystem"
+	"golang.org/x/term"
+)
+
+const (
+	shellPrompt      = "odit> "
+	shellHistoryName = ".odit_history"
+	shellHistorySize = 100 // what term.Terminal keeps
+)
+
+// inShell is set while the shell runs, so that it doesn't start again.
+var inShell bool
+
+// splitLine splits a line of the shell or of a script into words. Words
+// are separated by blanks; single and double quotes keep blanks in words,
+// and a backslash quotes the next character. "#" at the start of a word
+// starts a comment.
+func splitLine(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case r == '#' && !inWord:
+			return words, nil
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	switch {
+	case quote != 0:
+		return nil, fmt.Errorf("%w: missing closing %c", errUsage, quote)
+	case escaped:
+		return nil, fmt.Errorf("%w: backslash at end of line", errUsage)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// runLine runs the commands on a line of the shell or of a script.
+func runLine(fs *filesystem.FileSystem, line string) error {
+	args, err := splitLine(line)
+	if err != nil || len(args) == 0 {
+		return err
+	}
+	if err := runCommands(fs, args); err != nil {
+		return err
+	}
+	if fs != nil {
+		// Keep the image consistent in case odit is killed
+		return fs.Flush()
+	}
+	return nil
+}
+
+// runScript runs the lines read from name, or from stdin if name is "-".
+// Failing lines are reported; with stopOnError, the first one ends the
+// script.
+func runScript(fs *filesystem.FileSystem, name string, stopOnError bool) error {
+	in := os.Stdin
+	if name != "-" {
+		var err error
+		if in, err = os.Open(name); err != nil {
+			return fmt.Errorf("error opening script: %w", err)
+		}
+		defer in.Close()
+	}
+
+	failed := 0
+	lines := 0
+	sc := bufio.NewScanner(in)
+	for sc.Scan() {
+		lines++
+		if err := runLine(fs, sc.Text()); err != nil {
+			if stopOnError {
+				return fmt.Errorf("%s:%d: %w", name, lines, err)
+			}
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", name, lines, err)
+			failed++
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("error reading %s: %w", name, err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%s: %d of %d lines failed", name, failed, lines)
+	}
+	return nil
+}
+
+// runShell reads commands from the terminal until "exit" or end of input.
+// If stdin isn't a terminal, it reads the commands like a script.
+func runShell(fs *filesystem.FileSystem) error {
+	if inShell {
+		return fmt.Errorf("%w: already running the shell", errUsage)
+	}
+	inShell = true
+	defer func() { inShell = false }()
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return runScript(fs, "-", false)
+	}
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, shellPrompt)
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return completeLine(fs, line, pos)
+	}
+	history := loadShellHistory(t)
+	if history != nil {
+		defer history.Close()
+	}
+
+	for {
+		// Commands print as usual, so the terminal is only raw while
+		// reading the line
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		if w, h, err := term.GetSize(fd); err == nil && w > 0 {
+			t.SetSize(w, h)
+		}
+		line, err := t.ReadLine()
+		term.Restore(fd, state)
+		if err == io.EOF {
+			fmt.Println()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if history != nil {
+			fmt.Fprintln(history, line)
+		}
+		if line == "exit" || line == "quit" {
+			return nil
+		}
+		if err := runLine(fs, line); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+	}
+}
+
+// loadShellHistory adds the lines of earlier sessions to t's history. It
+// returns the history file, to append new lines to, or nil if there is
+// none.
+func loadShellHistory(t *term.Terminal) *os.File {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	path := filepath.Join(home, shellHistoryName)
+	if data, err := os.ReadFile(path); err == nil {
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		for _, line := range lines[max(len(lines)-shellHistorySize, 0):] {
+			if line != "" {
+				t.History.Add(line)
+			}
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil
+	}
+	return f
+}
+
+// completeLine completes the word before pos: the first word on the line to
+// a command name, the others to file names in the image. If there are
+// several candidates, it completes as far as they agree.
+func completeLine(fs *filesystem.FileSystem, line string, pos int) (string, int, bool) {
+	start := strings.LastIndexAny(line[:pos], " \t") + 1
+	prefix := line[start:pos]
+
+	var candidates []string
+	if strings.TrimSpace(line[:start]) == "" {
+		for _, cmd := range commands {
+			if strings.HasPrefix(cmd.name, prefix) {
+				candidates = append(candidates, cmd.name+" ")
+			}
+		}
+	} else if fs != nil && !strings.HasPrefix(prefix, "-") {
+		files, err := fs.ListFiles(filesystem.NameMatches(prefix + "*"))
+		if err != nil {
+			return "", 0, false
+		}
+		for _, f := range files {
+			candidates = append(candidates, f.Name()+" ")
+		}
+	}
+	if len(candidates) == 0 {
+		return "", 0, false
+	}
+
+	common := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(common) <= len(prefix) {
+		return "", 0, false
+	}
+	return line[:start] + common + line[pos:], start + len(common), true
+}
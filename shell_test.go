@@ -0,0 +1,74 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"  list -l  ", []string{"list", "-l"}},
+		{`write "My File.txt" Foo.Text`, []string{"write", "My File.txt", "Foo.Text"}},
+		{`write 'a "b"' c\ d`, []string{"write", `a "b"`, "c d"}},
+		{`list "*.Mod" # all modules`, []string{"list", "*.Mod"}},
+		{"# just a comment", nil},
+		{`read A#B x`, []string{"read", "A#B", "x"}},
+		{`touch ""`, []string{"touch", ""}},
+	}
+	for _, test := range tests {
+		got, err := splitLine(test.line)
+		if err != nil {
+			t.Errorf("splitLine(%q) failed: %v", test.line, err)
+			continue
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("splitLine(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+
+	for _, line := range []string{`list "*.Mod`, `list \`} {
+		if _, err := splitLine(line); err == nil {
+			t.Errorf("splitLine(%q) didn't fail", line)
+		}
+	}
+}
+
+func TestCompleteLine(t *testing.T) {
+	tests := []struct {
+		line, want string
+		ok         bool
+	}{
+		{"lis", "list ", true},
+		{"d", "", false}, // defrag, df, diff
+		{"de", "defrag ", true},
+		{"list -l xyz", "", false},
+	}
+	for _, test := range tests {
+		got, pos, ok := completeLine(nil, test.line, len(test.line))
+		if ok != test.ok || ok && (got != test.want || pos != len(test.want)) {
+			t.Errorf("completeLine(%q) = %q, %d, %v; want %q, %v", test.line, got, pos, ok, test.want, test.ok)
+		}
+	}
+}
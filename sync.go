@@ -0,0 +1,354 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/asig/odit/internal/filesystem"
+	"github.com/rs/zerolog/log"
+)
+
+// syncStateName is the default state file of sync, in the host directory.
+// Being hidden, it's never synced itself.
+const syncStateName = ".odit-sync.json"
+
+// syncState records the contents of the files after the last sync, so that
+// the next one can tell which side changed.
+type syncState struct {
+	Images map[string]map[string]string `json:"images"` // image path -> name -> hash
+}
+
+func readSyncState(path string) (*syncState, error) {
+	state := &syncState{Images: make(map[string]map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	if state.Images == nil {
+		state.Images = make(map[string]map[string]string)
+	}
+	return state, nil
+}
+
+func (s *syncState) write(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Actions of sync
+const (
+	syncCopy     = "copy"
+	syncUpdate   = "update"
+	syncDelete   = "delete"
+	syncSkip     = "skip"
+	syncConflict = "conflict"
+)
+
+// syncOptions are the flags of the sync command.
+type syncOptions struct {
+	reverse   bool // from the image to the host
+	delete    bool
+	force     bool // resolve conflicts in favor of the source
+	dryRun    bool
+	stateFile string
+}
+
+// syncAction is what sync does with one file.
+type syncAction struct {
+	name   string
+	action string // "" if nothing needs to be done
+	reason string
+	hash   string // what both sides contain afterwards, if they're in sync
+}
+
+// hostSyncFiles returns the files in dir that can be synced, i.e. all
+// regular files with valid names that aren't hidden.
+func hostSyncFiles(dir string) (map[string]diffFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]diffFile)
+	for _, e := range entries {
+		if !e.Type().IsRegular() || isHidden(e.Name()) || e.Name() == manifestName {
+			continue
+		}
+		if err := filesystem.ValidateFilename(e.Name()); err != nil {
+			log.Warn().Msgf("Not syncing %s: %s", e.Name(), err)
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		files[e.Name()] = hostDiffFile(filepath.Join(dir, e.Name()), info)
+	}
+	return files, nil
+}
+
+// planSync decides what to do with each file. last holds the hashes after
+// the previous sync, or is nil if there was none. Without it, the newer
+// file wins, and -delete deletes everything that's not in src.
+func planSync(src, dst map[string]diffFile, last map[string]string, srcName, dstName string, opts syncOptions) ([]syncAction, error) {
+	var names []string
+	for name := range src {
+		names = append(names, name)
+	}
+	for name := range dst {
+		if _, ok := src[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var actions []syncAction
+	for _, name := range names {
+		s, inSrc := src[name]
+		d, inDst := dst[name]
+		lastHash, known := last[name]
+		a := syncAction{name: name}
+
+		var srcHash, dstHash string
+		var err error
+		if inSrc {
+			if srcHash, err = s.hash(); err != nil {
+				return nil, fmt.Errorf("error reading %s in %s: %w", name, srcName, err)
+			}
+			a.hash = srcHash
+		}
+		if inDst {
+			if dstHash, err = d.hash(); err != nil {
+				return nil, fmt.Errorf("error reading %s in %s: %w", name, dstName, err)
+			}
+		}
+
+		switch {
+		case inSrc && inDst:
+			switch {
+			case srcHash == dstHash:
+			case known && dstHash == lastHash:
+				a.action = syncUpdate
+			case known && srcHash == lastHash:
+				a.action, a.reason = syncSkip, "changed in "+dstName+" only"
+			case known:
+				a.action, a.reason = syncConflict, "changed on both sides"
+			case !s.date.Before(d.date):
+				a.action = syncUpdate
+			default:
+				a.action, a.reason = syncConflict, "newer in "+dstName
+			}
+		case inSrc:
+			a.action = syncCopy
+			if known && srcHash == lastHash {
+				a.action, a.reason = syncSkip, "deleted in "+dstName
+			}
+		default:
+			if !opts.delete {
+				if !known {
+					continue
+				}
+				// Keep it in the state, for a later -delete
+				a.hash = lastHash
+				break
+			}
+			a.action = syncDelete
+			switch {
+			case known && dstHash != lastHash:
+				a.action, a.reason = syncConflict, "changed in "+dstName
+			case !known && last != nil:
+				a.action, a.reason = syncConflict, "new in "+dstName
+			}
+		}
+
+		if a.action == syncConflict && opts.force {
+			a.reason += ", forced"
+			switch {
+			case !inSrc:
+				a.action = syncDelete
+			case !inDst:
+				a.action = syncCopy
+			default:
+				a.action = syncUpdate
+			}
+		}
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
+
+// syncDir brings the image up to date with the files in dir, or with
+// reverse, dir up to date with the image. Existing files are updated in
+// place. Conflicting files are left alone and make syncDir fail.
+func syncDir(fs *filesystem.FileSystem, image, dir string, opts syncOptions) error {
+	if opts.stateFile == "" {
+		opts.stateFile = filepath.Join(dir, syncStateName)
+	}
+	state, err := readSyncState(opts.stateFile)
+	if err != nil {
+		return fmt.Errorf("error reading sync state: %w", err)
+	}
+	if abs, err := filepath.Abs(image); err == nil {
+		image = abs
+	}
+	last := state.Images[image]
+
+	hostFiles, err := hostSyncFiles(dir)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", dir, err)
+	}
+	files, err := fs.ListFiles(filesystem.AllFiles)
+	if err != nil {
+		return fmt.Errorf("error listing files: %w", err)
+	}
+	imageFiles := make(map[string]diffFile)
+	for _, f := range files {
+		imageFiles[f.Name()] = imageDiffFile(f)
+	}
+
+	src, dst := hostFiles, imageFiles
+	srcName, dstName := "directory", "image"
+	if opts.reverse {
+		src, dst = imageFiles, hostFiles
+		srcName, dstName = dstName, srcName
+	}
+	actions, err := planSync(src, dst, last, srcName, dstName, opts)
+	if err != nil {
+		return err
+	}
+
+	next := make(map[string]string)
+	t := newTable("sync", styleColumns, column{"name", "Name"}, column{"action", "Action"}, column{"reason", "Reason"})
+	counts := make(map[string]int)
+	for _, a := range actions {
+		if !opts.dryRun {
+			if err := applySync(fs, dir, a, src[a.name], opts.reverse); err != nil {
+				return err
+			}
+		}
+		switch a.action {
+		case "", syncCopy, syncUpdate:
+			next[a.name] = a.hash
+		case syncSkip, syncConflict:
+			if h, ok := last[a.name]; ok {
+				next[a.name] = h
+			}
+		}
+		if a.action == "" {
+			continue
+		}
+		t.add(a.name, a.action, a.reason)
+		counts[a.action]++
+	}
+	if !opts.dryRun {
+		state.Images[image] = next
+		if err := state.write(opts.stateFile); err != nil {
+			return fmt.Errorf("error writing sync state: %w", err)
+		}
+	}
+
+	summary := newTable("summary", styleRecord,
+		column{"copied", "Copied"},
+		column{"updated", "Updated"},
+		column{"deleted", "Deleted"},
+		column{"skipped", "Skipped"},
+		column{"conflicts", "Conflicts"},
+		column{"dry_run", "Dry run"},
+	)
+	summary.add(counts[syncCopy], counts[syncUpdate], counts[syncDelete], counts[syncSkip], counts[syncConflict], opts.dryRun)
+	if err := printTables(t, summary); err != nil {
+		return err
+	}
+	if n := counts[syncConflict]; n > 0 {
+		return fmt.Errorf("%w: %d files changed on both sides, use -force to overwrite", errConflict, n)
+	}
+	return nil
+}
+
+// applySync carries out a, with src being the source file.
+func applySync(fs *filesystem.FileSystem, dir string, a syncAction, src diffFile, reverse bool) error {
+	path := filepath.Join(dir, a.name)
+	switch {
+	case a.action == syncDelete && reverse:
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("error deleting %s: %w", path, err)
+		}
+	case a.action == syncDelete:
+		if err := fs.Remove(a.name); err != nil {
+			return fmt.Errorf("error deleting %s: %w", a.name, err)
+		}
+	case a.action != syncCopy && a.action != syncUpdate:
+	case reverse:
+		if err := writeHostFile(path, src); err != nil {
+			return fmt.Errorf("error writing %s to %s: %w", a.name, path, err)
+		}
+	default:
+		in, err := src.open()
+		if err != nil {
+			return fmt.Errorf("error opening %s: %w", path, err)
+		}
+		defer in.Close()
+		mode := writeNew
+		if a.action == syncUpdate {
+			mode = writeReplace
+		}
+		return storeFile(fs, in, src.size, src.date, path, a.name, mode)
+	}
+	return nil
+}
+
+// writeHostFile writes f to path, overwriting an existing file in place,
+// and sets its modification time to f's date.
+func writeHostFile(path string, f diffFile) error {
+	in, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	d := f.date
+	mtime := time.Date(d.Year(), d.Month(), d.Day(), d.Hour(), d.Minute(), d.Second(), 0, time.Local)
+	return os.Chtimes(path, mtime, mtime)
+}
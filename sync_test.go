@@ -0,0 +1,157 @@
+/*
+ * This file is part of then Oberon Disk Image Tool ("odit")
+ * Copyright (C) 2025 Andreas Signer <asigner@gmail.com>
+ *
+ * odit is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * odit is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with odit.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanSync(t *testing.T) {
+	older := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	file := func(content string, date time.Time) diffFile {
+		return diffFile{
+			size: int64(len(content)),
+			date: date,
+			open: func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(content)), nil },
+		}
+	}
+	hash := func(content string) string {
+		h, _ := hashFile(strings.NewReader(content))
+		return h
+	}
+
+	src := map[string]diffFile{
+		"Same.Mod":    file("same", older),
+		"New.Mod":     file("new", older),
+		"Changed.Mod": file("changed", older),
+		"DstOnly.Mod": file("old", older),
+		"Both.Mod":    file("src", older),
+		"Gone.Mod":    file("gone", older),
+	}
+	dst := map[string]diffFile{
+		"Same.Mod":    file("same", newer),
+		"Changed.Mod": file("old", newer),
+		"DstOnly.Mod": file("dst", newer),
+		"Both.Mod":    file("dst", newer),
+		"Extra.Mod":   file("extra", newer),
+		"Stale.Mod":   file("stale", newer),
+	}
+	last := map[string]string{
+		"Same.Mod":    hash("same"),
+		"Changed.Mod": hash("old"),
+		"DstOnly.Mod": hash("old"),
+		"Both.Mod":    hash("old"),
+		"Gone.Mod":    hash("gone"),
+		"Stale.Mod":   hash("stale"),
+	}
+
+	tests := []struct {
+		last map[string]string
+		opts syncOptions
+		want map[string]string
+	}{
+		{last, syncOptions{}, map[string]string{
+			"Same.Mod":    "",
+			"New.Mod":     syncCopy,
+			"Changed.Mod": syncUpdate,
+			"DstOnly.Mod": syncSkip,
+			"Both.Mod":    syncConflict,
+			"Gone.Mod":    syncSkip,
+			"Stale.Mod":   "",
+		}},
+		{last, syncOptions{delete: true}, map[string]string{
+			"Same.Mod":    "",
+			"New.Mod":     syncCopy,
+			"Changed.Mod": syncUpdate,
+			"DstOnly.Mod": syncSkip,
+			"Both.Mod":    syncConflict,
+			"Gone.Mod":    syncSkip,
+			"Extra.Mod":   syncConflict,
+			"Stale.Mod":   syncDelete,
+		}},
+		{last, syncOptions{delete: true, force: true}, map[string]string{
+			"Same.Mod":    "",
+			"New.Mod":     syncCopy,
+			"Changed.Mod": syncUpdate,
+			"DstOnly.Mod": syncSkip,
+			"Both.Mod":    syncUpdate,
+			"Gone.Mod":    syncSkip,
+			"Extra.Mod":   syncDelete,
+			"Stale.Mod":   syncDelete,
+		}},
+		// Without a previous sync, the newer file wins
+		{nil, syncOptions{delete: true}, map[string]string{
+			"Same.Mod":    "",
+			"New.Mod":     syncCopy,
+			"Changed.Mod": syncConflict,
+			"DstOnly.Mod": syncConflict,
+			"Both.Mod":    syncConflict,
+			"Gone.Mod":    syncCopy,
+			"Extra.Mod":   syncDelete,
+			"Stale.Mod":   syncDelete,
+		}},
+	}
+	for i, test := range tests {
+		actions, err := planSync(src, dst, test.last, "src", "dst", test.opts)
+		if err != nil {
+			t.Fatalf("%d: planSync failed: %v", i, err)
+		}
+		got := make(map[string]string)
+		for _, a := range actions {
+			got[a.name] = a.action
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%d: got actions %v, want %v", i, got, test.want)
+			continue
+		}
+		for name, want := range test.want {
+			if action, ok := got[name]; !ok || action != want {
+				t.Errorf("%d: %s: got %q, want %q", i, name, action, want)
+			}
+		}
+	}
+}
+
+func TestSyncStateKey(t *testing.T) {
+	// The image isn't named by -image, as in scripts and the shell
+	fs, image := openReportImage(t)
+	dir := t.TempDir()
+	state := filepath.Join(t.TempDir(), "state.json")
+	if err := cmdSync(fs, []string{"-reverse", "-state", state, dir}); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	s, err := readSyncState(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs, _ := filepath.Abs(image)
+	if _, ok := s.Images[abs]; !ok || len(s.Images) != 1 {
+		t.Errorf("state keys = %v, want only %s", s.Images, abs)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "A.Mod")); err != nil {
+		t.Errorf("A.Mod not synced: %v", err)
+	}
+}